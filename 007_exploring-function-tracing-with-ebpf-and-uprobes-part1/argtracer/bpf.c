@@ -0,0 +1,151 @@
+//go:build ignore
+
+#include <linux/bpf.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "ctx.h"
+
+char __license[] SEC("license") = "Dual MIT/GPL";
+
+// Values captured per call, and bytes copied of each string
+#define MAX_ARGS 16
+#define MAX_STRING_SIZE 64
+
+// Go internal ABI on amd64 (https://go.dev/s/regabi): integer arguments are passed in
+// RAX, RBX, RCX, RDI, RSI, R8, R9, R10 and R11, the others on the stack
+#define GO_REG_STACK 0xff
+
+#define ARG_VALUE  0 // Up to 8 bytes, interpreted by user space according to the type
+#define ARG_STRING 1 // Data pointer and length of a string
+
+// Where a value is at the function entry
+struct go_location {
+    __s32 stack_offset; // From the stack pointer, if reg is GO_REG_STACK
+    __s32 deref_offset; // If deref is set, the location holds a pointer and the value is this many bytes further
+    __u8 reg; // Index of the integer register, or GO_REG_STACK
+    __u8 deref;
+    __u8 size; // Bytes of the value, 8 at most
+    __u8 pad;
+};
+
+struct go_arg_spec {
+    __u8 kind; // ARG_*
+    __u8 pad[3];
+    struct go_location loc; // Value, or data pointer of a string
+    struct go_location len_loc; // Length of a string
+};
+
+// What to capture when a function is called, set by user space from the DWARF of the binary
+struct go_func_spec {
+    __u32 nargs;
+    struct go_arg_spec args[MAX_ARGS];
+};
+
+struct arg_event {
+    __u64 cookie; // Index of the function
+    __u32 pid;
+    __u32 tid;
+    __u64 values[MAX_ARGS]; // Value, or length of a string
+    __u8 errors[MAX_ARGS]; // 1 if the value couldn't be read
+    __u8 strings[MAX_ARGS][MAX_STRING_SIZE];
+};
+
+// Indexed by the cookie of the uprobe
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 256);
+    __type(key, __u32);
+    __type(value, struct go_func_spec);
+} func_specs SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 1024 * 1024);
+} arg_events SEC(".maps");
+
+static __always_inline __u64 go_register(struct pt_regs *ctx, __u8 reg) {
+    switch (reg) {
+    case 0: return ctx->ax;
+    case 1: return ctx->bx;
+    case 2: return ctx->cx;
+    case 3: return ctx->di;
+    case 4: return ctx->si;
+    case 5: return ctx->r8;
+    case 6: return ctx->r9;
+    case 7: return ctx->r10;
+    case 8: return ctx->r11;
+    }
+    return 0;
+}
+
+static __always_inline int read_location(struct pt_regs *ctx, struct go_location *loc, __u64 *value) {
+    __u64 v = 0;
+    if (loc->reg == GO_REG_STACK) {
+        // Stack slots are 8 byte aligned, user space masks what's beyond the value
+        if (bpf_probe_read_user(&v, sizeof(v), (void *)(ctx->sp + loc->stack_offset)) != 0) {
+            return -1;
+        }
+    } else {
+        v = go_register(ctx, loc->reg);
+    }
+
+    if (loc->deref) {
+        __u64 ptr = v;
+        __u32 size = loc->size;
+        v = 0;
+        if (size == 0 || size > sizeof(v)) {
+            return -1;
+        }
+        if (bpf_probe_read_user(&v, size, (void *)(ptr + loc->deref_offset)) != 0) {
+            return -1;
+        }
+    }
+    *value = v;
+    return 0;
+}
+
+SEC("uprobe/go_function")
+int go_function(struct pt_regs *ctx) {
+    __u32 key = bpf_get_attach_cookie(ctx);
+    struct go_func_spec *spec = bpf_map_lookup_elem(&func_specs, &key);
+    if (!spec) {
+        return 0;
+    }
+
+    struct arg_event *e = bpf_ringbuf_reserve(&arg_events, sizeof(*e), 0);
+    if (!e) {
+        return 0;
+    }
+    __u64 id = bpf_get_current_pid_tgid();
+    e->cookie = key;
+    e->pid = id >> 32;
+    e->tid = id;
+
+    for (int i = 0; i < MAX_ARGS; i++) {
+        if (i >= spec->nargs) {
+            break;
+        }
+        struct go_arg_spec *arg = &spec->args[i];
+        __u64 value = 0;
+        e->values[i] = 0;
+        e->errors[i] = read_location(ctx, &arg->loc, &value) != 0;
+        if (e->errors[i] || arg->kind != ARG_STRING) {
+            e->values[i] = value;
+            continue;
+        }
+
+        __u64 len = 0;
+        if (read_location(ctx, &arg->len_loc, &len) != 0) {
+            e->errors[i] = 1;
+            continue;
+        }
+        e->values[i] = len;
+        __u32 n = len < MAX_STRING_SIZE ? len : MAX_STRING_SIZE;
+        if (n > 0 && bpf_probe_read_user(e->strings[i], n, (void *)value) != 0) {
+            e->errors[i] = 1;
+        }
+    }
+
+    bpf_ringbuf_submit(e, 0);
+    return 0;
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"strings"
+)
+
+// Go internal ABI on amd64 (https://go.dev/s/regabi)
+const (
+	intRegs   = 9  // RAX, RBX, RCX, RDI, RSI, R8, R9, R10, R11
+	floatRegs = 15 // X0 to X14
+	ptrSize   = 8
+)
+
+// Mirrors of bpf.c
+const (
+	maxArgs       = 16
+	maxStringSize = 64
+	regStack      = 0xff
+
+	argValue  = 0
+	argString = 1
+)
+
+type goLocation struct {
+	StackOffset int32
+	DerefOffset int32
+	Reg         uint8
+	Deref       uint8
+	Size        uint8
+	Pad         uint8
+}
+
+type goArgSpec struct {
+	Kind   uint8
+	Pad    [3]uint8
+	Loc    goLocation
+	LenLoc goLocation
+}
+
+type goFuncSpec struct {
+	Nargs uint32
+	Args  [maxArgs]goArgSpec
+}
+
+type valueKind int
+
+const (
+	kindInt valueKind = iota
+	kindUint
+	kindBool
+	kindFloat
+	kindString
+	kindLen     // Length of a slice
+	kindPointer // Pointers, maps, channels, functions and the data of interfaces
+)
+
+// goValue is a value captured when a function is called: a parameter, or a field of one
+type goValue struct {
+	Name     string // e.g. u.Name
+	Type     string
+	Kind     valueKind
+	Size     int
+	Spec     int    // Index of the argument spec in the event, -1 if the value can't be read
+	Unread   string // Why the value can't be read
+	location goLocation
+	lenLoc   goLocation
+}
+
+// goFunction is a function to trace and the values its calls capture
+type goFunction struct {
+	Name    string
+	Values  []goValue
+	Skipped int // Values beyond maxArgs
+}
+
+// Spec returns what the BPF program captures on calls of the function
+func (f *goFunction) Spec() goFuncSpec {
+	var spec goFuncSpec
+	for _, v := range f.Values {
+		if v.Spec < 0 {
+			continue
+		}
+		arg := &spec.Args[v.Spec]
+		arg.Loc = v.location
+		arg.LenLoc = v.lenLoc
+		if v.Kind == kindString {
+			arg.Kind = argString
+		}
+		spec.Nargs = uint32(v.Spec + 1)
+	}
+	return spec
+}
+
+type goParam struct {
+	Name string
+	Type dwarf.Type
+}
+
+// findFunctions reads the parameters of the functions from DWARF, in order, results excluded
+func findFunctions(d *dwarf.Data, names []string) (map[string][]goParam, error) {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	found := make(map[string][]goParam)
+
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		// Out of line instances of inlined functions refer to their abstract instance for names and types
+		name, _ := attr(d, e, dwarf.AttrName).(string)
+		_, concrete := e.Val(dwarf.AttrLowpc).(uint64)
+		if !wanted[name] || !concrete || !e.Children {
+			if e.Children {
+				r.SkipChildren()
+			}
+			continue
+		}
+
+		params := []goParam{}
+		for {
+			child, err := r.Next()
+			if err != nil {
+				return nil, err
+			}
+			if child == nil || child.Tag == 0 {
+				break
+			}
+			if child.Children {
+				r.SkipChildren()
+			}
+			if child.Tag != dwarf.TagFormalParameter {
+				continue
+			}
+			if result, _ := attr(d, child, dwarf.AttrVarParam).(bool); result {
+				continue
+			}
+			paramName, _ := attr(d, child, dwarf.AttrName).(string)
+			typeOffset, ok := attr(d, child, dwarf.AttrType).(dwarf.Offset)
+			if !ok {
+				return nil, fmt.Errorf("%s: parameter %s has no type", name, paramName)
+			}
+			t, err := d.Type(typeOffset)
+			if err != nil {
+				return nil, fmt.Errorf("%s: parameter %s: %s", name, paramName, err)
+			}
+			params = append(params, goParam{Name: paramName, Type: t})
+		}
+		found[name] = params
+	}
+
+	for _, name := range names {
+		if _, ok := found[name]; !ok {
+			return nil, fmt.Errorf("%s: not found in DWARF, or only inlined", name)
+		}
+	}
+	return found, nil
+}
+
+// attr returns an attribute of an entry, or of its abstract origin
+func attr(d *dwarf.Data, e *dwarf.Entry, a dwarf.Attr) interface{} {
+	if v := e.Val(a); v != nil {
+		return v
+	}
+	origin, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+	if !ok {
+		return nil
+	}
+	r := d.Reader()
+	r.Seek(origin)
+	o, err := r.Next()
+	if err != nil || o == nil {
+		return nil
+	}
+	return o.Val(a)
+}
+
+// abiPiece is a part of a value passed in its own register
+type abiPiece struct {
+	offset int64
+	size   int64
+	float  bool
+	reg    int
+}
+
+// registerPieces splits a value into the pieces the ABI assigns to registers, false if it's passed on the stack.
+// Strings, slices and interfaces are structs in DWARF, as they are in the ABI.
+func registerPieces(t dwarf.Type, offset int64, pieces *[]abiPiece) bool {
+	switch t := t.(type) {
+	case *dwarf.TypedefType:
+		return registerPieces(t.Type, offset, pieces)
+	case *dwarf.StructType:
+		for _, f := range t.Field {
+			if !registerPieces(f.Type, offset+f.ByteOffset, pieces) {
+				return false
+			}
+		}
+		return true
+	case *dwarf.ArrayType:
+		switch t.Count {
+		case 0:
+			return true
+		case 1:
+			return registerPieces(t.Type, offset, pieces)
+		}
+		return false
+	case *dwarf.FloatType:
+		*pieces = append(*pieces, abiPiece{offset: offset, size: t.ByteSize, float: true})
+		return true
+	case *dwarf.ComplexType:
+		half := t.ByteSize / 2
+		*pieces = append(*pieces, abiPiece{offset: offset, size: half, float: true}, abiPiece{offset: offset + half, size: half, float: true})
+		return true
+	}
+	size := t.Size()
+	if size == 0 {
+		return true
+	}
+	if size > ptrSize {
+		return false
+	}
+	*pieces = append(*pieces, abiPiece{offset: offset, size: size})
+	return true
+}
+
+func alignment(t dwarf.Type) int64 {
+	switch t := t.(type) {
+	case *dwarf.TypedefType:
+		return alignment(t.Type)
+	case *dwarf.StructType:
+		align := int64(1)
+		for _, f := range t.Field {
+			align = max64(align, alignment(f.Type))
+		}
+		return align
+	case *dwarf.ArrayType:
+		return alignment(t.Type)
+	case *dwarf.ComplexType:
+		return t.ByteSize / 2
+	}
+	if size := t.Size(); size > 0 && size <= ptrSize {
+		return size
+	}
+	return 1
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// abiAssigner assigns the parameters of a function to registers or the stack, in order
+type abiAssigner struct {
+	ints   int
+	floats int
+	stack  int64 // Size of the stack-assigned arguments so far
+}
+
+// locator returns where the byte at an offset of a parameter is at the function entry,
+// an empty string if readable or the reason why not
+type locator func(offset int64) (goLocation, string)
+
+func (a *abiAssigner) assign(t dwarf.Type) locator {
+	var pieces []abiPiece
+	if registerPieces(t, 0, &pieces) {
+		ints, floats := 0, 0
+		for _, p := range pieces {
+			if p.float {
+				floats++
+			} else {
+				ints++
+			}
+		}
+		if a.ints+ints <= intRegs && a.floats+floats <= floatRegs {
+			for i := range pieces {
+				if pieces[i].float {
+					pieces[i].reg = a.floats
+					a.floats++
+				} else {
+					pieces[i].reg = a.ints
+					a.ints++
+				}
+			}
+			return func(offset int64) (goLocation, string) {
+				for _, p := range pieces {
+					if p.offset != offset {
+						continue
+					}
+					if p.float {
+						return goLocation{}, fmt.Sprintf("in X%d, BPF can't read floating point registers", p.reg)
+					}
+					return goLocation{Reg: uint8(p.reg)}, ""
+				}
+				return goLocation{}, "not in a register"
+			}
+		}
+	}
+
+	// Past the return address, each argument aligned to its type
+	align := alignment(t)
+	a.stack = (a.stack + align - 1) / align * align
+	base := ptrSize + a.stack
+	a.stack += t.Size()
+	return func(offset int64) (goLocation, string) {
+		return goLocation{Reg: regStack, StackOffset: int32(base + offset)}, ""
+	}
+}
+
+// planFunction decides which values of the parameters are captured and where they are
+func planFunction(name string, params []goParam) *goFunction {
+	f := &goFunction{Name: name}
+	a := &abiAssigner{}
+	for _, p := range params {
+		f.capture(p.Name, p.Type, 0, a.assign(p.Type), 0)
+	}
+	return f
+}
+
+const (
+	// Levels of struct fields and array elements captured, a pointer to a struct counting as one
+	maxDepth = 2
+	// Longest array whose elements are captured
+	maxArrayLen = 4
+)
+
+func (f *goFunction) capture(name string, t dwarf.Type, offset int64, locate locator, depth int) {
+	u := underlying(t)
+	typeName := t.Common().Name
+	if s, ok := u.(*dwarf.StructType); ok && typeName == "" {
+		typeName = s.StructName
+	} else if typeName == "" {
+		typeName = t.String()
+	}
+
+	switch u := u.(type) {
+	case *dwarf.StructType:
+		switch {
+		case u.StructName == "string":
+			ptr, why := locate(offset)
+			length, lenWhy := locate(offset + ptrSize)
+			if why == "" {
+				why = lenWhy
+			}
+			f.add(goValue{Name: name, Type: typeName, Kind: kindString, Size: ptrSize, location: ptr, lenLoc: length}, why)
+		case strings.HasPrefix(u.StructName, "[]"):
+			loc, why := locate(offset + ptrSize)
+			f.add(goValue{Name: name, Type: typeName, Kind: kindLen, Size: ptrSize, location: loc}, why)
+		case u.StructName == "runtime.iface" || u.StructName == "runtime.eface":
+			loc, why := locate(offset + ptrSize)
+			f.add(goValue{Name: name, Type: typeName, Kind: kindPointer, Size: ptrSize, location: loc}, why)
+		case depth < maxDepth:
+			for _, field := range u.Field {
+				f.capture(name+"."+field.Name, field.Type, offset+field.ByteOffset, locate, depth+1)
+			}
+		}
+
+	case *dwarf.PtrType:
+		loc, why := locate(offset)
+		f.add(goValue{Name: name, Type: typeName, Kind: kindPointer, Size: ptrSize, location: loc}, why)
+		// The fields of a struct pointed to are read through the pointer, once
+		target, ok := underlying(u.Type).(*dwarf.StructType)
+		if !ok || why != "" || loc.Deref != 0 || depth >= maxDepth || isRuntimeStruct(target) {
+			return
+		}
+		deref := func(fieldOffset int64) (goLocation, string) {
+			l := loc
+			l.Deref = 1
+			l.DerefOffset = int32(fieldOffset)
+			return l, ""
+		}
+		for _, field := range target.Field {
+			f.capture(name+"."+field.Name, field.Type, field.ByteOffset, deref, depth+1)
+		}
+
+	case *dwarf.ArrayType:
+		// Elements of small arrays
+		if u.Count > maxArrayLen || depth >= maxDepth || u.Count <= 0 {
+			return
+		}
+		size := u.Type.Size()
+		for i := int64(0); i < u.Count; i++ {
+			f.capture(fmt.Sprintf("%s[%d]", name, i), u.Type, offset+i*size, locate, depth+1)
+		}
+
+	case *dwarf.ComplexType:
+		half := u.ByteSize / 2
+		for i, part := range []string{"real", "imag"} {
+			loc, why := locate(offset + int64(i)*half)
+			f.add(goValue{Name: name + "." + part, Type: fmt.Sprintf("float%d", half*8), Kind: kindFloat, Size: int(half), location: loc}, why)
+		}
+
+	case *dwarf.IntType, *dwarf.UintType, *dwarf.BoolType, *dwarf.FloatType, *dwarf.UcharType, *dwarf.CharType:
+		kind := kindInt
+		switch u.(type) {
+		case *dwarf.UintType, *dwarf.UcharType:
+			kind = kindUint
+		case *dwarf.BoolType:
+			kind = kindBool
+		case *dwarf.FloatType:
+			kind = kindFloat
+		}
+		loc, why := locate(offset)
+		f.add(goValue{Name: name, Type: typeName, Kind: kind, Size: int(u.Size()), location: loc}, why)
+	}
+	// Other types aren't captured
+}
+
+// isRuntimeStruct tells whether a struct is the runtime representation of a map or channel
+func isRuntimeStruct(t *dwarf.StructType) bool {
+	return strings.HasPrefix(t.StructName, "hash<") || strings.HasPrefix(t.StructName, "hchan<") ||
+		strings.HasPrefix(t.StructName, "runtime.") || strings.HasPrefix(t.StructName, "internal/runtime")
+}
+
+func underlying(t dwarf.Type) dwarf.Type {
+	for {
+		typedef, ok := t.(*dwarf.TypedefType)
+		if !ok {
+			return t
+		}
+		t = typedef.Type
+	}
+}
+
+// add appends a value, captured if it can be read and there's room left in the event
+func (f *goFunction) add(v goValue, unread string) {
+	v.Spec = -1
+	v.Unread = unread
+	v.location.Size = uint8(v.Size)
+	v.lenLoc.Size = ptrSize
+	if unread == "" {
+		n := 0
+		for _, other := range f.Values {
+			if other.Spec >= 0 {
+				n++
+			}
+		}
+		if n < maxArgs {
+			v.Spec = n
+		} else {
+			v.Unread = "too many values"
+			f.Skipped++
+		}
+	}
+	f.Values = append(f.Values, v)
+}
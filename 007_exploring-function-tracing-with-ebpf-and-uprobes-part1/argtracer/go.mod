@@ -0,0 +1,10 @@
+module argtracer
+
+go 1.20
+
+require github.com/cilium/ebpf v0.12.3
+
+require (
+	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
+	golang.org/x/sys v0.14.1-0.20231108175955-e4099bfacb8c // indirect
+)
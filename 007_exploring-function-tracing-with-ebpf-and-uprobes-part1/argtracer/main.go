@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// ArgEvent mirrors struct arg_event of bpf.c
+type ArgEvent struct {
+	Cookie  uint64
+	Pid     uint32
+	Tid     uint32
+	Values  [maxArgs]uint64
+	Errors  [maxArgs]uint8
+	Strings [maxArgs][maxStringSize]byte
+}
+
+// Call is a decoded event, the arguments being typed: int64, uint64, bool, float64, string, or nil if unread
+type Call struct {
+	Function string                 `json:"function"`
+	Pid      uint32                 `json:"pid"`
+	Tid      uint32                 `json:"tid"`
+	Args     map[string]interface{} `json:"args"`
+	order    []string
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.order))
+	for i, name := range c.order {
+		switch v := c.Args[name].(type) {
+		case nil:
+			args[i] = name + "=?"
+		case string:
+			args[i] = fmt.Sprintf("%s=%q", name, v)
+		default:
+			args[i] = fmt.Sprintf("%s=%v", name, v)
+		}
+	}
+	return fmt.Sprintf("%s(%s) pid: %d tid: %d", c.Function, strings.Join(args, " "), c.Pid, c.Tid)
+}
+
+func decode(f *goFunction, e *ArgEvent) *Call {
+	c := &Call{Function: f.Name, Pid: e.Pid, Tid: e.Tid, Args: make(map[string]interface{})}
+	for _, v := range f.Values {
+		c.order = append(c.order, v.Name)
+		if v.Spec < 0 || e.Errors[v.Spec] != 0 {
+			c.Args[v.Name] = nil
+			continue
+		}
+		raw := e.Values[v.Spec]
+		if v.Size < 8 {
+			raw &= 1<<(8*v.Size) - 1
+		}
+		switch v.Kind {
+		case kindInt:
+			// Sign extension
+			shift := 64 - 8*v.Size
+			c.Args[v.Name] = int64(raw<<shift) >> shift
+		case kindUint:
+			c.Args[v.Name] = raw
+		case kindBool:
+			c.Args[v.Name] = raw != 0
+		case kindFloat:
+			if v.Size == 4 {
+				c.Args[v.Name] = float64(math.Float32frombits(uint32(raw)))
+			} else {
+				c.Args[v.Name] = math.Float64frombits(raw)
+			}
+		case kindString:
+			n := raw
+			if n > maxStringSize {
+				n = maxStringSize
+			}
+			s := string(e.Strings[v.Spec][:n])
+			if raw > maxStringSize {
+				s += fmt.Sprintf("...(%d bytes)", raw)
+			}
+			c.Args[v.Name] = s
+		case kindLen:
+			c.Args["len("+v.Name+")"] = raw
+			c.order[len(c.order)-1] = "len(" + v.Name + ")"
+		case kindPointer:
+			c.Args[v.Name] = fmt.Sprintf("0x%x", raw)
+		}
+	}
+	return c
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "print the calls as JSON objects")
+	obj := flag.String("obj", "argtracer.o", "compiled eBPF object")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-json] <binary> <function>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path, names := flag.Arg(0), flag.Args()[1:]
+
+	ef, err := elf.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d, err := ef.DWARF()
+	ef.Close()
+	if err != nil {
+		log.Fatalf("reading DWARF of %s: %s", path, err)
+	}
+	params, err := findFunctions(d, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatal(err)
+	}
+	coll, err := ebpf.LoadCollection(*obj)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer coll.Close()
+
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The cookie of each uprobe is the index of its function, and the key of its spec
+	functions := make([]*goFunction, len(names))
+	for i, name := range names {
+		f := planFunction(name, params[name])
+		functions[i] = f
+		for _, v := range f.Values {
+			if v.Unread != "" {
+				log.Printf("%s: %s %s isn't captured: %s", name, v.Name, v.Type, v.Unread)
+			}
+		}
+
+		spec := f.Spec()
+		if err := coll.Maps["func_specs"].Put(uint32(i), &spec); err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+		l, err := ex.Uprobe(name, coll.Programs["go_function"], &link.UprobeOptions{Cookie: uint64(i)})
+		if err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+		defer l.Close()
+		log.Printf("Tracing %s (%d values)", name, spec.Nargs)
+	}
+
+	rd, err := ringbuf.NewReader(coll.Maps["arg_events"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stopper
+		rd.Close()
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	var event ArgEvent
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if err == ringbuf.ErrClosed {
+				return
+			}
+			log.Printf("reading from ringbuf: %s", err)
+			continue
+		}
+		if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &event); err != nil {
+			log.Printf("parsing event: %s", err)
+			continue
+		}
+		if event.Cookie >= uint64(len(functions)) {
+			continue
+		}
+
+		call := decode(functions[event.Cookie], &event)
+		if *jsonOutput {
+			enc.Encode(call)
+		} else {
+			log.Println(call)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module argtracer-test
+
+go 1.20
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type User struct {
+	ID    int64
+	Name  string
+	Admin bool
+}
+
+type Order struct {
+	ID    uint32
+	Price float64
+	Items []string
+	Buyer *User
+}
+
+//go:noinline
+func Greet(name string) {
+	fmt.Println("Hello, " + name)
+}
+
+//go:noinline
+func Add(a int, b int8, c uint16, ok bool) int {
+	if ok {
+		return a + int(b) + int(c)
+	}
+	return 0
+}
+
+//go:noinline
+func Login(u User, attempts int) bool {
+	return u.Admin || attempts < 3
+}
+
+//go:noinline
+func Checkout(o *Order, express bool) float64 {
+	if express {
+		return o.Price + 10
+	}
+	return o.Price
+}
+
+//go:noinline
+func Ship(items []string, weight float32, tags ...string) int {
+	return len(items) + len(tags) + int(weight)
+}
+
+// More integer arguments than registers, the last ones go on the stack
+//
+//go:noinline
+func Sum(a, b, c, d, e, f, g, h, i, j, k int, label string) int {
+	return a + b + c + d + e + f + g + h + i + j + k + len(label)
+}
+
+// Arrays of more than one element are passed on the stack
+//
+//go:noinline
+func Scale(v [3]float64, factor float64, name string) float64 {
+	return (v[0] + v[1] + v[2]) * factor
+}
+
+func main() {
+	buyer := &User{ID: 42, Name: "Kerem", Admin: true}
+	for range time.Tick(time.Second) {
+		Greet("Mauro")
+		Add(40, -2, 7, true)
+		Login(User{ID: 7, Name: "Lucas"}, 2)
+		Checkout(&Order{ID: 1001, Price: 19.99, Items: []string{"book", "pen"}, Buyer: buyer}, true)
+		Ship([]string{"a", "b", "c"}, 2.5, "fragile")
+		Sum(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, "eleven")
+		Scale([3]float64{1, 2, 3}, 1.5, "vector")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+)
+
+// Most functions whose calls are aggregated by an argument, MAX_FUNCS of bpf.c
+const maxAggFuncs = 4096
+
+// Kinds of struct agg_arg of bpf.c
+const (
+	aggArgNone   = 0
+	aggArgInt    = 1
+	aggArgString = 2
+)
+
+// AggArg mirrors struct agg_arg of bpf.c
+type AggArg struct {
+	Kind uint32
+	Reg  uint32
+}
+
+// AggKey mirrors struct agg_key of bpf.c
+type AggKey struct {
+	Func uint32
+	Slot uint32
+	Arg  uint64
+}
+
+// AggValue mirrors struct agg_value of bpf.c
+type AggValue struct {
+	Count   uint64
+	TotalNs uint64
+}
+
+// aggregationArg locates the parameter the calls of a function are aggregated by
+func aggregationArg(f *trackedFunction, name string) (AggArg, *goValue, error) {
+	for i := range f.Params {
+		p := &f.Params[i]
+		if p.Name != name {
+			continue
+		}
+		switch p.Kind {
+		case resultInt, resultUint, resultBool, resultPointer:
+			return AggArg{Kind: aggArgInt, Reg: uint32(p.Reg)}, p, nil
+		case resultString:
+			return AggArg{Kind: aggArgString, Reg: uint32(p.Reg)}, p, nil
+		case resultUnknown:
+			return AggArg{}, nil, fmt.Errorf("%s isn't in an integer register we can locate", name)
+		}
+		return AggArg{}, nil, fmt.Errorf("%s is neither an integer nor a string", name)
+	}
+	return AggArg{}, nil, fmt.Errorf("no parameter %s", name)
+}
+
+// formatArg shows the argument value calls were aggregated by
+func formatArg(p *goValue, arg uint64) string {
+	if p.Kind == resultString {
+		// The first 8 bytes, zero padded
+		var b [8]byte
+		for i := range b {
+			b[i] = byte(arg >> (8 * i))
+		}
+		return strconv.Quote(string(bytes.TrimRight(b[:], "\x00")))
+	}
+	var regs [goResultRegs]uint64
+	regs[p.Reg] = arg
+	return p.format(&regs)
+}
+
+// aggregate is a line of the aggregation output, the calls of a function with an argument value
+type aggregate struct {
+	fn   int
+	arg  uint64
+	hist latencyHistogram
+}
+
+// printAggregates prints the counts and latency histograms that BPF keeps in aggregation mode,
+// byArg giving the parameter each function is aggregated by, if any
+func printAggregates(coll *ebpf.Collection, functions []*trackedFunction, byArg []*goValue) error {
+	greets := map[string]uint64{}
+	var param [6]byte
+	var count uint64
+	it := coll.Maps["greet_counts"].Iterate()
+	for it.Next(&param, &count) {
+		greets[string(bytes.TrimRight(param[:], "\x00"))] = count
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(greets) > 0 {
+		fmt.Printf("COUNT: %v\n", greets)
+	}
+
+	type aggKey struct {
+		fn  int
+		arg uint64
+	}
+	aggregates := map[aggKey]*aggregate{}
+	var key AggKey
+	var value AggValue
+	it = coll.Maps["call_stats"].Iterate()
+	for it.Next(&key, &value) {
+		if int(key.Func) >= len(functions) || key.Slot >= 64 {
+			continue
+		}
+		k := aggKey{int(key.Func), key.Arg}
+		a := aggregates[k]
+		if a == nil {
+			a = &aggregate{fn: k.fn, arg: k.arg}
+			aggregates[k] = a
+		}
+		a.hist.addSlot(int(key.Slot), value.Count, value.TotalNs)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	sorted := make([]*aggregate, 0, len(aggregates))
+	for _, a := range aggregates {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].fn != sorted[j].fn {
+			return sorted[i].fn < sorted[j].fn
+		}
+		return sorted[i].arg < sorted[j].arg
+	})
+	for _, a := range sorted {
+		name := functions[a.fn].Name
+		if p := byArg[a.fn]; p != nil {
+			name += " " + p.Name + "=" + formatArg(p, a.arg)
+		}
+		fmt.Printf("%s: %s\n", name, &a.hist)
+	}
+	return nil
+}
@@ -1,4 +1,7 @@
+//go:build ignore
+
 #include <linux/bpf.h>
+#include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 #include "ctx.h"
 
@@ -7,19 +10,237 @@ char __license[] SEC("license") = "Dual MIT/GPL";
 #define GO_PARAM1(x) ((x)->ax)
 #define GO_PARAM2(x) ((x)->bx)
 #define GO_PARAM3(x) ((x)->cx)
+// Current goroutine, kept in R14 by the Go internal ABI
+#define GO_G(x) ((x)->r14)
+// Offset of stack.hi in runtime.g, whose first field has always been the stack bounds
+#define G_STACK_HI_OFFSET 8
+
+// Integer results are returned in RAX, RBX, RCX, RDI, RSI, R8, R9, R10 and R11
+#define GO_RESULT_REGS 9
+
+// Deepest user stack captured, PERF_MAX_STACK_DEPTH
+#define MAX_STACK_DEPTH 127
+
+// Most functions whose calls are aggregated by an argument
+#define MAX_FUNCS 4096
+
+// How the argument calls are aggregated by is read at the entry
+#define AGG_ARG_NONE 0
+#define AGG_ARG_INT 1    // Integer register
+#define AGG_ARG_STRING 2 // First 8 bytes of the string whose pointer and length are in two registers
+
+// Set by the tracker, the offset of goid depending on the Go version of the binary
+struct tracker_config {
+    __u64 goid_offset; // Offset of goid in runtime.g, 0 if unknown
+    __u32 stacks;      // Whether user stacks are captured
+    __u32 aggregate;   // Whether calls are counted in maps rather than sent as events
+};
+
+// Where an event happened in the Go program
+struct go_context {
+    __u64 goid;
+    // The frame pointer unwinder misses the caller of a function hit at its entry or RET, as the function has no
+    // frame then, so its return address is read from the top of the stack
+    __u64 caller;
+    __s64 stack_id; // In stack_traces, negative if not captured
+};
 
 struct greet_event {
+    struct go_context go;
+    __u32 pid;
     char param[6];
 };
 
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct tracker_config);
+} tracker_config_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_STACK_TRACE);
+    __uint(max_entries, 16384);
+    __type(key, __u32);
+    __uint(value_size, MAX_STACK_DEPTH * sizeof(__u64));
+} stack_traces SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, 256 * 1024);
 } greet_params SEC(".maps");
 
+// Greet calls by parameter, in aggregation mode
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, char[6]);
+    __type(value, __u64);
+} greet_counts SEC(".maps");
+
+// A call in progress of a traced function, the function being the cookie of its uprobes
+struct call_key {
+    __u64 g;
+    __u64 depth; // Telling recursive calls apart, see stack_depth
+    __u32 pid;
+    __u32 func;
+};
+
+struct call_start {
+    __u64 ts;
+    __u64 arg; // Aggregation mode only
+};
+
+struct call_event {
+    __u64 duration_ns;
+    __u64 g;
+    __u32 pid;
+    __u32 tid;
+    __u32 func;
+    __u32 pad;
+    struct go_context go;
+    __u64 results[GO_RESULT_REGS];
+};
+
+// Entry time of each call, from the uprobe at the function entry to the one at its RET instructions.
+// Calls leaving without a RET, by a panic or a tail call, never delete theirs, so the oldest are evicted.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 10240);
+    __type(key, struct call_key);
+    __type(value, struct call_start);
+} call_starts SEC(".maps");
+
+struct agg_arg {
+    __u32 kind; // AGG_ARG_*
+    __u32 reg;  // Index in RAX, RBX, RCX, RDI, RSI, R8, R9, R10, R11, the pointer for strings
+};
+
+// Argument each function is aggregated by, indexed by the cookie
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_FUNCS);
+    __type(key, __u32);
+    __type(value, struct agg_arg);
+} agg_args SEC(".maps");
+
+// Calls of a function with an argument value and a duration in [2^(slot-1), 2^slot) microseconds, slot 0
+// being under a microsecond, like the log2 histograms of bpftrace's hist()
+struct agg_key {
+    __u32 func;
+    __u32 slot;
+    __u64 arg;
+};
+
+struct agg_value {
+    __u64 count;
+    __u64 total_ns;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, struct agg_key);
+    __type(value, struct agg_value);
+} call_stats SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} call_events SEC(".maps");
+
+static __always_inline struct tracker_config *get_config() {
+    __u32 zero = 0;
+    return bpf_map_lookup_elem(&tracker_config_map, &zero);
+}
+
+static __always_inline void get_go_context(struct pt_regs *ctx, struct go_context *go) {
+    struct tracker_config *config = get_config();
+
+    go->goid = 0;
+    go->caller = 0;
+    go->stack_id = -1;
+    if (!config) {
+        return;
+    }
+    if (config->goid_offset) {
+        bpf_probe_read_user(&go->goid, sizeof(go->goid), (void *)(GO_G(ctx) + config->goid_offset));
+    }
+    if (config->stacks) {
+        bpf_probe_read_user(&go->caller, sizeof(go->caller), (void *)ctx->sp);
+        go->stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+    }
+}
+
+// Distance from the top of the goroutine stack to the return address the stack pointer is on, both at
+// the entry and at a RET of a call. The stack pointer itself changes when the runtime copies the stack
+// to grow it, while the call runs, but the distance doesn't.
+static __always_inline __u64 stack_depth(struct pt_regs *ctx) {
+    __u64 hi = 0;
+    bpf_probe_read_user(&hi, sizeof(hi), (void *)(GO_G(ctx) + G_STACK_HI_OFFSET));
+    return hi - ctx->sp;
+}
+
+static __always_inline __u64 go_int_reg(struct pt_regs *ctx, __u32 reg) {
+    switch (reg) {
+    case 0: return ctx->ax;
+    case 1: return ctx->bx;
+    case 2: return ctx->cx;
+    case 3: return ctx->di;
+    case 4: return ctx->si;
+    case 5: return ctx->r8;
+    case 6: return ctx->r9;
+    case 7: return ctx->r10;
+    case 8: return ctx->r11;
+    }
+    return 0;
+}
+
+// Number of bits of v, i.e. floor(log2(v)) + 1 and 0 for 0, without loops
+static __always_inline __u32 bit_length(__u64 v) {
+    __u32 n = 0, shift;
+    shift = (v > 0xFFFFFFFF) << 5; v >>= shift; n |= shift;
+    shift = (v > 0xFFFF) << 4; v >>= shift; n |= shift;
+    shift = (v > 0xFF) << 3; v >>= shift; n |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; n |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; n |= shift;
+    n |= (v >> 1);
+    return v ? n + 1 : 0;
+}
+
+static __always_inline void count_call(struct agg_key *key, __u64 duration) {
+    struct agg_value *value = bpf_map_lookup_elem(&call_stats, key);
+    if (!value) {
+        struct agg_value first = {1, duration};
+        // Another CPU may have added the key meanwhile
+        if (bpf_map_update_elem(&call_stats, key, &first, BPF_NOEXIST) == 0) {
+            return;
+        }
+        value = bpf_map_lookup_elem(&call_stats, key);
+        if (!value) {
+            return;
+        }
+    }
+    __sync_fetch_and_add(&value->count, 1);
+    __sync_fetch_and_add(&value->total_ns, duration);
+}
+
 SEC("uprobe/go_test_greet")
 int BPF_UPROBE(go_test_greet) {
     struct greet_event *e;
+    struct tracker_config *config = get_config();
+
+    if (config && config->aggregate) {
+        char param[6] = {};
+        bpf_probe_read_str(&param, sizeof(param), (void*)GO_PARAM1(ctx));
+        __u64 one = 1, *count = bpf_map_lookup_elem(&greet_counts, &param);
+        if (count) {
+            __sync_fetch_and_add(count, 1);
+        } else {
+            bpf_map_update_elem(&greet_counts, &param, &one, BPF_NOEXIST);
+        }
+        return 0;
+    }
 
     /* reserve sample from BPF ringbuf */
     e = bpf_ringbuf_reserve(&greet_params, sizeof(*e), 0);
@@ -27,8 +248,93 @@ int BPF_UPROBE(go_test_greet) {
         return 0;
     
     /* fill in event data */
+    get_go_context(ctx, &e->go);
+    e->pid = bpf_get_current_pid_tgid() >> 32;
     bpf_probe_read_str(&e->param, sizeof(e->param), (void*)GO_PARAM1(ctx));
     
     bpf_ringbuf_submit(e, 0);
     return 0;
 }
+
+// Goroutines are keyed by their g rather than the stack pointer, since their stack moves when it grows
+SEC("uprobe/go_func_entry")
+int go_func_entry(struct pt_regs *ctx) {
+    struct call_key key = {};
+    key.g = GO_G(ctx);
+    key.depth = stack_depth(ctx);
+    key.pid = bpf_get_current_pid_tgid() >> 32;
+    key.func = bpf_get_attach_cookie(ctx);
+
+    struct call_start start = {};
+    struct tracker_config *config = get_config();
+    struct agg_arg *arg = bpf_map_lookup_elem(&agg_args, &key.func);
+    if (config && config->aggregate && arg) {
+        if (arg->kind == AGG_ARG_INT) {
+            start.arg = go_int_reg(ctx, arg->reg);
+        } else if (arg->kind == AGG_ARG_STRING) {
+            __u64 len = go_int_reg(ctx, arg->reg + 1);
+            if (len > sizeof(start.arg)) {
+                len = sizeof(start.arg);
+            }
+            bpf_probe_read_user(&start.arg, len, (void *)go_int_reg(ctx, arg->reg));
+        }
+    }
+
+    start.ts = bpf_ktime_get_ns();
+    bpf_map_update_elem(&call_starts, &key, &start, BPF_ANY);
+    return 0;
+}
+
+// Attached to each RET instruction instead of a uretprobe, which overwrites the return address
+// on the stack and crashes Go programs when the stack is copied
+SEC("uprobe/go_func_return")
+int go_func_return(struct pt_regs *ctx) {
+    struct call_key key = {};
+    __u64 id = bpf_get_current_pid_tgid();
+    key.g = GO_G(ctx);
+    key.depth = stack_depth(ctx);
+    key.pid = id >> 32;
+    key.func = bpf_get_attach_cookie(ctx);
+
+    struct call_start *start = bpf_map_lookup_elem(&call_starts, &key);
+    if (!start) {
+        return 0;
+    }
+    __u64 duration = bpf_ktime_get_ns() - start->ts;
+    __u64 arg = start->arg;
+    bpf_map_delete_elem(&call_starts, &key);
+
+    struct tracker_config *config = get_config();
+    if (config && config->aggregate) {
+        struct agg_key agg = {};
+        agg.func = key.func;
+        agg.slot = bit_length(duration / 1000);
+        agg.arg = arg;
+        count_call(&agg, duration);
+        return 0;
+    }
+
+    struct call_event *e = bpf_ringbuf_reserve(&call_events, sizeof(*e), 0);
+    if (!e) {
+        return 0;
+    }
+    e->duration_ns = duration;
+    e->g = key.g;
+    e->pid = key.pid;
+    e->tid = id;
+    e->func = key.func;
+    e->pad = 0;
+    get_go_context(ctx, &e->go);
+    e->results[0] = ctx->ax;
+    e->results[1] = ctx->bx;
+    e->results[2] = ctx->cx;
+    e->results[3] = ctx->di;
+    e->results[4] = ctx->si;
+    e->results[5] = ctx->r8;
+    e->results[6] = ctx->r9;
+    e->results[7] = ctx->r10;
+    e->results[8] = ctx->r11;
+
+    bpf_ringbuf_submit(e, 0);
+    return 0;
+}
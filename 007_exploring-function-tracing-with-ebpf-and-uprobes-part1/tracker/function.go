@@ -0,0 +1,338 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Integer registers of the Go internal ABI, in assignment order: RAX, RBX, RCX, RDI, RSI, R8, R9, R10, R11
+const goResultRegs = 9
+
+// resultKind is how a parameter or result is shown from the registers it's passed in
+type resultKind int
+
+const (
+	resultInt     resultKind = iota // Signed integer
+	resultUint                      // Unsigned integer
+	resultBool                      //
+	resultPointer                   // Pointers, maps, channels and funcs
+	resultString                    // Pointer and length, the bytes aren't read
+	resultSlice                     // Pointer, length and capacity
+	resultIface                     // Type and data words, only nil or not is shown
+	resultUnknown                   // Floats, in X registers, or values we don't know the registers of
+)
+
+type goValue struct {
+	Name string
+	Kind resultKind
+	Size int64 // Bytes of integers
+	Reg  int   // First register
+}
+
+// trackedFunction is a function matched by -funcs. Entry and Returns are file offsets, which is what
+// UprobeOptions.Address takes, rather than the virtual addresses of the symbol table.
+type trackedFunction struct {
+	Name    string
+	Entry   uint64
+	Returns []uint64 // RET instructions
+	Params  []goValue
+	Results []goValue
+}
+
+// signature is the parameters and results of a function, with their registers at the entry and RET respectively
+type signature struct {
+	Params  []goValue
+	Results []goValue
+}
+
+// findFunction disassembles the body of sym to collect the RET instructions the return probes go on
+func findFunction(ef *elf.File, sym goSymbol) (*trackedFunction, error) {
+	if ef.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("unsupported architecture %s", ef.Machine)
+	}
+	name, start, end := sym.Name, sym.Start, sym.End
+
+	text := ef.Section(".text")
+	if text == nil || start < text.Addr || end > text.Addr+text.Size {
+		return nil, fmt.Errorf("%s not in .text", name)
+	}
+	code := make([]byte, end-start)
+	if _, err := text.ReadAt(code, int64(start-text.Addr)); err != nil {
+		return nil, err
+	}
+
+	entry, err := fileOffset(ef, start)
+	if err != nil {
+		return nil, err
+	}
+	fn := &trackedFunction{Name: name, Entry: entry}
+	for i := 0; i < len(code); {
+		inst, err := x86asm.Decode(code[i:], 64)
+		// Stepping over what can't be decoded could land inside an instruction, where a 0xc3 byte would
+		// get a uprobe and corrupt the code, so the whole function is left alone. x86asm returns prefixes
+		// alone for encodings it doesn't know, and misdecodes some VEX ones without an error.
+		if err != nil || inst.Op == 0 || hasVEXPrefix(inst) {
+			return nil, fmt.Errorf("can't disassemble %s at +0x%x", name, i)
+		}
+		if inst.Op == x86asm.RET {
+			fn.Returns = append(fn.Returns, entry+uint64(i))
+		}
+		i += inst.Len
+	}
+	if len(fn.Returns) == 0 {
+		return nil, fmt.Errorf("no RET instruction in %s", name)
+	}
+	return fn, nil
+}
+
+func hasVEXPrefix(inst x86asm.Inst) bool {
+	for _, p := range inst.Prefix {
+		if p == 0 {
+			break
+		}
+		if p.IsVEX() {
+			return true
+		}
+	}
+	return false
+}
+
+// fileOffset maps addr back to where its bytes are in the binary, through the PT_LOAD segment
+// holding it, since uprobes are placed by file offset
+func fileOffset(ef *elf.File, addr uint64) (uint64, error) {
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if prog.Vaddr <= addr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x not in an executable segment", addr)
+}
+
+// findSignatures reads the parameters and results of functions from DWARF and assigns them their registers,
+// functions not found, such as those written in assembly, being left out
+func findSignatures(d *dwarf.Data, names map[string]bool) (map[string]*signature, error) {
+	found := make(map[string]*signature)
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return found, nil
+		}
+		if e.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		name, _ := e.Val(dwarf.AttrName).(string)
+		if _, done := found[name]; !names[name] || done || !e.Children {
+			if e.Children {
+				r.SkipChildren()
+			}
+			continue
+		}
+
+		// Parameters and results are assigned registers independently, both from RAX
+		sig := &signature{}
+		paramReg, resultReg := 0, 0
+		for {
+			child, err := r.Next()
+			if err != nil {
+				return nil, err
+			}
+			if child == nil || child.Tag == 0 {
+				break
+			}
+			if child.Children {
+				r.SkipChildren()
+			}
+			if child.Tag != dwarf.TagFormalParameter {
+				continue
+			}
+			valueName, _ := child.Val(dwarf.AttrName).(string)
+			if result, _ := child.Val(dwarf.AttrVarParam).(bool); result {
+				sig.Results = append(sig.Results, assignValue(d, child, valueName, &resultReg))
+			} else {
+				sig.Params = append(sig.Params, assignValue(d, child, valueName, &paramReg))
+			}
+		}
+		found[name] = sig
+	}
+}
+
+// assignValue gives a parameter or result the next registers, reg becoming -1 once they're unknown
+func assignValue(d *dwarf.Data, e *dwarf.Entry, name string, reg *int) goValue {
+	v := goValue{Name: name, Kind: resultUnknown, Reg: *reg}
+	off, ok := e.Val(dwarf.AttrType).(dwarf.Offset)
+	if !ok || *reg < 0 {
+		return v
+	}
+	t, err := d.Type(off)
+	if err != nil {
+		*reg = -1
+		return v
+	}
+	regs := classifyResult(&v, t)
+	if regs < 0 || *reg+regs > goResultRegs {
+		// Past a value we can't place, the registers of the next ones aren't known either
+		v.Kind = resultUnknown
+		*reg = -1
+	} else {
+		*reg += regs
+	}
+	return v
+}
+
+// classifyResult sets the kind of a value from its type, returning how many integer registers it takes,
+// or -1 if we can't tell
+func classifyResult(res *goValue, t dwarf.Type) int {
+	for {
+		typedef, ok := t.(*dwarf.TypedefType)
+		if !ok {
+			break
+		}
+		t = typedef.Type
+	}
+	res.Size = t.Size()
+	switch t := t.(type) {
+	case *dwarf.IntType, *dwarf.CharType:
+		res.Kind = resultInt
+		return 1
+	case *dwarf.UintType, *dwarf.UcharType:
+		res.Kind = resultUint
+		return 1
+	case *dwarf.BoolType:
+		res.Kind = resultBool
+		return 1
+	case *dwarf.PtrType, *dwarf.FuncType:
+		res.Kind = resultPointer
+		return 1
+	case *dwarf.FloatType:
+		// In X registers, which BPF can't read
+		return 0
+	case *dwarf.StructType:
+		switch {
+		case t.StructName == "string":
+			res.Kind = resultString
+			return 2
+		case strings.HasPrefix(t.StructName, "[]"):
+			res.Kind = resultSlice
+			return 3
+		case t.StructName == "runtime.iface" || t.StructName == "runtime.eface":
+			res.Kind = resultIface
+			return 2
+		case len(t.Field) == 0:
+			return 0
+		}
+	}
+	return -1
+}
+
+// format shows a result from the integer registers at a RET
+func (res *goValue) format(regs *[goResultRegs]uint64) string {
+	if res.Kind == resultUnknown {
+		return "?"
+	}
+	raw := regs[res.Reg]
+	if res.Size > 0 && res.Size < 8 {
+		raw &= 1<<(8*res.Size) - 1
+	}
+	switch res.Kind {
+	case resultInt:
+		shift := 64 - 8*res.Size
+		return fmt.Sprint(int64(raw<<shift) >> shift)
+	case resultUint:
+		return fmt.Sprint(raw)
+	case resultBool:
+		return fmt.Sprint(raw != 0)
+	case resultPointer:
+		return fmt.Sprintf("0x%x", raw)
+	case resultString:
+		return fmt.Sprintf("string(len %d)", regs[res.Reg+1])
+	case resultSlice:
+		return fmt.Sprintf("slice(len %d)", regs[res.Reg+1])
+	case resultIface:
+		if raw == 0 {
+			return "nil"
+		}
+		return "non-nil"
+	}
+	return "?"
+}
+
+// formatResults shows the results of a call, e.g. "n=3 err=nil"
+func (f *trackedFunction) formatResults(regs *[goResultRegs]uint64) string {
+	parts := make([]string, len(f.Results))
+	for i := range f.Results {
+		name := f.Results[i].Name
+		if name == "" || strings.HasPrefix(name, "~r") {
+			name = fmt.Sprintf("r%d", i)
+		}
+		parts[i] = name + "=" + f.Results[i].format(regs)
+	}
+	return strings.Join(parts, " ")
+}
+
+// latencyHistogram counts calls in power of two buckets of microseconds, as bcc's funclatency does
+type latencyHistogram struct {
+	buckets [64]uint64
+	count   uint64
+	total   uint64 // Nanoseconds
+}
+
+func (h *latencyHistogram) add(ns uint64) {
+	// Bucket 0 is below 1us, bucket n holds [2^(n-1), 2^n) us, as bit_length of bpf.c counts them
+	bucket := bits.Len64(ns / 1000)
+	h.buckets[bucket]++
+	h.count++
+	h.total += ns
+}
+
+// addSlot adds calls counted in BPF, whose slots are the same buckets
+func (h *latencyHistogram) addSlot(slot int, count, totalNs uint64) {
+	h.buckets[slot] += count
+	h.count += count
+	h.total += totalNs
+}
+
+func (h *latencyHistogram) String() string {
+	if h.count == 0 {
+		return "no calls\n"
+	}
+	last := 0
+	var most uint64
+	for i, n := range h.buckets {
+		if n > 0 {
+			last = i
+		}
+		most = max64(most, n)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d calls, avg %.1fus\n", h.count, float64(h.total)/float64(h.count)/1000)
+	fmt.Fprintf(&b, "%20s : %-8s %s\n", "usecs", "count", "distribution")
+	for i := 0; i <= last; i++ {
+		low, high := uint64(0), uint64(0)
+		if i > 0 {
+			low, high = 1<<(i-1), 1<<i-1
+		}
+		stars := int(math.Round(40 * float64(h.buckets[i]) / float64(most)))
+		fmt.Fprintf(&b, "%9d -> %-7d : %-8d |%-40s|\n", low, high, h.buckets[i], strings.Repeat("*", stars))
+	}
+	return b.String()
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,7 +2,10 @@ module t
 
 go 1.20
 
-require github.com/cilium/ebpf v0.12.3
+require (
+	github.com/cilium/ebpf v0.12.3
+	golang.org/x/arch v0.8.0
+)
 
 require (
 	golang.org/x/exp v0.0.0-20230224173230-c95f2b4c22f2 // indirect
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"debug/buildinfo"
+	"debug/dwarf"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// Deepest user stack captured, MAX_STACK_DEPTH of bpf.c
+const maxStackDepth = 127
+
+// GoContext mirrors struct go_context of bpf.c
+type GoContext struct {
+	Goid    uint64
+	Caller  uint64
+	StackID int64
+}
+
+// goidOffset returns the offset of goid in runtime.g, from the DWARF of the binary or, for binaries built without
+// it (go build -ldflags=-w), from the Go version that built it. The register ABI, which keeps g in R14, is used
+// on amd64 since Go 1.17.
+func goidOffset(ef *elf.File, path string) (uint64, error) {
+	if d, err := ef.DWARF(); err == nil {
+		if offset, ok := dwarfFieldOffset(d, "runtime.g", "goid"); ok {
+			return offset, nil
+		}
+	}
+
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(info.GoVersion, "go%d.%d", &major, &minor); err != nil || major != 1 {
+		return 0, fmt.Errorf("unknown Go version %s", info.GoVersion)
+	}
+	switch {
+	case minor < 17:
+		return 0, fmt.Errorf("%s doesn't keep g in R14", info.GoVersion)
+	case minor < 23:
+		return 152, nil
+	case minor < 25:
+		// g.syscallbp was added before goid
+		return 160, nil
+	default:
+		// gobuf.ret was removed from g.sched
+		return 152, nil
+	}
+}
+
+func dwarfFieldOffset(d *dwarf.Data, structName, field string) (uint64, bool) {
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil || e == nil {
+			return 0, false
+		}
+		if e.Tag != dwarf.TagStructType || e.Val(dwarf.AttrName) != structName {
+			if e.Children && e.Tag != dwarf.TagCompileUnit {
+				r.SkipChildren()
+			}
+			continue
+		}
+		t, err := d.Type(e.Offset)
+		if err != nil {
+			return 0, false
+		}
+		for _, f := range t.(*dwarf.StructType).Field {
+			if f.Name == field {
+				return uint64(f.ByteOffset), true
+			}
+		}
+		return 0, false
+	}
+}
+
+// symbolizer names the functions of user stacks with the pclntab of the binary, kept even in stripped binaries
+type symbolizer struct {
+	path  string
+	table *gosym.Table
+	pie   bool
+	text  *elf.Prog // Executable segment
+
+	mu     sync.Mutex
+	biases map[uint32]uint64 // Load address of position independent binaries, by pid
+}
+
+func newSymbolizer(ef *elf.File, path string) (*symbolizer, error) {
+	pclntab := ef.Section(".gopclntab")
+	text := ef.Section(".text")
+	if pclntab == nil || text == nil {
+		return nil, fmt.Errorf("no pclntab in %s", path)
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return nil, err
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return nil, err
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	s := &symbolizer{path: path, table: table, pie: ef.Type == elf.ET_DYN, biases: make(map[uint32]uint64)}
+	for _, prog := range ef.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 {
+			s.text = prog
+		}
+	}
+	return s, nil
+}
+
+// bias returns how far from their link address a process loaded the binary, found in its memory mappings
+func (s *symbolizer) bias(pid uint32) uint64 {
+	if !s.pie || s.text == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bias, ok := s.biases[pid]; ok {
+		return bias
+	}
+
+	var bias uint64
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	// 55d5c4a00000-55d5c4b9b000 r-xp 00200000 fd:01 1234 /usr/bin/app
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") || strings.Join(fields[5:], " ") != s.path {
+			continue
+		}
+		start, end, _ := strings.Cut(fields[0], "-")
+		addr, err1 := strconv.ParseUint(start, 16, 64)
+		endAddr, err2 := strconv.ParseUint(end, 16, 64)
+		offset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil || offset > s.text.Off || s.text.Off-offset >= endAddr-addr {
+			continue
+		}
+		// The mapping containing the executable segment, which may start before it in the file
+		bias = addr - offset - (s.text.Vaddr - s.text.Off)
+		break
+	}
+	s.biases[pid] = bias
+	return bias
+}
+
+// frame describes a program counter, e.g. "main.main /src/app/main.go:42". Return addresses point after
+// their call, so the line of the call is that of the byte before.
+func (s *symbolizer) frame(pid uint32, pc uint64, returnAddress bool) string {
+	pc -= s.bias(pid)
+	if returnAddress {
+		pc--
+	}
+	file, line, fn := s.table.PCToLine(pc)
+	if fn == nil {
+		return fmt.Sprintf("0x%x", pc)
+	}
+	return fmt.Sprintf("%s %s:%d", fn.Name, file, line)
+}
+
+// stack returns the user stack of an event, from the function hit to the outermost caller
+func (s *symbolizer) stack(stacks *ebpf.Map, pid uint32, gc *GoContext) ([]string, error) {
+	if gc.StackID < 0 {
+		return nil, fmt.Errorf("stack not captured (%d)", gc.StackID)
+	}
+	var ips [maxStackDepth]uint64
+	if err := stacks.Lookup(uint32(gc.StackID), &ips); err != nil {
+		return nil, err
+	}
+
+	var frames []string
+	for i, ip := range ips {
+		if ip == 0 {
+			break
+		}
+		frames = append(frames, s.frame(pid, ip, i > 0))
+		if i == 0 && gc.Caller != 0 {
+			frames = append(frames, s.frame(pid, gc.Caller, true))
+		}
+	}
+	return frames, nil
+}
+
+// formatCallers lists the callers that called a function the most, with their count
+func formatCallers(callers map[string]uint64, top int) string {
+	type caller struct {
+		frame string
+		count uint64
+	}
+	sorted := make([]caller, 0, len(callers))
+	for frame, count := range callers {
+		sorted = append(sorted, caller{frame, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].frame < sorted[j].frame
+	})
+	var b strings.Builder
+	for i, c := range sorted {
+		if i == top {
+			fmt.Fprintf(&b, "%8s %d others\n", "", len(sorted)-top)
+			break
+		}
+		fmt.Fprintf(&b, "%8d %s\n", c.count, c.frame)
+	}
+	return b.String()
+}
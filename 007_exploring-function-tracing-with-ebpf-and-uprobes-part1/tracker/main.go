@@ -2,7 +2,14 @@ package main
 
 import (
 	"debug/elf"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/cilium/ebpf"
@@ -14,23 +21,109 @@ import (
 const SymbolName = "main.Greet"
 
 type GreetEvent struct {
+	Go  GoContext
+	Pid uint32
 	Msg [6]byte
 }
 
+// TrackerConfig mirrors struct tracker_config of bpf.c
+type TrackerConfig struct {
+	GoidOffset uint64
+	Stacks     uint32
+	Aggregate  uint32
+}
+
+// CallEvent mirrors struct call_event of bpf.c
+type CallEvent struct {
+	DurationNs uint64
+	G          uint64
+	Pid        uint32
+	Tid        uint32
+	Func       uint32
+	_          uint32
+	Go         GoContext
+	Results    [goResultRegs]uint64
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		list(os.Args[2:])
+		return
+	}
+
+	path := flag.String("binary", "../program/p", "Go binary to trace")
+	funcs := flag.String("funcs", SymbolName, "comma separated functions to measure, as globs such as main.* or a ~regexp")
+	maxProbes := flag.Int("max-probes", 256, "most uprobes attached, entries and RET instructions included")
+	interval := flag.Duration("interval", 10*time.Second, "how often the latency histograms are printed")
+	quiet := flag.Bool("quiet", false, "don't log each call, only the histograms")
+	stacks := flag.Bool("stacks", false, "capture the user stack of each call, and count the callers of each function")
+	aggregate := flag.Bool("aggregate", false, "count calls and latencies in BPF maps instead of sending an event per call")
+	by := flag.String("by", "", "parameter the calls are aggregated by, an integer or a string of which 8 bytes are kept")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags]\n       %s list [-binary path] [pattern...]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *aggregate && *stacks {
+		log.Fatal("-stacks needs an event per call, which -aggregate doesn't send")
+	}
+	if *by != "" && !*aggregate {
+		log.Fatal("-by is an option of -aggregate")
+	}
+
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatal(err)
 	}
 
-	path := "../program/p"
 	// open in elf format in order to get the symbols
-	ef, err := elf.Open(path)
+	ef, err := elf.Open(*path)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer ef.Close()
+	symbols, err := listFunctions(ef)
+	if err != nil {
+		log.Fatalf("listing the functions of %s: %s", *path, err)
+	}
+	matched, err := matchFunctions(symbols, *funcs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Functions that can't be probed are reported rather than fatal, as patterns match many of them
+	var planned []*trackedFunction
+	var failed []string
+	probes := 0
+	names := make(map[string]bool)
+	for _, sym := range matched {
+		f, err := findFunction(ef, sym)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		planned = append(planned, f)
+		names[f.Name] = true
+		probes += 1 + len(f.Returns)
+	}
+	if probes > *maxProbes {
+		log.Fatalf("%s matches %d functions needing %d uprobes, more than -max-probes %d", *funcs, len(planned), probes, *maxProbes)
+	}
+
+	if d, err := ef.DWARF(); err != nil {
+		log.Printf("Return values aren't shown, reading DWARF of %s: %s", *path, err)
+	} else {
+		signatures, err := findSignatures(d, names)
+		if err != nil {
+			log.Fatalf("reading DWARF of %s: %s", *path, err)
+		}
+		for _, f := range planned {
+			if sig := signatures[f.Name]; sig != nil {
+				f.Params, f.Results = sig.Params, sig.Results
+			}
+		}
+	}
 
-	ex, err := link.OpenExecutable(path)
+	ex, err := link.OpenExecutable(*path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -39,30 +132,259 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer coll.Close()
+
+	config := TrackerConfig{}
+	if offset, err := goidOffset(ef, *path); err != nil {
+		log.Printf("Goroutine IDs aren't shown: %s", err)
+	} else {
+		config.GoidOffset = offset
+	}
+	var sym *symbolizer
+	if *stacks {
+		if sym, err = newSymbolizer(ef, *path); err != nil {
+			log.Fatal(err)
+		}
+		config.Stacks = 1
+	}
+	if *aggregate {
+		config.Aggregate = 1
+	}
+	if err := coll.Maps["tracker_config_map"].Put(uint32(0), &config); err != nil {
+		log.Fatal(err)
+	}
+	// printStack logs the stack of an event, indented below it
+	printStack := func(pid uint32, gc *GoContext) {
+		if sym == nil {
+			return
+		}
+		frames, err := sym.stack(coll.Maps["stack_traces"], pid, gc)
+		if err != nil {
+			log.Printf("\t%s", err)
+		}
+		for _, frame := range frames {
+			log.Printf("\t%s", frame)
+		}
+	}
+
+	// Greet calls are still counted by their parameter, when the binary has it
+	hasGreet := false
+	for _, s := range symbols {
+		hasGreet = hasGreet || s.Name == SymbolName
+	}
+	if hasGreet && !*aggregate {
+		greetEvents, err := ringbuf.NewReader(coll.Maps["greet_params"])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			countMap := map[string]uint64{}
+			for {
+				event, err := greetEvents.Read()
+				if err != nil {
+					log.Fatal(err)
+				}
+				greetEvent := (*GreetEvent)(unsafe.Pointer(&event.RawSample[0]))
+				countMap[string(greetEvent.Msg[:])]++
+				log.Printf("COUNT: %v goroutine: %d", countMap, greetEvent.Go.Goid)
+				printStack(greetEvent.Pid, &greetEvent.Go)
+			}
+		}()
+	}
+	if hasGreet {
+		l, err := ex.Uprobe(SymbolName, coll.Programs["go_test_greet"], &link.UprobeOptions{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+	}
+
+	// The cookie of the probes of a function is its index, so that the entry and RETs of a call match.
+	// Return probes are attached to each RET instruction, not as uretprobes: those replace the return
+	// address on the stack, which the Go runtime copies elsewhere when it grows the stack of a goroutine.
+	var functions []*trackedFunction
+	var links []link.Link
+	var byArg []*goValue
+	defer func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}()
+	for _, f := range planned {
+		var param *goValue
+		if *by != "" && len(functions) < maxAggFuncs {
+			arg, p, err := aggregationArg(f, *by)
+			if err != nil {
+				log.Printf("%s isn't aggregated by %s: %s", f.Name, *by, err)
+			}
+			if err := coll.Maps["agg_args"].Put(uint32(len(functions)), &arg); err != nil {
+				log.Fatal(err)
+			}
+			param = p
+		}
+		fnLinks, err := attachFunction(ex, coll, f, uint64(len(functions)))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", f.Name, err))
+			continue
+		}
+		links = append(links, fnLinks...)
+		functions = append(functions, f)
+		byArg = append(byArg, param)
+	}
+	for _, f := range failed {
+		log.Printf("Not measured: %s", f)
+	}
+	if len(functions) == 0 {
+		log.Fatalf("no function of %s could be measured", *funcs)
+	}
+	log.Printf("Measuring %d functions with %d uprobes", len(functions), len(links))
 
-	greetEvents, err := ringbuf.NewReader(coll.Maps["greet_params"])
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// Only the maps are read, every interval
+	if *aggregate {
+		for {
+			select {
+			case <-ticker.C:
+				if err := printAggregates(coll, functions, byArg); err != nil {
+					log.Fatal(err)
+				}
+			case <-stopper:
+				if err := printAggregates(coll, functions, byArg); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+		}
+	}
+
+	callEvents, err := ringbuf.NewReader(coll.Maps["call_events"])
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var mu sync.Mutex
+	histograms := make([]latencyHistogram, len(functions))
+	callers := make([]map[string]uint64, len(functions))
+	for i := range callers {
+		callers[i] = make(map[string]uint64)
+	}
+	printHistograms := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, f := range functions {
+			fmt.Printf("%s: %s", f.Name, &histograms[i])
+			if len(callers[i]) > 0 {
+				fmt.Printf("callers:\n%s", formatCallers(callers[i], 5))
+			}
+			fmt.Println()
+		}
+	}
+
 	go func() {
-		countMap := map[string]uint64{}
 		for {
-			event, err := greetEvents.Read()
+			record, err := callEvents.Read()
 			if err != nil {
+				if err == ringbuf.ErrClosed {
+					return
+				}
 				log.Fatal(err)
 			}
-			greetEvent := (*GreetEvent)(unsafe.Pointer(&event.RawSample[0]))
-			countMap[string(greetEvent.Msg[:])]++
-			log.Printf("COUNT: %v", countMap)
+			event := (*CallEvent)(unsafe.Pointer(&record.RawSample[0]))
+			if int(event.Func) >= len(functions) {
+				continue
+			}
+			f := functions[event.Func]
+			mu.Lock()
+			histograms[event.Func].add(event.DurationNs)
+			if sym != nil && event.Go.Caller != 0 {
+				callers[event.Func][sym.frame(event.Pid, event.Go.Caller, true)]++
+			}
+			mu.Unlock()
+			if !*quiet {
+				results := f.formatResults(&event.Results)
+				if results != "" {
+					results = " " + results
+				}
+				log.Printf("%s returned%s after %s (pid: %d tid: %d goroutine: %d)",
+					f.Name, results, time.Duration(event.DurationNs), event.Pid, event.Tid, event.Go.Goid)
+				printStack(event.Pid, &event.Go)
+			}
 		}
 	}()
 
-	_, err = ex.Uprobe(SymbolName, coll.Programs["go_test_greet"], &link.UprobeOptions{})
+	for {
+		select {
+		case <-ticker.C:
+			printHistograms()
+		case <-stopper:
+			callEvents.Close()
+			printHistograms()
+			return
+		}
+	}
+}
+
+// attachFunction attaches the probes of a function, all of them or none
+func attachFunction(ex *link.Executable, coll *ebpf.Collection, f *trackedFunction, cookie uint64) ([]link.Link, error) {
+	var links []link.Link
+	fail := func(err error) ([]link.Link, error) {
+		for _, l := range links {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	l, err := ex.Uprobe(f.Name, coll.Programs["go_func_entry"], &link.UprobeOptions{Address: f.Entry, Cookie: cookie})
+	if err != nil {
+		return fail(err)
+	}
+	links = append(links, l)
+	for _, ret := range f.Returns {
+		l, err := ex.Uprobe(f.Name, coll.Programs["go_func_return"], &link.UprobeOptions{Address: ret, Cookie: cookie})
+		if err != nil {
+			return fail(fmt.Errorf("RET at 0x%x: %s", ret, err))
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// list prints the functions of a binary matching the patterns, or all of them, with their address and size
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	path := fs.String("binary", "../program/p", "Go binary to list the functions of")
+	fs.Parse(args)
+
+	ef, err := elf.Open(*path)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer ef.Close()
+	symbols, err := listFunctions(ef)
+	if err != nil {
+		log.Fatalf("listing the functions of %s: %s", *path, err)
+	}
 
-	for {
+	var patterns []*symbolPattern
+	for _, arg := range fs.Args() {
+		p, err := parseSymbolPattern(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		patterns = append(patterns, p)
+	}
+	for _, s := range symbols {
+		matches := len(patterns) == 0
+		for _, p := range patterns {
+			matches = matches || p.re.MatchString(s.Name)
+		}
+		if matches {
+			fmt.Printf("0x%x %6d %s\n", s.Start, s.End-s.Start, s.Name)
+		}
 	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// goSymbol is a function of the binary, Start and End being virtual addresses
+type goSymbol struct {
+	Name  string
+	Start uint64
+	End   uint64
+}
+
+// listFunctions returns the functions of a binary sorted by address, from the symbol table or, for stripped
+// binaries, from the pclntab that Go keeps for stack traces
+func listFunctions(ef *elf.File) ([]goSymbol, error) {
+	var functions []goSymbol
+	if symbols, err := ef.Symbols(); err == nil {
+		for _, s := range symbols {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 && s.Size != 0 {
+				functions = append(functions, goSymbol{Name: s.Name, Start: s.Value, End: s.Value + s.Size})
+			}
+		}
+	}
+
+	if len(functions) == 0 {
+		pclntab := ef.Section(".gopclntab")
+		text := ef.Section(".text")
+		if pclntab == nil || text == nil {
+			return nil, fmt.Errorf("neither a symbol table nor a pclntab")
+		}
+		data, err := pclntab.Data()
+		if err != nil {
+			return nil, err
+		}
+		table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range table.Funcs {
+			functions = append(functions, goSymbol{Name: fn.Name, Start: fn.Entry, End: fn.End})
+		}
+	}
+
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Start < functions[j].Start })
+	return functions, nil
+}
+
+// symbolPattern matches function names against a glob, in which * matches any characters, / included,
+// and ? a single one, or a regular expression when prefixed with ~:
+//
+//	main.Greet  main.*  net/http.(*Client).*  ~^main\.(Greet|Add)$
+type symbolPattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+func parseSymbolPattern(s string) (*symbolPattern, error) {
+	if expr, ok := strings.CutPrefix(s, "~"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s, err)
+		}
+		return &symbolPattern{text: s, re: re}, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range s {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return &symbolPattern{text: s, re: regexp.MustCompile(expr.String())}, nil
+}
+
+func (p *symbolPattern) String() string {
+	return p.text
+}
+
+// matchFunctions returns the functions matching any of the comma separated patterns, in address order.
+// Regular expressions can contain commas, so one extends to the end of the list.
+// Patterns matching nothing are an error, as they're usually typos.
+func matchFunctions(functions []goSymbol, patterns string) ([]goSymbol, error) {
+	var matchers []*symbolPattern
+	for patterns != "" {
+		var s string
+		if strings.HasPrefix(patterns, "~") {
+			s, patterns = patterns, ""
+		} else {
+			s, patterns, _ = strings.Cut(patterns, ",")
+		}
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parseSymbolPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, p)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("no function pattern")
+	}
+
+	var matched []goSymbol
+	used := make([]bool, len(matchers))
+	for _, fn := range functions {
+		found := false
+		for i, p := range matchers {
+			if p.re.MatchString(fn.Name) {
+				used[i] = true
+				found = true
+			}
+		}
+		if found {
+			matched = append(matched, fn)
+		}
+	}
+	for i, p := range matchers {
+		if !used[i] {
+			return nil, fmt.Errorf("%s: no function matches", p)
+		}
+	}
+	return matched, nil
+}
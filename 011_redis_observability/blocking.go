@@ -0,0 +1,195 @@
+package main
+
+// Blocking commands wait on the server until data is available or their timeout expires,
+// so their latency is mostly time spent waiting rather than time spent serving them.
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the timeout argument of a blocking command is
+const (
+	timeoutLastArg  = iota // BLPOP key [key ...] timeout
+	timeoutFirstArg        // BLMPOP timeout numkeys key [key ...]
+	timeoutBlockArg        // XREAD [COUNT count] [BLOCK milliseconds] STREAMS ...
+)
+
+type redisBlockingCommand struct {
+	Position     int
+	Milliseconds bool // Timeout is in milliseconds instead of seconds
+}
+
+var redisBlockingCommands = map[string]redisBlockingCommand{
+	"BLPOP":      {timeoutLastArg, false},
+	"BRPOP":      {timeoutLastArg, false},
+	"BRPOPLPUSH": {timeoutLastArg, false},
+	"BLMOVE":     {timeoutLastArg, false},
+	"BZPOPMIN":   {timeoutLastArg, false},
+	"BZPOPMAX":   {timeoutLastArg, false},
+	"BLMPOP":     {timeoutFirstArg, false},
+	"BZMPOP":     {timeoutFirstArg, false},
+	"WAIT":       {timeoutLastArg, true},
+	"WAITAOF":    {timeoutLastArg, true},
+	"XREAD":      {timeoutBlockArg, true},
+	"XREADGROUP": {timeoutBlockArg, true},
+}
+
+// BlockingTimeout returns the timeout of a blocking command, 0 meaning it blocks forever.
+// XREAD and XREADGROUP only block when called with BLOCK. Commands whose timeout can't be
+// parsed, which the server rejects, aren't reported as blocking.
+func BlockingTimeout(args []string) (time.Duration, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+	command, ok := redisBlockingCommands[strings.ToUpper(args[0])]
+	if !ok {
+		return 0, false
+	}
+
+	var timeout string
+	switch command.Position {
+	case timeoutLastArg:
+		timeout = args[len(args)-1]
+	case timeoutFirstArg:
+		timeout = args[1]
+	case timeoutBlockArg:
+		for i := 1; i+1 < len(args); i++ {
+			arg := strings.ToUpper(args[i])
+			if arg == "STREAMS" {
+				break
+			}
+			if arg == "BLOCK" {
+				timeout = args[i+1]
+				break
+			}
+		}
+		if timeout == "" {
+			return 0, false
+		}
+	}
+
+	// Timeouts in seconds can be fractional, e.g. BLPOP list 0.5
+	value, err := strconv.ParseFloat(timeout, 64)
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	if command.Milliseconds {
+		return time.Duration(value * float64(time.Millisecond)), true
+	}
+	return time.Duration(value * float64(time.Second)), true
+}
+
+// blockingTimedOut tells whether a blocking command returned because its timeout expired
+func blockingTimedOut(args []string, response []byte) bool {
+	switch strings.ToUpper(args[0]) {
+	case "WAIT":
+		// WAIT numreplicas timeout replies with the number of replicas reached
+		value, err := ParseRedisProtocol(bufio.NewReader(bytes.NewReader(response)))
+		acked, ok := value.(int64)
+		if err != nil || !ok {
+			return false
+		}
+		return fewerAcks(acked, args[len(args)-2])
+	case "WAITAOF":
+		// WAITAOF numlocal numreplicas timeout replies with the number of local and replica AOF fsyncs
+		value, err := ParseRedisProtocol(bufio.NewReader(bytes.NewReader(response)))
+		acks, ok := value.([]RedisValue)
+		if err != nil || !ok || len(args) < 4 || len(acks) != 2 {
+			return false
+		}
+		local, ok := acks[0].(int64)
+		if !ok {
+			return false
+		}
+		replicas, ok := acks[1].(int64)
+		if !ok {
+			return false
+		}
+		return fewerAcks(local, args[len(args)-3]) || fewerAcks(replicas, args[len(args)-2])
+	default:
+		return IsRedisNil(response)
+	}
+}
+
+// fewerAcks tells whether fewer acknowledgements than the number asked for were received
+func fewerAcks(acked int64, wanted string) bool {
+	n, err := strconv.ParseInt(wanted, 10, 64)
+	return err == nil && acked < n
+}
+
+type redisBlockingStats struct {
+	Calls        uint64
+	Data         uint64 // Calls that returned data
+	TimedOut     uint64 // Calls that returned nil once the timeout expired
+	Forever      uint64 // Calls with a timeout of 0
+	Blocked      LatencyHistogram
+	TotalTimeout time.Duration
+}
+
+// RedisBlockingTracker measures blocking commands separately from the other commands
+type RedisBlockingTracker struct {
+	mu       sync.Mutex
+	commands map[string]*redisBlockingStats
+}
+
+func NewRedisBlockingTracker() *RedisBlockingTracker {
+	return &RedisBlockingTracker{
+		commands: make(map[string]*redisBlockingStats),
+	}
+}
+
+// Observe records how long a blocking command was blocked for, compared to its timeout
+func (t *RedisBlockingTracker) Observe(args []string, timeout time.Duration, response []byte, blocked time.Duration) {
+	command := strings.ToUpper(args[0])
+	timedOut := blockingTimedOut(args, response)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.commands[command]
+	if !ok {
+		stats = &redisBlockingStats{}
+		t.commands[command] = stats
+	}
+	stats.Calls++
+	stats.Blocked.Observe(blocked)
+	if timeout == 0 {
+		stats.Forever++
+	} else {
+		stats.TotalTimeout += timeout
+	}
+	if timedOut {
+		stats.TimedOut++
+	} else {
+		stats.Data++
+	}
+}
+
+// Report logs time blocked versus timeout per blocking command
+func (t *RedisBlockingTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	commands := make([]string, 0, len(t.commands))
+	for command := range t.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	for _, command := range commands {
+		s := t.commands[command]
+		avgTimeout := "forever"
+		if withTimeout := s.Calls - s.Forever; withTimeout > 0 {
+			avgTimeout = (s.TotalTimeout / time.Duration(withTimeout)).String()
+		}
+		log.Printf("Blocking %s calls: %d data: %d timed out: %d blocked avg: %s max: %s timeout avg: %s %s",
+			command, s.Calls, s.Data, s.TimedOut, s.Blocked.Total/time.Duration(s.Calls), s.Blocked.Max, avgTimeout, &s.Blocked)
+	}
+}
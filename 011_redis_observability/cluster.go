@@ -0,0 +1,326 @@
+package main
+
+// Redis Cluster specification
+// https://redis.io/docs/latest/operate/oss_and_stack/reference/cluster-spec/
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keys are distributed over 16384 hash slots
+const RedisClusterSlots = 16384
+
+const (
+	REDIS_ERROR_MOVED     = "MOVED"
+	REDIS_ERROR_ASK       = "ASK"
+	REDIS_ERROR_CROSSSLOT = "CROSSSLOT"
+)
+
+// CRC16-CCITT (XMODEM) lookup table, the variant used by Redis Cluster
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeyHashSlot returns the hash slot of a key. If the key contains a non-empty hash tag,
+// e.g. "{user1000}.following", only the part between the first '{' and the following '}' is hashed
+func KeyHashSlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % RedisClusterSlots
+}
+
+// Commands whose arguments are all keys
+var redisMultiKeyCommands = map[string]bool{
+	"DEL": true, "UNLINK": true, "EXISTS": true, "TOUCH": true, "MGET": true, "WATCH": true,
+	"SDIFF": true, "SINTER": true, "SUNION": true, "PFCOUNT": true, "PFMERGE": true,
+	"SDIFFSTORE": true, "SINTERSTORE": true, "SUNIONSTORE": true, "RENAME": true, "RENAMENX": true,
+}
+
+// Commands whose first two arguments are keys, a source and a destination, followed by other arguments
+var redisTwoKeyCommands = map[string]bool{
+	"RPOPLPUSH": true, "BRPOPLPUSH": true, "LMOVE": true, "BLMOVE": true, "SMOVE": true, "COPY": true,
+}
+
+// Commands whose arguments are alternating keys and values
+var redisKeyValueCommands = map[string]bool{
+	"MSET": true, "MSETNX": true,
+}
+
+// Commands whose arguments are keys followed by a timeout
+var redisKeysTimeoutCommands = map[string]bool{
+	"BLPOP": true, "BRPOP": true, "BZPOPMIN": true, "BZPOPMAX": true,
+}
+
+// Commands with the index of their argument that is the number of keys following it
+var redisNumKeysCommands = map[string]int{
+	"EVAL": 2, "EVALSHA": 2, "EVAL_RO": 2, "EVALSHA_RO": 2, "FCALL": 2, "FCALL_RO": 2,
+	"LMPOP": 1, "ZMPOP": 1, "SINTERCARD": 1, "ZINTERCARD": 1, "ZUNION": 1, "ZINTER": 1, "ZDIFF": 1,
+	"BLMPOP": 2, "BZMPOP": 2, // After the timeout
+}
+
+// Commands whose first argument is a destination key, followed by the number of source keys and the keys
+var redisStoreNumKeysCommands = map[string]bool{
+	"ZUNIONSTORE": true, "ZINTERSTORE": true, "ZDIFFSTORE": true,
+}
+
+// Commands that are not routed by key
+var redisKeylessCommands = map[string]bool{
+	"PING": true, "ECHO": true, "AUTH": true, "HELLO": true, "SELECT": true, "QUIT": true,
+	"INFO": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true, "DBSIZE": true,
+	"FLUSHALL": true, "FLUSHDB": true, "KEYS": true, "SCAN": true, "RANDOMKEY": true, "TIME": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true, "WAIT": true, "READONLY": true,
+	"READWRITE": true, "ASKING": true, "SCRIPT": true, "FUNCTION": true, "PUBLISH": true,
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+}
+
+// CommandKeys returns the keys a command operates on, args[0] being the command name
+func CommandKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	name := strings.ToUpper(args[0])
+
+	switch {
+	case redisKeylessCommands[name]:
+		return nil
+	case redisMultiKeyCommands[name]:
+		return args[1:]
+	case redisKeyValueCommands[name]:
+		keys := []string{}
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case redisTwoKeyCommands[name]:
+		if len(args) < 3 {
+			return nil
+		}
+		return args[1:3]
+	case redisKeysTimeoutCommands[name]:
+		return args[1 : len(args)-1]
+	case redisNumKeysCommands[name] > 0:
+		return numKeysArgs(args, redisNumKeysCommands[name])
+	case redisStoreNumKeysCommands[name]:
+		keys := numKeysArgs(args, 2)
+		if keys == nil {
+			return nil
+		}
+		return append([]string{args[1]}, keys...)
+	case name == "XREAD" || name == "XREADGROUP":
+		// ... STREAMS key [key ...] id [id ...]
+		for i := 1; i < len(args); i++ {
+			if strings.ToUpper(args[i]) == "STREAMS" {
+				streams := args[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	default:
+		// Most commands take a single key as their first argument
+		return args[1:2]
+	}
+}
+
+// numKeysArgs returns the keys following args[i], the number of keys
+func numKeysArgs(args []string, i int) []string {
+	if i >= len(args) {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[i])
+	if err != nil || numKeys < 0 || i+1+numKeys > len(args) {
+		return nil
+	}
+	return args[i+1 : i+1+numKeys]
+}
+
+// RedisRedirect is a decoded -MOVED or -ASK reply
+type RedisRedirect struct {
+	Ask  bool // ASK redirects a single command while a slot is migrating, MOVED is permanent
+	Slot uint16
+	Node string // host:port
+}
+
+// ParseRedisRedirect decodes error messages such as "MOVED 3999 127.0.0.1:6381"
+func ParseRedisRedirect(msg string) (*RedisRedirect, bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != REDIS_ERROR_MOVED && fields[0] != REDIS_ERROR_ASK) {
+		return nil, false
+	}
+	slot, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil || slot >= RedisClusterSlots {
+		return nil, false
+	}
+	return &RedisRedirect{
+		Ask:  fields[0] == REDIS_ERROR_ASK,
+		Slot: uint16(slot),
+		Node: fields[2],
+	}, true
+}
+
+type redisClusterClientStats struct {
+	Commands  uint64
+	Moved     uint64
+	Ask       uint64
+	CrossSlot uint64 // CROSSSLOT errors returned by the server
+	MultiSlot uint64 // Commands whose keys hash to more than one slot
+}
+
+// RedisClusterTracker aggregates cluster redirections per client process,
+// and the slot to node mapping as the clients were told by the servers
+type RedisClusterTracker struct {
+	mu        sync.Mutex
+	clients   map[uint32]*redisClusterClientStats // keyed by pid
+	slots     map[uint16]string                   // from MOVED replies
+	migrating map[uint16]string                   // from ASK replies
+}
+
+func NewRedisClusterTracker() *RedisClusterTracker {
+	return &RedisClusterTracker{
+		clients:   make(map[uint32]*redisClusterClientStats),
+		slots:     make(map[uint16]string),
+		migrating: make(map[uint16]string),
+	}
+}
+
+// Observe records a command sent by the process pid and the reply it got
+func (t *RedisClusterTracker) Observe(pid uint32, args []string, status uint32, response []byte) {
+	keys := CommandKeys(args)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.clients[pid]
+	if !ok {
+		stats = &redisClusterClientStats{}
+		t.clients[pid] = stats
+	}
+	stats.Commands++
+
+	if len(keys) > 1 {
+		slot := KeyHashSlot(keys[0])
+		for _, key := range keys[1:] {
+			if KeyHashSlot(key) != slot {
+				stats.MultiSlot++
+				break
+			}
+		}
+	}
+
+	if status != BPF_STATUS_ERROR {
+		return
+	}
+	msg, ok := ParseRedisError(response)
+	if !ok {
+		return
+	}
+
+	if strings.HasPrefix(msg, REDIS_ERROR_CROSSSLOT) {
+		stats.CrossSlot++
+		log.Printf("CROSSSLOT pid: %d command: %s keys: %v", pid, strings.ToUpper(args[0]), keys)
+		return
+	}
+
+	redirect, ok := ParseRedisRedirect(msg)
+	if !ok {
+		return
+	}
+	kind := REDIS_ERROR_MOVED
+	if redirect.Ask {
+		kind = REDIS_ERROR_ASK
+		stats.Ask++
+		t.migrating[redirect.Slot] = redirect.Node
+	} else {
+		stats.Moved++
+		t.slots[redirect.Slot] = redirect.Node
+		delete(t.migrating, redirect.Slot)
+	}
+
+	// The slot computed from the key should match the one in the reply
+	if len(keys) > 0 && KeyHashSlot(keys[0]) != redirect.Slot {
+		log.Printf("Slot mismatch for key %s: computed %d, server replied %d", keys[0], KeyHashSlot(keys[0]), redirect.Slot)
+	}
+	log.Printf("%s pid: %d command: %s slot: %d node: %s", kind, pid, strings.ToUpper(args[0]), redirect.Slot, redirect.Node)
+}
+
+// Report logs the redirect rates per client and the slot to node mapping seen so far
+func (t *RedisClusterTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.clients) == 0 {
+		return
+	}
+
+	pids := make([]uint32, 0, len(t.clients))
+	for pid := range t.clients {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+
+	for _, pid := range pids {
+		s := t.clients[pid]
+		redirects := s.Moved + s.Ask
+		log.Printf("Cluster pid: %d commands: %d redirects: %d (%.2f%%) moved: %d ask: %d crossslot errors: %d multi-slot commands: %d",
+			pid, s.Commands, redirects, 100*float64(redirects)/float64(s.Commands), s.Moved, s.Ask, s.CrossSlot, s.MultiSlot)
+	}
+
+	for _, r := range slotRanges(t.slots) {
+		log.Printf("Cluster slots %s", r)
+	}
+	for slot, node := range t.migrating {
+		log.Printf("Cluster slot %d migrating to %s", slot, node)
+	}
+}
+
+// slotRanges collapses consecutive slots served by the same node, e.g. "0-5460 -> 10.0.0.1:6379"
+func slotRanges(slots map[uint16]string) []string {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, int(slot))
+	}
+	sort.Ints(sorted)
+
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		node := slots[uint16(sorted[i])]
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 && slots[uint16(sorted[j+1])] == node {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d -> %s", sorted[i], node))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d -> %s", sorted[i], sorted[j], node))
+		}
+		i = j + 1
+	}
+	return ranges
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of log2 buckets. Bucket i > 0 starts at 2^(i-1) µs, so the last one holds everything from
+// 2^24 µs (~16.8 seconds) up
+const latencyBuckets = 26
+
+// LatencyHistogram counts latencies in log2 buckets of microseconds: [0,1), [1,2), [2,4), [4,8)...
+type LatencyHistogram struct {
+	Buckets [latencyBuckets]uint64
+	Count   uint64
+	Total   time.Duration
+	Max     time.Duration
+}
+
+func (h *LatencyHistogram) Observe(latency time.Duration) {
+	bucket := 0
+	if us := latency.Microseconds(); us > 0 {
+		bucket = bits.Len64(uint64(us))
+	}
+	if bucket >= latencyBuckets {
+		bucket = latencyBuckets - 1
+	}
+	h.Buckets[bucket]++
+	h.Count++
+	h.Total += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+}
+
+// bucketRange returns the lower and upper bound of a bucket
+func bucketRange(bucket int) (time.Duration, time.Duration) {
+	if bucket == 0 {
+		return 0, time.Microsecond
+	}
+	return time.Duration(1<<(bucket-1)) * time.Microsecond, time.Duration(1<<bucket) * time.Microsecond
+}
+
+// String prints the non-empty buckets, e.g. "[256µs, 512µs): 10 [512µs, 1.024ms): 2"
+func (h *LatencyHistogram) String() string {
+	var b strings.Builder
+	for i, count := range h.Buckets {
+		if count == 0 {
+			continue
+		}
+		low, high := bucketRange(i)
+		if i == latencyBuckets-1 {
+			fmt.Fprintf(&b, "[%s, ...): %d ", low, count)
+		} else {
+			fmt.Fprintf(&b, "[%s, %s): %d ", low, high, count)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// RedisLatencyTracker keeps a latency histogram per command
+type RedisLatencyTracker struct {
+	mu       sync.Mutex
+	commands map[string]*LatencyHistogram
+}
+
+func NewRedisLatencyTracker() *RedisLatencyTracker {
+	return &RedisLatencyTracker{
+		commands: make(map[string]*LatencyHistogram),
+	}
+}
+
+func (t *RedisLatencyTracker) Observe(command string, latency time.Duration) {
+	command = strings.ToUpper(command)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.commands[command]
+	if !ok {
+		h = &LatencyHistogram{}
+		t.commands[command] = h
+	}
+	h.Observe(latency)
+}
+
+// Report logs the latency histogram of every command
+func (t *RedisLatencyTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	commands := make([]string, 0, len(t.commands))
+	for command := range t.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	for _, command := range commands {
+		h := t.commands[command]
+		log.Printf("Latency %s count: %d avg: %s max: %s %s", command, h.Count, h.Total/time.Duration(h.Count), h.Max, h)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"unsafe"
 	"bufio"
 	"bytes"
+	"time"
 
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/perf"
@@ -16,7 +18,14 @@ import (
 
 var pgObjs redisObjects
 
+// How often aggregated statistics are logged
+const reportInterval = 10 * time.Second
+
+var includeBlocking = flag.Bool("include-blocking", false, "include blocking commands such as BLPOP in the latency histograms")
+
 func main() {
+	flag.Parse()
+
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatal(err)
@@ -51,6 +60,21 @@ func main() {
 		log.Fatal("error creating perf event array reader")
 	}
 
+	clusterTracker := NewRedisClusterTracker()
+	scriptTracker := NewRedisScriptTracker()
+	latencyTracker := NewRedisLatencyTracker()
+	blockingTracker := NewRedisBlockingTracker()
+	streamTracker := NewRedisStreamTracker()
+	go func() {
+		for range time.Tick(reportInterval) {
+			clusterTracker.Report()
+			scriptTracker.Report()
+			latencyTracker.Report()
+			blockingTracker.Report()
+			streamTracker.Report()
+		}
+	}()
+
 	for {
 		var record perf.Record
 		err := L7EventsReader.ReadInto(&record)
@@ -77,7 +101,29 @@ func main() {
 			if err != nil {
 				log.Println("Error:", err)
 			} else {
-				log.Printf("%s\n", ConvertValueToString(value))
+				args, ok := ConvertValueToArgs(value)
+				if line, isScript := FormatScriptCommand(args); isScript {
+					log.Printf("%s\n", line)
+				} else {
+					log.Printf("%s\n", ConvertValueToString(value))
+				}
+
+				if ok && RedisMethodConversion(l7Event.Method).String() == REDIS_COMMAND {
+					response := l7Event.ResponsePayload[:l7Event.ResponsePayloadSize]
+					clusterTracker.Observe(l7Event.Pid, args, l7Event.Status, response)
+					latency := time.Duration(l7Event.Duration)
+					scriptTracker.Observe(args, l7Event.Status, response, latency)
+					streamTracker.Observe(args, l7Event.Status, response, l7Event.WriteTimeNs, l7Event.WriteTimeNs+l7Event.Duration)
+
+					// Blocking commands are kept out of the latency histograms unless asked for
+					timeout, blocking := BlockingTimeout(args)
+					if blocking {
+						blockingTracker.Observe(args, timeout, response, latency)
+					}
+					if !blocking || *includeBlocking {
+						latencyTracker.Observe(args[0], latency)
+					}
+				}
 			}
 		}
 	}
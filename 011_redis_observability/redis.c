@@ -66,6 +66,9 @@ int process_enter_of_syscalls_write(void* ctx, __u64 fd, char* buf, __u64 payloa
         }
     }
 
+    // Start time of the request, used to calculate the latency once the response is read
+    req->write_time_ns = bpf_ktime_get_ns();
+
     // Copy the payload from the packet and check whether it fit below the MAX_PAYLOAD_SIZE
     bpf_probe_read(&req->payload, sizeof(req->payload), (const void *)buf);
     if (payload_size > MAX_PAYLOAD_SIZE) {
@@ -144,6 +147,8 @@ int process_exit_of_syscalls_read(void* ctx, __s64 ret) {
             }
             e->protocol = PROTOCOL_REDIS;
             e->method = METHOD_REDIS_PUSHED_EVENT;
+            e->write_time_ns = 0;
+            e->duration = 0;
             
             // Read the payload from the packet and check whether it fit below the MAX_PAYLOAD_SIZE
             bpf_probe_read(e->payload, MAX_PAYLOAD_SIZE, read_info->buf);
@@ -155,6 +160,12 @@ int process_exit_of_syscalls_read(void* ctx, __s64 ret) {
                 e->payload_read_complete = 1;
             }
             
+            e->fd = read_info->fd;
+            e->pid = pid;
+            e->tid = id & 0xFFFFFFFF;
+            e->response_payload_size = 0;
+            e->response_payload_read_complete = 0;
+
             bpf_map_delete_elem(&active_reads, &id);
 
             // Forward the event to the userspace application
@@ -166,8 +177,13 @@ int process_exit_of_syscalls_read(void* ctx, __s64 ret) {
         return 0;
     }
 
+    e->fd = read_info->fd;
+    e->pid = pid;
+    e->tid = id & 0xFFFFFFFF;
     e->method = active_req->method;
     e->protocol = active_req->protocol;
+    e->write_time_ns = active_req->write_time_ns;
+    e->duration = bpf_ktime_get_ns() - active_req->write_time_ns;
     
     // Copy Request payload values
     e->payload_size = active_req->payload_size;
@@ -183,6 +199,19 @@ int process_exit_of_syscalls_read(void* ctx, __s64 ret) {
                 e->method = METHOD_REDIS_COMMAND;
             }
         }
+
+        // Copy the response so user space can decode replies such as -MOVED and -ASK
+        e->response_payload_size = 0;
+        e->response_payload_read_complete = 0;
+        if (ret > 0) {
+            bpf_probe_read(e->response_payload, MAX_PAYLOAD_SIZE, read_info->buf);
+            if (ret > MAX_PAYLOAD_SIZE) {
+                e->response_payload_size = MAX_PAYLOAD_SIZE;
+            } else {
+                e->response_payload_size = ret;
+                e->response_payload_read_complete = 1;
+            }
+        }
     } else {
         bpf_map_delete_elem(&active_reads, &id);
         return 0;
@@ -94,6 +94,9 @@ struct l7_event {
     __u8 is_tls;
     __u32 seq;
     __u32 tid;
+    unsigned char response_payload[MAX_PAYLOAD_SIZE];
+    __u32 response_payload_size;
+    __u8 response_payload_read_complete;
 };
 
 struct trace_event_raw_sys_exit_recvfrom {
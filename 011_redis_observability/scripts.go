@@ -0,0 +1,165 @@
+package main
+
+// Lua scripts and functions
+// https://redis.io/docs/latest/develop/interact/programmability/eval-intro/
+// https://redis.io/docs/latest/develop/interact/programmability/functions-intro/
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REDIS_ERROR_NOSCRIPT = "NOSCRIPT"
+
+// Length of the script body shown next to its SHA1
+const scriptSummaryLen = 40
+
+type redisScriptStats struct {
+	Calls        uint64
+	Errors       uint64
+	NoScript     uint64 // EVALSHA calls rejected since the script wasn't loaded
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// RedisScriptTracker maps EVALSHA calls back to the scripts seen in EVAL and SCRIPT LOAD,
+// and aggregates call counts and latency per script and per function
+type RedisScriptTracker struct {
+	mu       sync.Mutex
+	scripts  map[string]string            // sha1 -> script summary
+	stats    map[string]*redisScriptStats // script sha1 or function name
+	isScript map[string]bool
+}
+
+func NewRedisScriptTracker() *RedisScriptTracker {
+	return &RedisScriptTracker{
+		scripts:  make(map[string]string),
+		stats:    make(map[string]*redisScriptStats),
+		isScript: make(map[string]bool),
+	}
+}
+
+// ScriptSHA1 returns the SHA1 Redis uses to identify a script body
+func ScriptSHA1(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptSummary turns a script body into a single, short line
+func scriptSummary(body string) string {
+	summary := strings.Join(strings.Fields(body), " ")
+	if len(summary) > scriptSummaryLen {
+		summary = summary[:scriptSummaryLen] + "..."
+	}
+	return summary
+}
+
+// FormatScriptCommand prints EVAL and SCRIPT LOAD with the SHA1 and a summary instead of the whole script body
+func FormatScriptCommand(args []string) (string, bool) {
+	if len(args) < 2 {
+		return "", false
+	}
+	switch strings.ToUpper(args[0]) {
+	case "EVAL", "EVAL_RO":
+		body := args[1]
+		args = append([]string{args[0], ScriptSHA1(body)[:8], "(" + scriptSummary(body) + ")"}, args[2:]...)
+	case "SCRIPT":
+		if strings.ToUpper(args[1]) != "LOAD" || len(args) < 3 {
+			return "", false
+		}
+		body := args[2]
+		args = []string{args[0], args[1], ScriptSHA1(body)[:8], "(" + scriptSummary(body) + ")"}
+	default:
+		return "", false
+	}
+	return strings.Join(args, " "), true
+}
+
+// Observe records a command and its reply, commands other than scripts and functions are ignored
+func (t *RedisScriptTracker) Observe(args []string, status uint32, response []byte, latency time.Duration) {
+	if len(args) < 2 {
+		return
+	}
+
+	var id string
+	isScript := true
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "EVAL", "EVAL_RO":
+		id = ScriptSHA1(args[1])
+		t.scripts[id] = scriptSummary(args[1])
+	case "EVALSHA", "EVALSHA_RO":
+		id = strings.ToLower(args[1])
+	case "FCALL", "FCALL_RO":
+		id = args[1]
+		isScript = false
+	case "SCRIPT":
+		if strings.ToUpper(args[1]) == "LOAD" && len(args) > 2 {
+			t.scripts[ScriptSHA1(args[2])] = scriptSummary(args[2])
+		}
+		return
+	default:
+		return
+	}
+
+	stats, ok := t.stats[id]
+	if !ok {
+		stats = &redisScriptStats{}
+		t.stats[id] = stats
+		t.isScript[id] = isScript
+	}
+	stats.Calls++
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+
+	if status != BPF_STATUS_ERROR {
+		return
+	}
+	stats.Errors++
+	if msg, ok := ParseRedisError(response); ok && strings.HasPrefix(msg, REDIS_ERROR_NOSCRIPT) {
+		stats.NoScript++
+		log.Printf("NOSCRIPT %s", t.name(id))
+	}
+}
+
+// name returns a readable identity of a script or function
+func (t *RedisScriptTracker) name(id string) string {
+	if !t.isScript[id] {
+		return "function " + id
+	}
+	summary, ok := t.scripts[id]
+	if !ok {
+		summary = "(body not seen)"
+	}
+	return "script " + id[:min(8, len(id))] + " " + summary
+}
+
+// Report logs call counts and latency per script and function, the most expensive first
+func (t *RedisScriptTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.stats))
+	for id := range t.stats {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return t.stats[ids[i]].TotalLatency > t.stats[ids[j]].TotalLatency
+	})
+
+	for _, id := range ids {
+		s := t.stats[id]
+		log.Printf("Lua %s calls: %d errors: %d noscript: %d avg: %s max: %s total: %s",
+			t.name(id), s.Calls, s.Errors, s.NoScript, s.TotalLatency/time.Duration(s.Calls), s.MaxLatency, s.TotalLatency)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+// Redis Streams and consumer groups
+// https://redis.io/docs/latest/develop/data-types/streams/
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries delivered but not acknowledged yet are tracked up to this limit
+const maxPendingEntries = 100000
+
+type streamGroupKey struct {
+	Stream string
+	Group  string
+}
+
+type pendingEntry struct {
+	Consumer    string
+	DeliveredNs uint64 // kernel time the entry was delivered to the consumer
+}
+
+type redisStreamGroupStats struct {
+	Consumed     uint64 // New entries delivered with XREADGROUP ... >
+	Redelivered  uint64 // Entries read again from the consumer's pending list
+	Acked        uint64
+	Claimed      uint64
+	AckLatency   LatencyHistogram        // From delivery to XACK
+	ClaimedFrom  map[string]uint64       // consumer -> entries claimed away from it
+	Pending      map[string]pendingEntry // entry ID -> delivery
+	lastConsumed uint64
+}
+
+// RedisStreamTracker builds a client-side view of streams and consumer groups from the traced commands
+type RedisStreamTracker struct {
+	mu           sync.Mutex
+	produced     map[string]uint64 // stream -> entries added with XADD
+	lastProduced map[string]uint64
+	groups       map[streamGroupKey]*redisStreamGroupStats
+	pending      int
+	lastReport   time.Time
+}
+
+func NewRedisStreamTracker() *RedisStreamTracker {
+	return &RedisStreamTracker{
+		produced:     make(map[string]uint64),
+		lastProduced: make(map[string]uint64),
+		groups:       make(map[streamGroupKey]*redisStreamGroupStats),
+		lastReport:   time.Now(),
+	}
+}
+
+func (t *RedisStreamTracker) group(stream, group string) *redisStreamGroupStats {
+	k := streamGroupKey{Stream: stream, Group: group}
+	stats, ok := t.groups[k]
+	if !ok {
+		stats = &redisStreamGroupStats{
+			ClaimedFrom: make(map[string]uint64),
+			Pending:     make(map[string]pendingEntry),
+		}
+		t.groups[k] = stats
+	}
+	return stats
+}
+
+// streamEntryIDs returns the IDs of stream entries replied as [[id, [field, value, ...]], ...],
+// or as [id, ...] for commands called with JUSTID
+func streamEntryIDs(value RedisValue) []string {
+	entries, ok := value.([]RedisValue)
+	if !ok {
+		return nil
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case string:
+			ids = append(ids, e)
+		case []RedisValue:
+			if len(e) > 0 {
+				if id, ok := e[0].(string); ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// Observe records a stream command and its reply, startNs and endNs being the kernel time
+// the command was written and the reply read
+func (t *RedisStreamTracker) Observe(args []string, status uint32, response []byte, startNs, endNs uint64) {
+	if len(args) < 2 || status == BPF_STATUS_ERROR {
+		return
+	}
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "XADD", "XREADGROUP", "XACK", "XCLAIM", "XAUTOCLAIM":
+	default:
+		return
+	}
+
+	reply, err := ParseRedisProtocol(bufio.NewReader(bytes.NewReader(response)))
+	if err != nil {
+		// The reply didn't fit in the copied payload
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch command {
+	case "XADD":
+		// XADD key [NOMKSTREAM] [MAXLEN|MINID ...] <* | id> field value [field value ...]
+		if id, ok := reply.(string); ok && id != "" {
+			t.produced[args[1]]++
+		}
+	case "XREADGROUP":
+		t.observeReadGroup(args, reply, endNs)
+	case "XACK":
+		// XACK key group id [id ...]
+		if len(args) < 4 {
+			return
+		}
+		stats := t.group(args[1], args[2])
+		for _, id := range args[3:] {
+			entry, ok := stats.Pending[id]
+			if !ok {
+				continue
+			}
+			stats.Acked++
+			if startNs > entry.DeliveredNs {
+				stats.AckLatency.Observe(time.Duration(startNs - entry.DeliveredNs))
+			}
+			delete(stats.Pending, id)
+			t.pending--
+		}
+	case "XCLAIM":
+		// XCLAIM key group consumer min-idle-time id [id ...] [JUSTID] ...
+		if len(args) < 6 {
+			return
+		}
+		t.observeClaim(args[1], args[2], args[3], streamEntryIDs(reply), endNs)
+	case "XAUTOCLAIM":
+		// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+		// replies with [next start, claimed entries, deleted IDs]
+		replies, ok := reply.([]RedisValue)
+		if len(args) < 6 || !ok || len(replies) < 2 {
+			return
+		}
+		t.observeClaim(args[1], args[2], args[3], streamEntryIDs(replies[1]), endNs)
+	}
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]
+// replies with [[key, [[id, [field, value, ...]], ...]], ...]
+func (t *RedisStreamTracker) observeReadGroup(args []string, reply RedisValue, deliveredNs uint64) {
+	if len(args) < 4 || strings.ToUpper(args[1]) != "GROUP" {
+		return
+	}
+	group, consumer := args[2], args[3]
+
+	// ">" reads new entries, any other ID reads the consumer's pending entries again
+	newEntries := map[string]bool{}
+	noAck := false
+	for i := 4; i < len(args); i++ {
+		arg := strings.ToUpper(args[i])
+		if arg == "NOACK" {
+			noAck = true
+		}
+		if arg == "STREAMS" {
+			streams := args[i+1:]
+			keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
+			for j, key := range keys {
+				newEntries[key] = ids[j] == ">"
+			}
+			break
+		}
+	}
+
+	streams, ok := reply.([]RedisValue)
+	if !ok {
+		// nil once BLOCK expired
+		return
+	}
+	for _, s := range streams {
+		stream, ok := s.([]RedisValue)
+		if !ok || len(stream) < 2 {
+			continue
+		}
+		key, ok := stream[0].(string)
+		if !ok {
+			continue
+		}
+		stats := t.group(key, group)
+		for _, id := range streamEntryIDs(stream[1]) {
+			if !newEntries[key] {
+				stats.Redelivered++
+				continue
+			}
+			stats.Consumed++
+			if noAck || t.pending >= maxPendingEntries {
+				continue
+			}
+			if _, ok := stats.Pending[id]; !ok {
+				t.pending++
+			}
+			stats.Pending[id] = pendingEntry{Consumer: consumer, DeliveredNs: deliveredNs}
+		}
+	}
+}
+
+// observeClaim transfers the ownership of pending entries to the claiming consumer
+func (t *RedisStreamTracker) observeClaim(stream, group, consumer string, ids []string, claimedNs uint64) {
+	stats := t.group(stream, group)
+	for _, id := range ids {
+		stats.Claimed++
+		entry, ok := stats.Pending[id]
+		if !ok {
+			if t.pending >= maxPendingEntries {
+				continue
+			}
+			t.pending++
+		} else if entry.Consumer != consumer {
+			stats.ClaimedFrom[entry.Consumer]++
+		}
+		stats.Pending[id] = pendingEntry{Consumer: consumer, DeliveredNs: claimedNs}
+	}
+}
+
+// Report logs produce and consume rates since the last report, ack latency and claimed entries
+func (t *RedisStreamTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elapsed := time.Since(t.lastReport).Seconds()
+	t.lastReport = time.Now()
+
+	streams := make([]string, 0, len(t.produced))
+	for stream := range t.produced {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	for _, stream := range streams {
+		produced := t.produced[stream]
+		log.Printf("Stream %s produced: %d (%.2f/s)", stream, produced, float64(produced-t.lastProduced[stream])/elapsed)
+		t.lastProduced[stream] = produced
+	}
+
+	keys := make([]streamGroupKey, 0, len(t.groups))
+	for k := range t.groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Stream != keys[j].Stream {
+			return keys[i].Stream < keys[j].Stream
+		}
+		return keys[i].Group < keys[j].Group
+	})
+	for _, k := range keys {
+		s := t.groups[k]
+		var avgAck time.Duration
+		if s.AckLatency.Count > 0 {
+			avgAck = s.AckLatency.Total / time.Duration(s.AckLatency.Count)
+		}
+		log.Printf("Stream %s group %s consumed: %d (%.2f/s) redelivered: %d acked: %d pending: %d claimed: %d ack latency avg: %s max: %s %s",
+			k.Stream, k.Group, s.Consumed, float64(s.Consumed-s.lastConsumed)/elapsed, s.Redelivered, s.Acked, len(s.Pending), s.Claimed, avgAck, s.AckLatency.Max, &s.AckLatency)
+		s.lastConsumed = s.Consumed
+
+		for consumer, count := range s.ClaimedFrom {
+			log.Printf("Stream %s group %s consumer %s: %d entries claimed away", k.Stream, k.Group, consumer, count)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -53,25 +54,35 @@ type L7Event struct {
 }
 
 type bpfL7Event struct {
-	Fd                  uint64
-	WriteTimeNs         uint64
-	Pid                 uint32
-	Status              uint32
-	Duration            uint64
-	Protocol            uint8
-	Method              uint8
-	Padding             uint16
-	Payload             [1024]uint8
-	PayloadSize         uint32
-	PayloadReadComplete uint8
-	Failed              uint8
-	IsTls               uint8
-	_                   [1]byte
-	Seq                 uint32
-	Tid                 uint32
-	_                   [4]byte
+	Fd                          uint64
+	WriteTimeNs                 uint64
+	Pid                         uint32
+	Status                      uint32
+	Duration                    uint64
+	Protocol                    uint8
+	Method                      uint8
+	Padding                     uint16
+	Payload                     [1024]uint8
+	PayloadSize                 uint32
+	PayloadReadComplete         uint8
+	Failed                      uint8
+	IsTls                       uint8
+	_                           [1]byte
+	Seq                         uint32
+	Tid                         uint32
+	ResponsePayload             [1024]uint8
+	ResponsePayloadSize         uint32
+	ResponsePayloadReadComplete uint8
+	_                           [7]byte
 }
 
+// Response status reported by the eBPF program, order is important
+const (
+	BPF_STATUS_SUCCESS = iota + 1
+	BPF_STATUS_ERROR
+	BPF_STATUS_UNKNOWN
+)
+
 // Custom types for the enumeration
 type L7ProtocolConversion uint32
 type RedisMethodConversion uint32
@@ -221,3 +232,39 @@ func ConvertValueToString(value RedisValue) string {
 		return "Unknown"
 	}
 }
+
+// ConvertValueToArgs converts a command, sent as a RESP array of bulk strings, to its arguments
+func ConvertValueToArgs(value RedisValue) ([]string, bool) {
+	array, ok := value.([]RedisValue)
+	if !ok || len(array) == 0 {
+		return nil, false
+	}
+	args := make([]string, len(array))
+	for i, elem := range array {
+		arg, ok := elem.(string)
+		if !ok {
+			return nil, false
+		}
+		args[i] = arg
+	}
+	return args, true
+}
+
+// ParseRedisError returns the message of a simple error reply, e.g. "MOVED 3999 127.0.0.1:6381"
+func ParseRedisError(payload []byte) (string, bool) {
+	if len(payload) == 0 || payload[0] != ErrorPrefix {
+		return "", false
+	}
+	msg, err := parseError(bufio.NewReader(bytes.NewReader(payload[1:])))
+	if err != nil {
+		return "", false
+	}
+	return msg, true
+}
+
+// IsRedisNil tells whether a reply is a null bulk string, a null array or the RESP3 null
+func IsRedisNil(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte("$-1\r\n")) ||
+		bytes.HasPrefix(payload, []byte("*-1\r\n")) ||
+		bytes.HasPrefix(payload, []byte("_\r\n"))
+}
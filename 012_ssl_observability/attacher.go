@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+const (
+	processEventExec = 0
+	processEventMmap = 1
+	processEventExit = 2
+)
+
+// attachment is a library or executable the probes of a backend are attached to
+type attachment struct {
+	backend   *tlsBackend
+	library   sslLibrary
+	links     []link.Link
+	installed bool            // Listed in ld.so.cache, attached as long as the tracer runs
+	users     map[uint32]bool // Processes that loaded it
+}
+
+// Attacher attaches the TLS backends to the libraries installed on the host and to those loaded by processes,
+// including processes started after the tracer, and detaches them once the last process using them exits
+type Attacher struct {
+	mu          sync.Mutex
+	objs        *bpfObjects
+	attachments map[libraryKey]*attachment
+	processes   map[uint32][]libraryKey // Libraries each process loaded
+	skipped     map[libraryKey]bool     // Files that aren't TLS libraries or failed to attach, not looked at again
+}
+
+func NewAttacher(objs *bpfObjects) *Attacher {
+	return &Attacher{
+		objs:        objs,
+		attachments: make(map[libraryKey]*attachment),
+		processes:   make(map[uint32][]libraryKey),
+		skipped:     make(map[libraryKey]bool),
+	}
+}
+
+// AttachInstalled attaches to the libraries of /etc/ld.so.cache
+func (a *Attacher) AttachInstalled() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := range tlsBackends {
+		backend := &tlsBackends[i]
+		if backend.library == "" {
+			continue
+		}
+		libraries, err := installedLibraries(backend.library)
+		if err != nil {
+			log.Printf("%s: %s", backend.name, err)
+			continue
+		}
+		for _, library := range libraries {
+			if att := a.attach(backend, library); att != nil {
+				att.installed = true
+			}
+		}
+	}
+}
+
+// ScanProcesses attaches to the libraries and executables of the running processes
+func (a *Attacher) ScanProcesses() {
+	pids, err := pids()
+	if err != nil {
+		log.Printf("listing processes: %s", err)
+		return
+	}
+	for _, pid := range pids {
+		a.HandleEvent(uint32(pid), processEventExec, "")
+		a.HandleEvent(uint32(pid), processEventMmap, "")
+	}
+}
+
+// HandleEvent updates the attachments after a process event. An exec replaces the executable and unmaps
+// the libraries of the process, which are then mapped again one by one; filename is the name of the mapped file,
+// or empty to look for every library.
+func (a *Attacher) HandleEvent(pid uint32, eventType uint32, filename string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch eventType {
+	case processEventExec:
+		a.release(pid)
+		for i := range tlsBackends {
+			backend := &tlsBackends[i]
+			if backend.library != "" {
+				continue
+			}
+			// Processes can exit before we look at them
+			if path, err := processExecutable(int(pid)); err == nil {
+				a.use(backend, path, pid)
+			}
+		}
+
+	case processEventMmap:
+		for i := range tlsBackends {
+			backend := &tlsBackends[i]
+			if backend.library == "" || (filename != "" && !isLibrary(filename, backend.library)) {
+				continue
+			}
+			paths, err := processLibraries(int(pid), backend.library)
+			if err != nil {
+				continue
+			}
+			for _, path := range paths {
+				a.use(backend, path, pid)
+			}
+		}
+
+	case processEventExit:
+		a.release(pid)
+	}
+}
+
+// use records that pid loaded the library or executable at path, attaching to it if it's the first user
+func (a *Attacher) use(backend *tlsBackend, path string, pid uint32) {
+	library, err := statLibrary(path)
+	if err != nil {
+		return
+	}
+	k := library.key()
+	if a.skipped[k] {
+		return
+	}
+
+	att, ok := a.attachments[k]
+	if !ok {
+		if backend.accept != nil && !backend.accept(path) {
+			a.skipped[k] = true
+			return
+		}
+		if att = a.attach(backend, library); att == nil {
+			return
+		}
+	}
+	a.addUser(att, pid)
+}
+
+func (a *Attacher) addUser(att *attachment, pid uint32) {
+	if !att.users[pid] {
+		att.users[pid] = true
+		a.processes[pid] = append(a.processes[pid], att.library.key())
+	}
+}
+
+func (a *Attacher) attach(backend *tlsBackend, library sslLibrary) *attachment {
+	k := library.key()
+	if att, ok := a.attachments[k]; ok {
+		return att
+	}
+	links, err := backend.attach(a.objs, library.Path)
+	if err != nil {
+		log.Printf("Skipping %s: %s", library.Path, err)
+		a.skipped[k] = true
+		return nil
+	}
+	log.Printf("%s path: %s (inode %d)\n", backend.name, library.Path, library.Ino)
+	att := &attachment{
+		backend: backend,
+		library: library,
+		links:   links,
+		users:   make(map[uint32]bool),
+	}
+	a.attachments[k] = att
+	return att
+}
+
+// release forgets the libraries pid used, detaching those it was the last user of
+func (a *Attacher) release(pid uint32) {
+	for _, k := range a.processes[pid] {
+		att, ok := a.attachments[k]
+		if !ok {
+			continue
+		}
+		delete(att.users, pid)
+		if len(att.users) == 0 && !att.installed {
+			a.findUsers(att, pid)
+		}
+		if len(att.users) > 0 || att.installed {
+			continue
+		}
+		closeLinks(att.links)
+		delete(a.attachments, k)
+		log.Printf("Detached %s path: %s (inode %d)\n", att.backend.name, att.library.Path, att.library.Ino)
+	}
+	delete(a.processes, pid)
+}
+
+// findUsers looks for processes still using a library whose known users are gone, e.g. the children
+// a daemon forked before exiting, since forks inherit the mappings without any event
+func (a *Attacher) findUsers(att *attachment, exited uint32) {
+	pids, err := pids()
+	if err != nil {
+		return
+	}
+	for _, pid := range pids {
+		if uint32(pid) == exited {
+			continue
+		}
+		var paths []string
+		if att.backend.library == "" {
+			if path, err := processExecutable(pid); err == nil {
+				paths = append(paths, path)
+			}
+		} else {
+			paths, _ = processLibraries(pid, att.backend.library)
+		}
+		for _, path := range paths {
+			if library, err := statLibrary(path); err == nil && library.key() == att.library.key() {
+				a.addUser(att, uint32(pid))
+			}
+		}
+	}
+}
+
+// Len returns the number of libraries and executables attached to
+func (a *Attacher) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.attachments)
+}
+
+func (a *Attacher) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, att := range a.attachments {
+		closeLinks(att.links)
+		delete(a.attachments, k)
+	}
+}
+
+// attachProcessTracepoints attaches to the process lifecycle tracepoints feeding the Attacher
+func attachProcessTracepoints(objs *bpfObjects) ([]link.Link, error) {
+	tracepoints := []struct {
+		group, name string
+		prog        *ebpf.Program
+	}{
+		{"sched", "sched_process_exec", objs.TracepointSchedProcessExec},
+		{"sched", "sched_process_exit", objs.TracepointSchedProcessExit},
+		{"syscalls", "sys_enter_mmap", objs.TracepointSysEnterMmap},
+		{"syscalls", "sys_exit_mmap", objs.TracepointSysExitMmap},
+	}
+
+	links := []link.Link{}
+	for _, tp := range tracepoints {
+		l, err := link.Tracepoint(tp.group, tp.name, tp.prog, nil)
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("attaching tracepoint %s: %s", tp.name, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// tlsBackend is a TLS implementation whose plaintext is captured, all of them feeding the same events
+type tlsBackend struct {
+	name    string
+	library string                 // Prefix of the shared library name, empty when the library is linked into executables
+	accept  func(path string) bool // Whether an executable embeds the library
+	attach  func(objs *bpfObjects, path string) ([]link.Link, error)
+}
+
+var tlsBackends = []tlsBackend{
+	{"OpenSSL", "libssl", nil, attachSSLProbes},
+	// BIO_new_socket is part of libcrypto, which processes map along with libssl
+	{"OpenSSL libcrypto", "libcrypto", nil, attachCryptoProbes},
+	{"GnuTLS", "libgnutls", nil, attachGnuTLSProbes},
+	{"NSS", "libnspr4", nil, attachNSSProbes},
+	// BoringSSL is usually linked statically, e.g. in Envoy or Chrome, and has the same API as OpenSSL
+	{"BoringSSL", "", func(path string) bool { return definesSymbol(path, "SSL_write") }, attachSSLProbes},
+}
+
+type uprobeSpec struct {
+	symbol    string
+	uprobe    *ebpf.Program
+	uretprobe *ebpf.Program // nil when the return isn't needed
+	optional  bool          // Skipped when the library doesn't define the symbol
+}
+
+// attachUprobes attaches the probes to the symbols of the library or executable at path, with a cookie
+// that the programs read with bpf_get_attach_cookie
+func attachUprobes(path string, cookie uint64, specs []uprobeSpec) ([]link.Link, error) {
+	// Open an ELF binary and read its symbols.
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening executable: %s", err)
+	}
+
+	opts := &link.UprobeOptions{Cookie: cookie}
+	links := []link.Link{}
+	for _, spec := range specs {
+		up, err := ex.Uprobe(spec.symbol, spec.uprobe, opts)
+		// A symbol the library imports rather than defines has no address, which the uprobe reports as not supported
+		if spec.optional && (errors.Is(err, link.ErrNoSymbol) || errors.Is(err, link.ErrNotSupported)) {
+			continue
+		}
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("creating uprobe - %s: %s", spec.symbol, err)
+		}
+		links = append(links, up)
+
+		if spec.uretprobe == nil {
+			continue
+		}
+		uret, err := ex.Uretprobe(spec.symbol, spec.uretprobe, opts)
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("creating uretprobe - %s: %s", spec.symbol, err)
+		}
+		links = append(links, uret)
+	}
+	return links, nil
+}
+
+// attachCryptoProbes attaches to BIO_new_socket, so that the socket BIOs given to SSL_set_bio bind SSL* to their fd
+func attachCryptoProbes(objs *bpfObjects, path string) ([]link.Link, error) {
+	return attachUprobes(path, 0, []uprobeSpec{
+		{"BIO_new_socket", objs.UprobeLibsslBioNewSocket, objs.UretprobeLibsslBioNewSocket, false},
+	})
+}
+
+// attachGnuTLSProbes attaches to gnutls_record_send/gnutls_record_recv, whose arguments and return value
+// are the same as SSL_write/SSL_read, so the OpenSSL programs are reused
+func attachGnuTLSProbes(objs *bpfObjects, path string) ([]link.Link, error) {
+	return attachUprobes(path, 0, []uprobeSpec{
+		{"gnutls_record_send", objs.UprobeLibsslWrite, nil, false},
+		{"gnutls_record_recv", objs.UprobeLibsslRead, objs.UretprobeLibsslRead, false},
+		// gnutls_transport_set_int is a macro calling gnutls_transport_set_int2
+		{"gnutls_transport_set_int2", objs.UprobeGnutlsTransportSetInt2, nil, true},
+	})
+}
+
+// attachNSSProbes attaches to NSPR's PR_Write/PR_Read, through which NSS applications (e.g. Firefox)
+// read and write their SSL sockets. The PRFileDesc* of the SSL layer stands for the SSL*.
+func attachNSSProbes(objs *bpfObjects, path string) ([]link.Link, error) {
+	return attachUprobes(path, 0, []uprobeSpec{
+		{"PR_Write", objs.UprobeNsprWrite, nil, false},
+		{"PR_Read", objs.UprobeNsprRead, objs.UretprobeLibsslRead, false},
+	})
+}
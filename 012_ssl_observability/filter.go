@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	filterDirectionAny     = 0
+	filterDirectionEgress  = 1
+	filterDirectionIngress = 2
+
+	taskCommLen = 16
+)
+
+// filterTerm is a field compared to values with an operator, e.g. path^=/api/,/v1/
+type filterTerm struct {
+	field   string
+	op      string
+	values  []string
+	re      *regexp.Regexp // ~=
+	latency time.Duration
+}
+
+// HTTPFilter selects the traffic that's output. Its expression is made of space separated terms
+// that must all match, each a field, an operator and comma separated values of which one must match:
+//
+//	pid=1234 comm=curl,wget dir=egress host=api.example.com method=POST path^=/v1/ status=5xx latency>=100ms
+//
+// pid and comm are evaluated in BPF, so that the events of other processes don't reach user space.
+// host, method and path select the payloads and exchanges of matching requests, status and latency the exchanges.
+// dir only selects the payloads: both directions are still traced, so that requests are paired with their responses.
+type HTTPFilter struct {
+	Pids      []uint32
+	Comms     []string
+	Direction uint8 // filterDirection*, checked in user space
+	terms     []filterTerm
+}
+
+var filterOps = []string{"!=", "^=", "~=", ">=", "=", ">"} // Longest first
+
+// Operators each field accepts
+var filterFields = map[string][]string{
+	"pid":     {"="},
+	"comm":    {"="},
+	"dir":     {"="},
+	"host":    {"=", "!=", "^=", "~="},
+	"method":  {"=", "!="},
+	"path":    {"=", "!=", "^=", "~="},
+	"status":  {"=", "!="},
+	"latency": {">=", ">"},
+}
+
+// ParseHTTPFilter parses a filter expression, an empty one matching everything
+func ParseHTTPFilter(expr string) (*HTTPFilter, error) {
+	f := &HTTPFilter{}
+	for _, s := range strings.Fields(expr) {
+		t, err := parseFilterTerm(s)
+		if err != nil {
+			return nil, err
+		}
+		switch t.field {
+		case "pid":
+			for _, v := range t.values {
+				pid, err := strconv.ParseUint(v, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid pid %q", s, v)
+				}
+				f.Pids = append(f.Pids, uint32(pid))
+			}
+		case "comm":
+			for _, v := range t.values {
+				// The kernel keeps the first 15 bytes of command names
+				if len(v) >= taskCommLen {
+					v = v[:taskCommLen-1]
+				}
+				f.Comms = append(f.Comms, v)
+			}
+		case "dir":
+			if len(t.values) != 1 {
+				return nil, fmt.Errorf("%s: expected egress or ingress", s)
+			}
+			switch t.values[0] {
+			case "egress":
+				f.Direction = filterDirectionEgress
+			case "ingress":
+				f.Direction = filterDirectionIngress
+			default:
+				return nil, fmt.Errorf("%s: expected egress or ingress", s)
+			}
+		default:
+			f.terms = append(f.terms, t)
+		}
+	}
+	return f, nil
+}
+
+func parseFilterTerm(s string) (filterTerm, error) {
+	// The field is a word, followed by the operator
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') })
+	if i <= 0 {
+		return filterTerm{}, fmt.Errorf("%s: expected a field, an operator and values", s)
+	}
+	t := filterTerm{field: strings.ToLower(s[:i])}
+	ops, known := filterFields[t.field]
+	if !known {
+		return t, fmt.Errorf("%s: unknown field %q", s, s[:i])
+	}
+	for _, op := range filterOps {
+		value, ok := strings.CutPrefix(s[i:], op)
+		if !ok {
+			continue
+		}
+		t.op = op
+		if !slices.Contains(ops, op) {
+			return t, fmt.Errorf("%s: %s doesn't support %s", s, t.field, op)
+		}
+		if value == "" {
+			return t, fmt.Errorf("%s: missing value", s)
+		}
+
+		if op == "~=" {
+			// Regular expressions can contain commas
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return t, fmt.Errorf("%s: %s", s, err)
+			}
+			t.re = re
+			return t, nil
+		}
+		t.values = strings.Split(value, ",")
+		for _, v := range t.values {
+			if err := validateFilterValue(t.field, v); err != nil {
+				return t, fmt.Errorf("%s: %s", s, err)
+			}
+		}
+		if t.field == "latency" {
+			if len(t.values) != 1 {
+				return t, fmt.Errorf("%s: expected a single duration", s)
+			}
+			t.latency, _ = time.ParseDuration(t.values[0])
+		}
+		return t, nil
+	}
+	return t, fmt.Errorf("%s: unknown operator", s)
+}
+
+func validateFilterValue(field, v string) error {
+	switch field {
+	case "status":
+		// A code or a class such as 5xx
+		if len(v) == 3 && v[0] >= '1' && v[0] <= '5' && strings.ToLower(v[1:]) == "xx" {
+			return nil
+		}
+		if code, err := strconv.Atoi(v); err != nil || code < 100 || code > 999 {
+			return fmt.Errorf("invalid status %q", v)
+		}
+	case "latency":
+		_, err := time.ParseDuration(v)
+		return err
+	}
+	return nil
+}
+
+// MatchEvent tells whether the payload of an event is output, msg being the HTTP message its bytes belong to.
+// Events are matched on their request, that of a response being known once the response is paired,
+// while the status and latency of requests aren't known yet when they're output.
+func (f *HTTPFilter) MatchEvent(egress bool, msg *HTTPMessage) bool {
+	if f == nil {
+		return true
+	}
+	if (f.Direction == filterDirectionEgress && !egress) || (f.Direction == filterDirectionIngress && egress) {
+		return false
+	}
+	req := msg
+	if msg != nil && !msg.Request {
+		req = msg.Answers
+	}
+	for _, t := range f.terms {
+		switch t.field {
+		case "status":
+			if msg != nil && !msg.Request && msg.Status != 0 && !t.match(strconv.Itoa(msg.Status)) {
+				return false
+			}
+		case "latency":
+		default:
+			if req == nil || !t.match(requestField(req, t.field)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// MatchExchange tells whether an exchange is output
+func (f *HTTPFilter) MatchExchange(e *HTTPExchange) bool {
+	if f == nil {
+		return true
+	}
+	for _, t := range f.terms {
+		var ok bool
+		switch t.field {
+		case "status":
+			ok = t.match(strconv.Itoa(e.Response.Status))
+		case "latency":
+			ok = e.Latency > t.latency || (t.op == ">=" && e.Latency == t.latency)
+		default:
+			ok = t.match(requestField(e.Request, t.field))
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchHandshake tells whether a handshake is output, its host being the SNI
+func (f *HTTPFilter) MatchHandshake(h *TLSHandshake) bool {
+	if f == nil {
+		return true
+	}
+	for _, t := range f.terms {
+		if t.field == "host" && !t.match(h.ServerName) {
+			return false
+		}
+	}
+	return true
+}
+
+func requestField(req *HTTPMessage, field string) string {
+	switch field {
+	case "host":
+		// Without the port
+		host := req.Host
+		if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		return strings.Trim(host, "[]")
+	case "method":
+		return req.Method
+	case "path":
+		return req.URL
+	}
+	return ""
+}
+
+func (t *filterTerm) match(v string) bool {
+	switch t.op {
+	case "~=":
+		return t.re.MatchString(v)
+	case "!=":
+		for _, value := range t.values {
+			if t.equal(v, value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range t.values {
+		if t.op == "^=" && strings.HasPrefix(v, value) {
+			return true
+		}
+		if t.op == "=" && t.equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *filterTerm) equal(v, value string) bool {
+	switch t.field {
+	case "status":
+		if strings.HasSuffix(strings.ToLower(value), "xx") {
+			return len(v) == 3 && v[0] == value[0]
+		}
+	case "host", "method":
+		return strings.EqualFold(v, value)
+	}
+	return v == value
+}
+
+// Push writes the pid and command prefilters to the BPF maps
+func (f *HTTPFilter) Push(objs *bpfObjects) error {
+	config := bpfFilterConfig{}
+	for _, pid := range f.Pids {
+		if err := objs.FilterPidMap.Put(pid, uint8(1)); err != nil {
+			return fmt.Errorf("adding pid %d: %s", pid, err)
+		}
+		config.Pids = 1
+	}
+	for _, comm := range f.Comms {
+		var key [taskCommLen]byte
+		copy(key[:], comm)
+		if err := objs.FilterCommMap.Put(key, uint8(1)); err != nil {
+			return fmt.Errorf("adding command %s: %s", comm, err)
+		}
+		config.Comms = 1
+	}
+	return objs.FilterConfigMap.Put(uint32(0), config)
+}
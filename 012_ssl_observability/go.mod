@@ -4,6 +4,8 @@ go 1.22.4
 
 require (
 	github.com/cilium/ebpf v0.15.0
+	golang.org/x/arch v0.8.0
+	golang.org/x/net v0.26.0
 	golang.org/x/sys v0.21.0
 )
 
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+const (
+	goTLSWriteSymbol = "crypto/tls.(*Conn).Write"
+	goTLSReadSymbol  = "crypto/tls.(*Conn).Read"
+)
+
+// goFunction is a function of a Go binary, its addresses being offsets in the ELF file as expected by uprobes
+type goFunction struct {
+	Entry   uint64
+	Returns []uint64 // RET instructions
+}
+
+// goSymbol returns the address range of a function, from the symbol table or, for stripped binaries,
+// from the pclntab that Go keeps for stack traces
+func goSymbol(ef *elf.File, name string) (start, end uint64, err error) {
+	if symbols, err := ef.Symbols(); err == nil {
+		for _, s := range symbols {
+			if s.Name == name && elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+				return s.Value, s.Value + s.Size, nil
+			}
+		}
+	}
+
+	pclntab := ef.Section(".gopclntab")
+	text := ef.Section(".text")
+	if pclntab == nil || text == nil {
+		return 0, 0, fmt.Errorf("%s not found", name)
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return 0, 0, err
+	}
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return 0, 0, err
+	}
+	fn := table.LookupFunc(name)
+	if fn == nil {
+		return 0, 0, fmt.Errorf("%s not found", name)
+	}
+	return fn.Entry, fn.End, nil
+}
+
+// fileOffset converts a virtual address of the executable segment to an offset in the file
+func fileOffset(ef *elf.File, addr uint64) (uint64, error) {
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if prog.Vaddr <= addr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x not in an executable segment", addr)
+}
+
+// findGoFunction looks up a function and decodes its instructions to find where it returns
+func findGoFunction(ef *elf.File, name string) (*goFunction, error) {
+	if ef.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("unsupported architecture %s", ef.Machine)
+	}
+	start, end, err := goSymbol(ef, name)
+	if err != nil {
+		return nil, err
+	}
+
+	text := ef.Section(".text")
+	if text == nil || start < text.Addr || end > text.Addr+text.Size {
+		return nil, fmt.Errorf("%s not in .text", name)
+	}
+	code := make([]byte, end-start)
+	if _, err := text.ReadAt(code, int64(start-text.Addr)); err != nil {
+		return nil, err
+	}
+
+	entry, err := fileOffset(ef, start)
+	if err != nil {
+		return nil, err
+	}
+	fn := &goFunction{Entry: entry}
+	for i := 0; i < len(code); {
+		inst, err := x86asm.Decode(code[i:], 64)
+		// Without a reliable instruction length the following RETs would be guessed, and a probe on a
+		// byte inside an instruction corrupts the program: refuse instead. Unknown encodings come back
+		// as bare prefixes (Op 0), and some VEX ones are misdecoded without an error.
+		if err != nil || inst.Op == 0 || hasVEXPrefix(inst) {
+			return nil, fmt.Errorf("can't disassemble %s at +0x%x", name, i)
+		}
+		if inst.Op == x86asm.RET {
+			fn.Returns = append(fn.Returns, entry+uint64(i))
+		}
+		i += inst.Len
+	}
+	if len(fn.Returns) == 0 {
+		return nil, fmt.Errorf("no RET instruction in %s", name)
+	}
+	return fn, nil
+}
+
+func hasVEXPrefix(inst x86asm.Inst) bool {
+	for _, p := range inst.Prefix {
+		if p == 0 {
+			break
+		}
+		if p.IsVEX() {
+			return true
+		}
+	}
+	return false
+}
+
+type goProbe struct {
+	symbol  string
+	address uint64 // File offset
+	prog    *ebpf.Program
+}
+
+// attachGoTLSProbes attaches to the crypto/tls (*Conn).Write and (*Conn).Read functions of a Go binary.
+// Read results are captured at each RET instruction, as uretprobes crash Go programs when their stack moves.
+func attachGoTLSProbes(objs *bpfObjects, path string) ([]link.Link, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+
+	write, err := findGoFunction(ef, goTLSWriteSymbol)
+	if err != nil {
+		return nil, err
+	}
+	read, err := findGoFunction(ef, goTLSReadSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening executable: %s", err)
+	}
+
+	probes := []goProbe{
+		{goTLSWriteSymbol, write.Entry, objs.UprobeGoTlsWrite},
+		{goTLSReadSymbol, read.Entry, objs.UprobeGoTlsRead},
+	}
+	for _, ret := range read.Returns {
+		probes = append(probes, goProbe{goTLSReadSymbol, ret, objs.UprobeGoTlsReadRet})
+	}
+
+	links := []link.Link{}
+	for _, probe := range probes {
+		l, err := ex.Uprobe(probe.symbol, probe.prog, &link.UprobeOptions{Address: probe.address})
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("creating uprobe - %s at 0x%x: %s", probe.symbol, probe.address, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+// TLS 1.2: https://www.rfc-editor.org/rfc/rfc5246
+// TLS 1.3: https://www.rfc-editor.org/rfc/rfc8446
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	handshakeEventData = 0
+	handshakeEventDone = 1
+
+	// Handshakes not over after this long are forgotten
+	tlsHandshakeTimeout = 30 * time.Second
+)
+
+const (
+	tlsRecordHeaderSize    = 5
+	tlsHandshakeHeaderSize = 4
+
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsClientHello = 1
+	tlsCertificate = 11
+
+	tlsAlertFatal = 2
+)
+
+var tlsAlerts = map[uint8]string{
+	10: "unexpected_message", 20: "bad_record_mac", 40: "handshake_failure", 42: "bad_certificate",
+	43: "unsupported_certificate", 44: "certificate_revoked", 45: "certificate_expired", 46: "certificate_unknown",
+	47: "illegal_parameter", 48: "unknown_ca", 50: "decode_error", 51: "decrypt_error", 70: "protocol_version",
+	71: "insufficient_security", 80: "internal_error", 86: "inappropriate_fallback", 109: "missing_extension",
+	110: "unsupported_extension", 112: "unrecognized_name", 116: "certificate_required", 120: "no_application_protocol",
+}
+
+// TLSHandshake is what an SSL* negotiated, as its getters return it once the handshake is over
+type TLSHandshake struct {
+	Pid             uint32
+	Tid             uint32 // Thread that completed the handshake
+	SSL             uint64
+	Socket          SocketInfo
+	Client          bool   // Whether the traced process sent the ClientHello
+	ServerName      string // SNI
+	ALPN            string // Protocol selected by the server
+	Version         uint16
+	CipherSuite     uint16
+	PeerCertificate *x509.Certificate // First certificate received, read from the socket, encrypted since TLS 1.3
+	Alert           string            // Fatal alert that ended the handshake
+	Ret             int32             // Return value of SSL_do_handshake, or 1 once the first SSL_read or SSL_write moved data
+	// Whether the handshake messages went through the socket while traced, which they don't for connections
+	// established before the tracer started, nor for libraries that don't do the socket I/O themselves: their
+	// duration is unknown
+	Observed bool
+	Start    uint64
+	End      uint64
+}
+
+// Weaknesses lists what's unsafe in the negotiated parameters: deprecated protocol versions,
+// ciphers known to be broken and expired certificates
+func (h *TLSHandshake) Weaknesses() []string {
+	var weak []string
+	if h.Version != 0 && h.Version < tls.VersionTLS12 {
+		weak = append(weak, tls.VersionName(h.Version))
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		if c.ID == h.CipherSuite {
+			weak = append(weak, "insecure cipher")
+		}
+	}
+	if h.PeerCertificate != nil && time.Now().After(h.PeerCertificate.NotAfter) {
+		weak = append(weak, "expired certificate")
+	}
+	return weak
+}
+
+func (h *TLSHandshake) String() string {
+	side := "server"
+	if h.Client {
+		side = "client"
+	}
+	s := fmt.Sprintf("pid: %d tid: %d ssl: 0x%x %s %s", h.Pid, h.Tid, h.SSL, h.Socket, side)
+	if h.ServerName != "" {
+		s += fmt.Sprintf(" sni: %s", h.ServerName)
+	}
+	if h.Version != 0 {
+		s += fmt.Sprintf(" version: %s", tls.VersionName(h.Version))
+	}
+	if h.CipherSuite != 0 {
+		s += fmt.Sprintf(" cipher: %s", tls.CipherSuiteName(h.CipherSuite))
+	}
+	if h.ALPN != "" {
+		s += fmt.Sprintf(" alpn: %s", h.ALPN)
+	}
+	if c := h.PeerCertificate; c != nil {
+		s += fmt.Sprintf(" peer: %s expires: %s", c.Subject, c.NotAfter.Format(time.DateOnly))
+	} else if h.Version == tls.VersionTLS13 {
+		s += " peer: encrypted (TLS 1.3)"
+	}
+	if h.Observed {
+		s += fmt.Sprintf(" duration: %s", time.Duration(h.End-h.Start))
+	} else {
+		s += " handshake not seen"
+	}
+	if h.Alert != "" {
+		s += fmt.Sprintf(" failed: %s", h.Alert)
+	} else if h.Ret != 1 {
+		s += fmt.Sprintf(" failed: ret %d", h.Ret)
+	}
+	if weak := h.Weaknesses(); len(weak) > 0 {
+		s += fmt.Sprintf(" WEAK: %s", strings.Join(weak, ", "))
+	}
+	return s
+}
+
+// tlsRecordStream splits the records sent by one peer, and reassembles the handshake messages
+// they carry until the peer starts encrypting
+type tlsRecordStream struct {
+	header     []byte // Record header being received
+	inRecord   bool
+	recordType uint8
+	remaining  int // Bytes left in the current record
+	body       []byte
+	partial    bool   // Part of the record wasn't copied
+	messages   []byte // Handshake messages, which can span records
+	done       bool   // Encrypted from here on, or out of sync
+}
+
+// Feed splits the bytes of a socket read or write into records, lost being the number of bytes that followed
+// data but weren't copied
+func (s *tlsRecordStream) Feed(data []byte, lost uint64, onRecord func(recordType uint8, body []byte, partial bool)) {
+	for len(data) > 0 && !s.done {
+		if !s.inRecord {
+			n := min(tlsRecordHeaderSize-len(s.header), len(data))
+			s.header = append(s.header, data[:n]...)
+			data = data[n:]
+			if len(s.header) < tlsRecordHeaderSize {
+				break
+			}
+			s.recordType = s.header[0]
+			s.remaining = int(binary.BigEndian.Uint16(s.header[3:5]))
+			s.header = s.header[:0]
+			if s.recordType < tlsRecordChangeCipherSpec || s.recordType > tlsRecordApplicationData {
+				// Not TLS
+				s.done = true
+				break
+			}
+			s.inRecord = true
+			s.body = s.body[:0]
+			s.partial = false
+		}
+
+		n := min(len(data), s.remaining)
+		s.body = append(s.body, data[:n]...)
+		s.remaining -= n
+		data = data[n:]
+		if s.remaining == 0 {
+			s.inRecord = false
+			onRecord(s.recordType, s.body, s.partial)
+		}
+	}
+
+	if lost > 0 && !s.done {
+		if !s.inRecord {
+			// A record header wasn't copied
+			s.done = true
+			return
+		}
+		s.partial = true
+		if lost < uint64(s.remaining) {
+			s.remaining -= int(lost)
+			return
+		}
+		// The bytes past the end of the record include the header of the next one
+		nextLost := lost > uint64(s.remaining)
+		s.inRecord = false
+		onRecord(s.recordType, s.body, s.partial)
+		s.done = s.done || nextLost
+	}
+}
+
+type tlsHandshakeConn struct {
+	streams      [2]*tlsRecordStream // Indexed by egress
+	handshake    *TLSHandshake
+	lastActivity uint64
+}
+
+// record handles a record sent in the egress direction
+func (c *tlsHandshakeConn) record(egress bool, s *tlsRecordStream, recordType uint8, body []byte, partial bool) {
+	switch recordType {
+	case tlsRecordHandshake:
+		s.messages = append(s.messages, body...)
+		for len(s.messages) >= tlsHandshakeHeaderSize {
+			size := int(s.messages[1])<<16 | int(s.messages[2])<<8 | int(s.messages[3])
+			if len(s.messages) < tlsHandshakeHeaderSize+size {
+				if partial {
+					// The rest of the message wasn't copied, what there is of it is parsed but the next ones can't be found
+					c.message(egress, s.messages[0], s.messages[tlsHandshakeHeaderSize:])
+					s.done = true
+				}
+				break
+			}
+			c.message(egress, s.messages[0], s.messages[tlsHandshakeHeaderSize:tlsHandshakeHeaderSize+size])
+			s.messages = s.messages[tlsHandshakeHeaderSize+size:]
+		}
+	case tlsRecordAlert:
+		if len(body) >= 2 && body[0] == tlsAlertFatal {
+			c.handshake.Alert = tlsAlerts[body[1]]
+			if c.handshake.Alert == "" {
+				c.handshake.Alert = fmt.Sprintf("alert %d", body[1])
+			}
+		}
+	default:
+		// Whatever follows ChangeCipherSpec or the first application data record (TLS 1.3) is encrypted
+		s.done = true
+	}
+}
+
+// message parses a handshake message sent in the egress direction, which may be truncated. What was negotiated
+// is read from the SSL*, only the certificate of the peer, which it doesn't keep in the encoding it was received in,
+// is taken from the messages.
+func (c *tlsHandshakeConn) message(egress bool, msgType uint8, body []byte) {
+	h := c.handshake
+	r := &tlsReader{b: body, ok: true}
+
+	switch msgType {
+	case tlsClientHello:
+		h.Observed = true
+		// For libraries whose layout isn't known
+		h.Client = egress
+
+	case tlsCertificate:
+		if egress || h.PeerCertificate != nil {
+			return
+		}
+		// certificate_list, the end entity certificate coming first
+		r.uint24()
+		if cert, err := x509.ParseCertificate(r.vector24()); err == nil {
+			h.PeerCertificate = cert
+		}
+	}
+}
+
+// HandshakeTracker follows the handshake of each SSL*, reporting what was negotiated once it's over
+type HandshakeTracker struct {
+	conns     map[httpConnKey]*tlsHandshakeConn
+	lastSweep uint64
+}
+
+func NewHandshakeTracker() *HandshakeTracker {
+	return &HandshakeTracker{
+		conns: make(map[httpConnKey]*tlsHandshakeConn),
+	}
+}
+
+// Observe feeds a handshake event, returning the handshake once SSL_do_handshake, or the first SSL_read or SSL_write
+// of the SSL*, succeeded or failed
+func (t *HandshakeTracker) Observe(e *bpfSslHandshakeEventT) *TLSHandshake {
+	t.sweep(e.TimestampNs)
+
+	k := httpConnKey{Pid: e.Pid, SSL: e.Ssl}
+	c, ok := t.conns[k]
+	if !ok {
+		c = &tlsHandshakeConn{
+			streams:   [2]*tlsRecordStream{{}, {}},
+			handshake: &TLSHandshake{Pid: e.Pid, SSL: e.Ssl, Start: e.StartNs},
+		}
+		t.conns[k] = c
+	}
+	c.lastActivity = e.TimestampNs
+
+	if e.Type == handshakeEventData {
+		egress := e.Egress != 0
+		s := c.streams[0]
+		if egress {
+			s = c.streams[1]
+		}
+		s.Feed(e.Buf[:e.Len], uint64(e.Ret)-uint64(e.Len), func(recordType uint8, body []byte, partial bool) {
+			c.record(egress, s, recordType, body, partial)
+		})
+		return nil
+	}
+
+	h := c.handshake
+	// Non-blocking sockets make SSL_do_handshake return -1 until the peer's messages arrived
+	if e.Ret < 0 && h.Alert == "" {
+		return nil
+	}
+	delete(t.conns, k)
+	// Handshakes that weren't seen are only reported once the connection moves data
+	if !h.Observed && e.Ret != 1 {
+		return nil
+	}
+	h.Version = e.Version
+	h.CipherSuite = e.Cipher
+	h.ServerName = unix.ByteSliceToString(e.ServerName[:])
+	h.ALPN = string(e.Alpn[:min(int(e.AlpnLen), len(e.Alpn))])
+	if e.Server >= 0 {
+		h.Client = e.Server == 0
+	}
+	h.Tid = e.Tid
+	h.Ret = e.Ret
+	h.End = e.TimestampNs
+	h.Socket = socketInfo(e.Fd, e.Family, e.Lport, e.Rport, e.Laddr, e.Raddr)
+	return h
+}
+
+// sweep forgets the handshakes that never ended
+func (t *HandshakeTracker) sweep(now uint64) {
+	if now-t.lastSweep < uint64(httpSweepInterval) {
+		return
+	}
+	t.lastSweep = now
+
+	for k, c := range t.conns {
+		if now-c.lastActivity >= uint64(tlsHandshakeTimeout) {
+			delete(t.conns, k)
+		}
+	}
+}
+
+// tlsReader reads the fields of a handshake message, ok turning false when one goes past its end
+type tlsReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) uint24() int {
+	if b := r.bytes(3); b != nil {
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return 0
+}
+
+func (r *tlsReader) vector24() []byte {
+	return r.bytes(r.uint24())
+}
+
+// attachHandshakeTracepoints attaches to the socket syscalls, whose data is only copied for threads in SSL_do_handshake
+func attachHandshakeTracepoints(objs *bpfObjects) ([]link.Link, error) {
+	tracepoints := []struct {
+		name string
+		prog *ebpf.Program
+	}{
+		{"sys_enter_write", objs.TracepointSysEnterWrite},
+		{"sys_exit_write", objs.TracepointSysExitWrite},
+		{"sys_enter_sendto", objs.TracepointSysEnterSendto},
+		{"sys_exit_sendto", objs.TracepointSysExitSendto},
+		{"sys_enter_read", objs.TracepointSysEnterRead},
+		{"sys_exit_read", objs.TracepointSysExitRead},
+		{"sys_enter_recvfrom", objs.TracepointSysEnterRecvfrom},
+		{"sys_exit_recvfrom", objs.TracepointSysExitRecvfrom},
+	}
+
+	links := []link.Link{}
+	for _, tp := range tracepoints {
+		l, err := link.Tracepoint("syscalls", tp.name, tp.prog, nil)
+		if err != nil {
+			closeLinks(links)
+			return nil, fmt.Errorf("attaching tracepoint %s: %s", tp.name, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
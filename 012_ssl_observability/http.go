@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Connections without activity for this long are forgotten, their pending messages being reported as incomplete
+	httpIdleTimeout = 30 * time.Second
+	// How often idle connections are looked for, in event time
+	httpSweepInterval = time.Second
+)
+
+var httpMethods = map[string]bool{
+	"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true,
+	"HEAD": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+}
+
+// HTTPExchange is an HTTP request paired with its response on the same SSL connection
+type HTTPExchange struct {
+	Pid      uint32
+	SSL      uint64
+	Socket   SocketInfo
+	StreamID uint32 // HTTP/2 only
+	Request  *HTTPMessage
+	Response *HTTPMessage
+	Latency  time.Duration // From the first request byte to the last response byte
+}
+
+func (e *HTTPExchange) String() string {
+	s := fmt.Sprintf("%s %s%s -> %d", e.Request.Method, e.Request.Host, e.Request.URL, e.Response.Status)
+	if e.StreamID != 0 {
+		s += fmt.Sprintf(" stream: %d", e.StreamID)
+	}
+	if service, method, ok := e.GRPCMethod(); ok {
+		s += fmt.Sprintf(" grpc: %s/%s grpc-status: %s", service, method, e.Response.Headers.Get("Grpc-Status"))
+	}
+	s += fmt.Sprintf(" pid: %d tid: %d ssl: 0x%x %s request: %dB response: %dB latency: %s",
+		e.Pid, e.Request.Tid, e.SSL, e.Socket, e.Request.Size, e.Response.Size, e.Latency)
+	if !e.Response.Complete {
+		s += " (incomplete)"
+	}
+	return s
+}
+
+// GRPCMethod returns the service and method of a gRPC call, whose path is /<package>.<service>/<method>
+func (e *HTTPExchange) GRPCMethod() (service, method string, ok bool) {
+	if !strings.HasPrefix(e.Request.Headers.Get("Content-Type"), "application/grpc") {
+		return "", "", false
+	}
+	return strings.Cut(strings.TrimPrefix(e.Request.URL, "/"), "/")
+}
+
+type httpConnKey struct {
+	Pid uint32
+	SSL uint64
+}
+
+type httpConn struct {
+	streams      [2]*httpStream // Indexed by egress
+	http2        *http2Conn     // Set once the HTTP/2 preface is seen
+	socket       SocketInfo
+	requests     []*HTTPMessage                // Requests whose response didn't start yet, in order
+	responses    map[*HTTPMessage]*HTTPMessage // Request of each response being received
+	lastActivity uint64
+}
+
+func newHTTPConn() *httpConn {
+	c := &httpConn{
+		responses: make(map[*HTTPMessage]*HTTPMessage),
+	}
+	for i := range c.streams {
+		c.streams[i] = &httpStream{egress: i == 1, onHeaders: c.onHeaders}
+	}
+	return c
+}
+
+// onHeaders pairs a response with the oldest request waiting for one, as pipelined requests are answered in order
+func (c *httpConn) onHeaders(m *HTTPMessage) bool {
+	if m.Request {
+		c.requests = append(c.requests, m)
+		return false
+	}
+	// Interim responses (e.g. 100 Continue) are followed by the final one
+	if m.Status < 200 && m.Status != 101 {
+		return true
+	}
+	if len(c.requests) == 0 {
+		return false
+	}
+	req := c.requests[0]
+	c.requests = c.requests[1:]
+	c.responses[m] = req
+	m.Answers = req
+
+	// Past a protocol switch or an established tunnel, the connection doesn't carry HTTP/1.x anymore
+	if m.Status == 101 || (req.Method == "CONNECT" && m.Status < 300) {
+		for _, s := range c.streams {
+			s.upgraded = true
+		}
+		return true
+	}
+	return req.Method == "HEAD"
+}
+
+// http2Exchanges turns ended HTTP/2 streams into exchanges
+func (c *httpConn) http2Exchanges(k httpConnKey, ended []*http2Stream) []*HTTPExchange {
+	var exchanges []*HTTPExchange
+	for _, s := range ended {
+		exchanges = append(exchanges, &HTTPExchange{
+			Pid:      k.Pid,
+			SSL:      k.SSL,
+			Socket:   c.socket,
+			StreamID: s.id,
+			Request:  s.request,
+			Response: s.response,
+			Latency:  time.Duration(max(s.request.End, s.response.End) - s.request.Start),
+		})
+	}
+	return exchanges
+}
+
+// exchanges pairs the completed responses with their request
+func (c *httpConn) exchanges(k httpConnKey, completed []*HTTPMessage) []*HTTPExchange {
+	var exchanges []*HTTPExchange
+	for _, m := range completed {
+		req, ok := c.responses[m]
+		if !ok {
+			continue
+		}
+		delete(c.responses, m)
+		exchanges = append(exchanges, &HTTPExchange{
+			Pid:      k.Pid,
+			SSL:      k.SSL,
+			Socket:   c.socket,
+			Request:  req,
+			Response: m,
+			Latency:  time.Duration(m.End - req.Start),
+		})
+	}
+	return exchanges
+}
+
+// HTTPTracker reassembles the HTTP/1.x messages flowing through each SSL* and pairs requests with their responses.
+// Requests are written and responses read when the traced process is the client, the other way around for a server.
+type HTTPTracker struct {
+	conns     map[httpConnKey]*httpConn
+	lastSweep uint64
+}
+
+func NewHTTPTracker() *HTTPTracker {
+	return &HTTPTracker{
+		conns: make(map[httpConnKey]*httpConn),
+	}
+}
+
+// Observe feeds an SSL data event, returning the message its bytes belong to (nil if none) and the exchanges it completed
+func (t *HTTPTracker) Observe(event *bpfSslDataEventT) (*HTTPMessage, []*HTTPExchange) {
+	exchanges := t.sweep(event.TimestampNs)
+	if event.Ret <= 0 {
+		return nil, exchanges
+	}
+
+	k := httpConnKey{Pid: event.Pid, SSL: event.Ssl}
+	c, ok := t.conns[k]
+	if !ok {
+		c = newHTTPConn()
+		t.conns[k] = c
+	}
+	c.lastActivity = event.TimestampNs
+	c.socket = NewSocketInfo(event)
+
+	egress := event.Egress != 0
+	data := event.Buf[:event.Len]
+	lost := uint64(event.Ret) - uint64(event.Len)
+
+	// HTTP/2 connections start with the client preface, the HTTP/1.x parsers are left aside
+	if c.http2 == nil && bytes.HasPrefix(data, []byte(http2Preface)) {
+		c.http2 = newHTTP2Conn(egress)
+		data = data[len(http2Preface):]
+	}
+	if c.http2 != nil {
+		msg, ended := c.http2.Feed(egress, data, lost, event.Tid, event.TimestampNs)
+		return msg, append(exchanges, c.http2Exchanges(k, ended)...)
+	}
+
+	stream := c.streams[0]
+	if egress {
+		stream = c.streams[1]
+	}
+	msg, completed := stream.Feed(data, lost, event.Tid, event.TimestampNs)
+	return msg, append(exchanges, c.exchanges(k, completed)...)
+}
+
+// sweep forgets idle connections, reporting the responses they were receiving
+func (t *HTTPTracker) sweep(now uint64) []*HTTPExchange {
+	if now-t.lastSweep < uint64(httpSweepInterval) {
+		return nil
+	}
+	t.lastSweep = now
+
+	var exchanges []*HTTPExchange
+	for k, c := range t.conns {
+		if now-c.lastActivity < uint64(httpIdleTimeout) {
+			continue
+		}
+		var completed []*HTTPMessage
+		for _, s := range c.streams {
+			if m := s.Flush(); m != nil {
+				completed = append(completed, m)
+			}
+		}
+		exchanges = append(exchanges, c.exchanges(k, completed)...)
+		if c.http2 != nil {
+			exchanges = append(exchanges, c.http2Exchanges(k, c.http2.Flush())...)
+		}
+		delete(t.conns, k)
+	}
+	return exchanges
+}
@@ -0,0 +1,373 @@
+package main
+
+// HTTP/2: https://www.rfc-editor.org/rfc/rfc9113
+// HPACK: https://www.rfc-editor.org/rfc/rfc7541
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// Sent by clients before their first frame
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	http2FrameHeaderSize = 9
+
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+
+	http2SettingHeaderTableSize = 0x1
+
+	// Initial size of the HPACK dynamic table
+	http2DefaultHeaderTableSize = 4096
+)
+
+// http2Stream is a request and its response, multiplexed with others on the connection
+type http2Stream struct {
+	id           uint32
+	request      *HTTPMessage
+	response     *HTTPMessage
+	requestDone  bool
+	responseDone bool
+}
+
+// http2Direction splits the frames sent by one peer of the connection
+type http2Direction struct {
+	client  bool
+	decoder *hpack.Decoder
+
+	header    []byte // Frame header being received
+	inFrame   bool
+	frameType uint8
+	flags     uint8
+	streamID  uint32
+	remaining uint32 // Payload bytes left in the current frame
+	keep      bool   // Whether the payload of the current frame is needed
+	payload   []byte
+	partial   bool // Part of the payload wasn't copied
+
+	block          []byte // Header block fragments, until END_HEADERS
+	blockEndStream bool
+	blockPartial   bool
+	blockPromised  uint32 // Stream promised by a PUSH_PROMISE, whose request the block is
+
+	hpackBroken bool // A header block was lost, so the dynamic table can't be trusted anymore
+	lost        bool // Frame boundaries were lost, nothing more can be parsed
+}
+
+// http2Conn decodes the frames of an HTTP/2 connection, each peer having its own HPACK state
+type http2Conn struct {
+	dirs    [2]*http2Direction // Indexed by egress
+	streams map[uint32]*http2Stream
+}
+
+// newHTTP2Conn starts decoding a connection whose preface was sent in the clientEgress direction
+func newHTTP2Conn(clientEgress bool) *http2Conn {
+	c := &http2Conn{
+		streams: make(map[uint32]*http2Stream),
+	}
+	for i := range c.dirs {
+		c.dirs[i] = &http2Direction{
+			client:  (i == 1) == clientEgress,
+			decoder: hpack.NewDecoder(http2DefaultHeaderTableSize, nil),
+		}
+	}
+	return c
+}
+
+// Feed splits the bytes of an SSL read or write into frames, lost being the number of bytes that followed
+// data but weren't copied. It returns the message of the last stream the bytes belong to and the streams they ended.
+func (c *http2Conn) Feed(egress bool, data []byte, lost uint64, tid uint32, ts uint64) (*HTTPMessage, []*http2Stream) {
+	d := c.dirs[0]
+	if egress {
+		d = c.dirs[1]
+	}
+	var current *HTTPMessage
+	var ended []*http2Stream
+
+	for len(data) > 0 && !d.lost {
+		if !d.inFrame {
+			n := min(http2FrameHeaderSize-len(d.header), len(data))
+			d.header = append(d.header, data[:n]...)
+			data = data[n:]
+			if len(d.header) < http2FrameHeaderSize {
+				break
+			}
+			d.startFrame()
+			if m := c.startFrame(d, ts, &ended); m != nil {
+				current = m
+			}
+			if d.remaining == 0 {
+				if m := c.endFrame(d, tid, ts, &ended); m != nil {
+					current = m
+				}
+			}
+			continue
+		}
+
+		n := min(uint32(len(data)), d.remaining)
+		if d.keep {
+			d.payload = append(d.payload, data[:n]...)
+		} else if s := c.streams[d.streamID]; s != nil {
+			current = s.message(d.client)
+		}
+		d.remaining -= n
+		data = data[n:]
+		if d.remaining == 0 {
+			if m := c.endFrame(d, tid, ts, &ended); m != nil {
+				current = m
+			}
+		}
+	}
+
+	if lost > 0 && !d.lost {
+		if !d.inFrame || lost > uint64(d.remaining) {
+			// A frame header wasn't copied
+			d.lost = true
+		} else {
+			d.partial = true
+			d.remaining -= uint32(lost)
+			if d.remaining == 0 {
+				if m := c.endFrame(d, tid, ts, &ended); m != nil {
+					current = m
+				}
+			}
+		}
+	}
+	return current, ended
+}
+
+func (d *http2Direction) startFrame() {
+	h := d.header
+	d.remaining = uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+	d.frameType = h[3]
+	d.flags = h[4]
+	d.streamID = binary.BigEndian.Uint32(h[5:9]) & 0x7fffffff
+	d.header = d.header[:0]
+	d.inFrame = true
+	d.payload = d.payload[:0]
+	d.partial = false
+	switch d.frameType {
+	case http2FrameHeaders, http2FrameContinuation, http2FrameSettings, http2FramePushPromise:
+		d.keep = true
+	default:
+		d.keep = false
+	}
+}
+
+// startFrame handles the frames whose payload isn't needed as soon as their header is received
+func (c *http2Conn) startFrame(d *http2Direction, ts uint64, ended *[]*http2Stream) *HTTPMessage {
+	switch d.frameType {
+	case http2FrameData:
+		s := c.streams[d.streamID]
+		if s == nil {
+			return nil
+		}
+		m := s.message(d.client)
+		m.BodySize += uint64(d.remaining)
+		m.Size += http2FrameHeaderSize + uint64(d.remaining)
+		m.End = ts
+		if d.flags&http2FlagEndStream != 0 {
+			c.endStream(s, d.client, ended)
+		}
+		return m
+	case http2FrameRSTStream:
+		s := c.streams[d.streamID]
+		if s == nil {
+			return nil
+		}
+		s.response.End = ts
+		delete(c.streams, s.id)
+		*ended = append(*ended, s)
+		return s.response
+	}
+	return nil
+}
+
+// endFrame handles the frames whose payload is needed, once it's received
+func (c *http2Conn) endFrame(d *http2Direction, tid uint32, ts uint64, ended *[]*http2Stream) *HTTPMessage {
+	d.inFrame = false
+	payload := d.payload
+
+	switch d.frameType {
+	case http2FrameHeaders:
+		if !d.partial {
+			// Strip the padding and priority fields
+			padding := 0
+			if d.flags&http2FlagPadded != 0 && len(payload) > 0 {
+				padding = int(payload[0])
+				payload = payload[1:]
+			}
+			if d.flags&http2FlagPriority != 0 && len(payload) >= 5 {
+				payload = payload[5:]
+			}
+			if padding <= len(payload) {
+				payload = payload[:len(payload)-padding]
+			}
+		}
+		d.block = append(d.block[:0], payload...)
+		d.blockEndStream = d.flags&http2FlagEndStream != 0
+		d.blockPartial = d.partial
+		d.blockPromised = 0
+		if d.flags&http2FlagEndHeaders != 0 {
+			return c.headers(d, tid, ts, ended)
+		}
+
+	case http2FramePushPromise:
+		// The header block follows the pad length and the promised stream ID, and must be decoded
+		// like any other for the dynamic table to stay in sync
+		padding := 0
+		if d.flags&http2FlagPadded != 0 && len(payload) > 0 {
+			padding = int(payload[0])
+			payload = payload[1:]
+		}
+		if len(payload) < 4 {
+			d.hpackBroken = true
+			return nil
+		}
+		promised := binary.BigEndian.Uint32(payload[:4]) & 0x7fffffff
+		payload = payload[4:]
+		if !d.partial && padding <= len(payload) {
+			payload = payload[:len(payload)-padding]
+		}
+		d.block = append(d.block[:0], payload...)
+		d.blockEndStream = false
+		d.blockPartial = d.partial
+		d.blockPromised = promised
+		if d.flags&http2FlagEndHeaders != 0 {
+			return c.headers(d, tid, ts, ended)
+		}
+
+	case http2FrameContinuation:
+		d.block = append(d.block, payload...)
+		d.blockPartial = d.blockPartial || d.partial
+		if d.flags&http2FlagEndHeaders != 0 {
+			return c.headers(d, tid, ts, ended)
+		}
+
+	case http2FrameSettings:
+		if d.flags&http2FlagAck != 0 || d.partial {
+			return nil
+		}
+		// The peer receiving the settings encodes its headers within the announced table size
+		for i := 0; i+6 <= len(payload); i += 6 {
+			if binary.BigEndian.Uint16(payload[i:i+2]) == http2SettingHeaderTableSize {
+				c.peer(d).decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[i+2 : i+6]))
+			}
+		}
+	}
+	return nil
+}
+
+// headers decodes a complete header block, the first of a stream being its request or response headers and the next ones trailers.
+// The block of a PUSH_PROMISE is the request of the promised stream, which the server sends in place of the client.
+func (c *http2Conn) headers(d *http2Direction, tid uint32, ts uint64, ended *[]*http2Stream) *HTTPMessage {
+	id, client := d.streamID, d.client
+	if d.blockPromised != 0 {
+		id, client = d.blockPromised, true
+	}
+	s, ok := c.streams[id]
+	if !ok {
+		clientEgress := c.dirs[1].client
+		s = &http2Stream{
+			id:       id,
+			request:  &HTTPMessage{Request: true, Egress: clientEgress, Proto: "HTTP/2.0", Headers: http.Header{}, Tid: tid, Start: ts, End: ts},
+			response: &HTTPMessage{Egress: !clientEgress, Proto: "HTTP/2.0", Headers: http.Header{}, Tid: tid, Start: ts, End: ts},
+		}
+		s.response.Answers = s.request
+		c.streams[id] = s
+	}
+	m := s.message(client)
+	if m.HeaderSize == 0 {
+		m.Tid = tid
+		m.Start = ts
+	}
+	m.HeaderSize += uint64(len(d.block))
+	m.Size += http2FrameHeaderSize + uint64(len(d.block))
+	m.End = ts
+
+	if d.blockPartial {
+		d.hpackBroken = true
+	}
+	if d.hpackBroken {
+		m.Truncated = true
+	} else if fields, err := d.decoder.DecodeFull(d.block); err != nil {
+		d.hpackBroken = true
+		m.Truncated = true
+	} else {
+		for _, f := range fields {
+			switch f.Name {
+			case ":method":
+				m.Method = f.Value
+			case ":path":
+				m.URL = f.Value
+			case ":authority":
+				m.Host = f.Value
+			case ":status":
+				m.Status, _ = strconv.Atoi(f.Value)
+			case ":scheme", ":protocol":
+			default:
+				m.Headers.Add(f.Name, f.Value)
+			}
+		}
+	}
+
+	// A promised request has no body
+	if d.blockEndStream || d.blockPromised != 0 {
+		c.endStream(s, client, ended)
+	}
+	return m
+}
+
+// endStream marks one side of the stream as done, the stream ends when both are
+func (c *http2Conn) endStream(s *http2Stream, client bool, ended *[]*http2Stream) {
+	if client {
+		s.requestDone = true
+		s.request.Complete = true
+	} else {
+		s.responseDone = true
+		s.response.Complete = true
+	}
+	if s.requestDone && s.responseDone {
+		delete(c.streams, s.id)
+		*ended = append(*ended, s)
+	}
+}
+
+// Flush ends the streams still open, when the connection is closed or idle
+func (c *http2Conn) Flush() []*http2Stream {
+	var ended []*http2Stream
+	for id, s := range c.streams {
+		delete(c.streams, id)
+		ended = append(ended, s)
+	}
+	return ended
+}
+
+func (c *http2Conn) peer(d *http2Direction) *http2Direction {
+	if c.dirs[0] == d {
+		return c.dirs[1]
+	}
+	return c.dirs[0]
+}
+
+func (s *http2Stream) message(client bool) *HTTPMessage {
+	if client {
+		return s.request
+	}
+	return s.response
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Longest header block or chunk line kept while waiting for its end
+const maxHTTPHeaderSize = 64 * 1024
+
+// HTTPMessage is an HTTP/1.x request or response reassembled from the SSL reads or writes of a connection
+type HTTPMessage struct {
+	Request    bool
+	Egress     bool   // Written by the traced process, i.e. a request of a client or a response of a server
+	Method     string // Requests only
+	URL        string // Requests only, as sent in the request line
+	Host       string // Requests only
+	Proto      string
+	Status     int          // Responses only
+	Answers    *HTTPMessage // Responses only, the request they answer once paired
+	Headers    http.Header
+	HeaderSize uint64
+	BodySize   uint64 // Body without the chunked encoding framing
+	Size       uint64 // Bytes on the wire
+	Chunked    bool
+	Tid        uint32 // Thread of the first event
+	Start      uint64 // Timestamps of the first and last event
+	End        uint64
+	Truncated  bool // Headers didn't fit in the copied buffers, so some may be missing
+	Complete   bool // Whether the end of the message was found
+}
+
+func (m *HTTPMessage) String() string {
+	var s string
+	if m.Proto == "" {
+		return fmt.Sprintf("waiting for headers (%dB)", m.Size)
+	}
+	if m.Request {
+		s = fmt.Sprintf("%s %s%s %s", m.Method, m.Host, m.URL, m.Proto)
+	} else {
+		s = fmt.Sprintf("%s %d", m.Proto, m.Status)
+	}
+	s += fmt.Sprintf(" headers: %d body: %dB", len(m.Headers), m.BodySize)
+	if m.Chunked {
+		s += " chunked"
+	}
+	if m.Truncated {
+		s += " (truncated headers)"
+	}
+	return s
+}
+
+type httpParseState int
+
+const (
+	httpStateStart     httpParseState = iota // Between messages
+	httpStateHeaders                         // Start line and headers
+	httpStateBody                            // Content-Length body
+	httpStateChunkSize                       // Chunk size line
+	httpStateChunkData                       // Chunk data
+	httpStateChunkEnd                        // CRLF after the chunk data
+	httpStateTrailers                        // Trailer lines after the last chunk
+	httpStateUntilNext                       // Body ending with the connection, or data after a loss of sync
+)
+
+// httpStream reassembles the HTTP/1.x messages flowing in one direction of a connection.
+// Keep-alive connections carry one message after the other, pipelined ones as well.
+type httpStream struct {
+	state     httpParseState
+	msg       *HTTPMessage
+	line      []byte // Pending header block, chunk size or trailer line
+	remaining uint64 // Body or chunk bytes left
+	upgraded  bool   // Not HTTP/1.x anymore after a protocol switch or CONNECT
+	egress    bool
+	// Called once the headers of a message are parsed, returns whether a response has no body (e.g. to a HEAD request)
+	onHeaders func(m *HTTPMessage) bool
+}
+
+// Feed parses the bytes of an SSL read or write, lost being the number of bytes that followed
+// data but weren't copied. It returns the message the bytes belong to and the messages they completed.
+func (s *httpStream) Feed(data []byte, lost uint64, tid uint32, ts uint64) (*HTTPMessage, []*HTTPMessage) {
+	if s.upgraded {
+		return nil, nil
+	}
+	var completed []*HTTPMessage
+	var current *HTTPMessage
+
+	finish := func(complete bool) {
+		s.msg.Complete = complete
+		completed = append(completed, s.msg)
+		s.msg = nil
+		s.line = s.line[:0]
+		s.state = httpStateStart
+	}
+
+	// A body ending with the connection, or data we lost track of, ends when the next message starts
+	if s.state == httpStateUntilNext && isHTTPStart(data) {
+		finish(false)
+	}
+
+	for len(data) > 0 && !s.upgraded {
+		if s.msg != nil {
+			current = s.msg
+			s.msg.End = ts
+		}
+
+		switch s.state {
+		case httpStateStart:
+			if !isHTTPStart(data) {
+				// Middle of a message we didn't see the start of
+				return current, completed
+			}
+			s.msg = &HTTPMessage{Egress: s.egress, Tid: tid, Start: ts, End: ts}
+			s.state = httpStateHeaders
+
+		case httpStateHeaders:
+			prev := len(s.line)
+			s.line = append(s.line, data...)
+			end := bytes.Index(s.line, []byte("\r\n\r\n"))
+			if end == -1 {
+				s.msg.Size += uint64(len(data))
+				data = nil
+				if len(s.line) > maxHTTPHeaderSize {
+					s.truncateHeaders()
+				}
+				continue
+			}
+			n := end + 4 - prev
+			s.msg.Size += uint64(n)
+			data = data[n:]
+			if !parseHTTPHeaders(s.msg, s.line[:end]) {
+				// Not HTTP after all
+				s.msg = nil
+				s.line = s.line[:0]
+				s.state = httpStateStart
+				return current, completed
+			}
+			s.msg.HeaderSize = uint64(end + 4)
+			s.line = s.line[:0]
+			if s.startBody() {
+				finish(true)
+			}
+
+		case httpStateBody:
+			n := min(uint64(len(data)), s.remaining)
+			s.consumeBody(n)
+			data = data[n:]
+			if s.remaining == 0 {
+				finish(true)
+			}
+
+		case httpStateChunkSize, httpStateTrailers:
+			i := bytes.IndexByte(data, '\n')
+			if i == -1 {
+				s.line = append(s.line, data...)
+				s.msg.Size += uint64(len(data))
+				data = nil
+				if len(s.line) > maxHTTPHeaderSize {
+					s.state = httpStateUntilNext
+				}
+				continue
+			}
+			s.line = append(s.line, data[:i+1]...)
+			s.msg.Size += uint64(i + 1)
+			data = data[i+1:]
+			line := strings.TrimSpace(string(s.line))
+			s.line = s.line[:0]
+
+			if s.state == httpStateTrailers {
+				// Trailers end with an empty line
+				if line == "" {
+					finish(true)
+				}
+				continue
+			}
+			// chunk-size [; chunk-ext]
+			size, err := strconv.ParseUint(strings.TrimSpace(strings.SplitN(line, ";", 2)[0]), 16, 64)
+			if err != nil {
+				s.state = httpStateUntilNext
+				continue
+			}
+			if size == 0 {
+				s.state = httpStateTrailers
+			} else {
+				s.remaining = size
+				s.state = httpStateChunkData
+			}
+
+		case httpStateChunkData:
+			n := min(uint64(len(data)), s.remaining)
+			s.consumeBody(n)
+			data = data[n:]
+			if s.remaining == 0 {
+				s.remaining = 2
+				s.state = httpStateChunkEnd
+			}
+
+		case httpStateChunkEnd:
+			n := min(uint64(len(data)), s.remaining)
+			s.remaining -= n
+			s.msg.Size += n
+			data = data[n:]
+			if s.remaining == 0 {
+				s.state = httpStateChunkSize
+			}
+
+		case httpStateUntilNext:
+			if s.msg.Chunked || s.msg.Headers == nil {
+				s.msg.Size += uint64(len(data))
+			} else {
+				s.consumeBody(uint64(len(data)))
+			}
+			data = nil
+		}
+	}
+
+	if lost > 0 && s.msg != nil && !s.upgraded {
+		current = s.msg
+		s.skip(lost, &completed)
+	}
+	return current, completed
+}
+
+// skip accounts for bytes that weren't copied, the message can still be followed when they're body bytes of known size
+func (s *httpStream) skip(lost uint64, completed *[]*HTTPMessage) {
+	switch s.state {
+	case httpStateBody:
+		n := min(lost, s.remaining)
+		s.consumeBody(n)
+		if s.remaining == 0 {
+			// What follows belongs to the next message, which isn't resynchronized before the next start line
+			s.msg.Complete = true
+			*completed = append(*completed, s.msg)
+			s.msg = nil
+			s.state = httpStateStart
+		}
+	case httpStateChunkData:
+		if lost <= s.remaining {
+			s.consumeBody(lost)
+			if s.remaining == 0 {
+				s.remaining = 2
+				s.state = httpStateChunkEnd
+			}
+		} else {
+			remaining := s.remaining
+			s.consumeBody(remaining)
+			s.msg.Size += lost - remaining
+			s.state = httpStateUntilNext
+		}
+	case httpStateHeaders:
+		s.msg.Size += lost
+		s.truncateHeaders()
+	case httpStateUntilNext:
+		s.msg.Size += lost
+		if !s.msg.Chunked && s.msg.Headers != nil {
+			s.msg.BodySize += lost
+		}
+	default:
+		s.msg.Size += lost
+		s.state = httpStateUntilNext
+	}
+}
+
+// truncateHeaders parses what was received of a header block whose end was lost
+func (s *httpStream) truncateHeaders() {
+	block := s.line
+	if i := bytes.LastIndex(block, []byte("\r\n")); i != -1 {
+		block = block[:i]
+	}
+	s.line = s.line[:0]
+	if !parseHTTPHeaders(s.msg, block) {
+		s.msg = nil
+		s.state = httpStateStart
+		return
+	}
+	s.msg.Truncated = true
+	if s.onHeaders != nil {
+		s.onHeaders(s.msg)
+	}
+	s.state = httpStateUntilNext
+}
+
+func (s *httpStream) consumeBody(n uint64) {
+	s.remaining -= min(n, s.remaining)
+	s.msg.BodySize += n
+	s.msg.Size += n
+}
+
+// startBody picks how the body of the parsed message ends, returning true when it has no body
+func (s *httpStream) startBody() bool {
+	m := s.msg
+	bodyless := false
+	if s.onHeaders != nil {
+		bodyless = s.onHeaders(m)
+	}
+
+	if !m.Request && (m.Status < 200 || m.Status == http.StatusNoContent || m.Status == http.StatusNotModified || bodyless) {
+		return true
+	}
+
+	if strings.Contains(strings.ToLower(m.Headers.Get("Transfer-Encoding")), "chunked") {
+		m.Chunked = true
+		s.state = httpStateChunkSize
+		return false
+	}
+	if cl := m.Headers.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseUint(cl, 10, 64)
+		if err != nil {
+			s.state = httpStateUntilNext
+			return false
+		}
+		if n == 0 {
+			return true
+		}
+		s.remaining = n
+		s.state = httpStateBody
+		return false
+	}
+	// Requests without length have no body, responses last until the connection is closed
+	if m.Request {
+		return true
+	}
+	s.state = httpStateUntilNext
+	return false
+}
+
+// Flush ends the message being parsed, when the connection is closed or idle
+func (s *httpStream) Flush() *HTTPMessage {
+	m := s.msg
+	if m == nil {
+		return nil
+	}
+	s.msg = nil
+	s.line = s.line[:0]
+	s.state = httpStateStart
+	return m
+}
+
+// isHTTPStart tells whether data starts with a request line ("GET / HTTP/1.1") or a status line ("HTTP/1.1 200 OK")
+func isHTTPStart(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		return true
+	}
+	sp := bytes.IndexByte(data, ' ')
+	return sp != -1 && httpMethods[string(data[:sp])]
+}
+
+// parseHTTPHeaders fills m from a header block without its final CRLFCRLF, returning false if the start line is invalid
+func parseHTTPHeaders(m *HTTPMessage, block []byte) bool {
+	lines := strings.Split(string(block), "\r\n")
+	fields := strings.SplitN(lines[0], " ", 3)
+	if len(fields) < 2 {
+		return false
+	}
+
+	if strings.HasPrefix(fields[0], "HTTP/") {
+		// HTTP/1.1 200 OK
+		status, err := strconv.Atoi(fields[1])
+		if err != nil || len(fields[1]) != 3 {
+			return false
+		}
+		m.Proto = fields[0]
+		m.Status = status
+	} else {
+		// GET /index.html HTTP/1.1
+		if len(fields) != 3 || !httpMethods[fields[0]] || !strings.HasPrefix(fields[2], "HTTP/") {
+			return false
+		}
+		m.Request = true
+		m.Method = fields[0]
+		m.URL = fields[1]
+		m.Proto = fields[2]
+	}
+
+	m.Headers = http.Header{}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		m.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if m.Request {
+		m.Host = m.Headers.Get("Host")
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+package main
+
+// SSL and the structures behind it are opaque, their layout changing with each OpenSSL release and build, so BPF
+// can't read them like it reads kernel structures with CO-RE. Their getters are mostly a single load from the
+// pointer they're given, though: the offsets are taken from the code of the getters of each library.
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"sync"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Longest getter decoded, SSL_get_servername being the longest of them
+const maxGetterSize = 1024
+
+var endbr64 = []byte{0xf3, 0x0f, 0x1e, 0xfa}
+
+// sslGetter is an exported function of the library, decoded
+type sslGetter []x86asm.Inst
+
+// readSSLGetter decodes the instructions of a function defined by the library
+func readSSLGetter(ef *elf.File, name string) (sslGetter, error) {
+	var sym *elf.Symbol
+	for _, symbols := range []func() ([]elf.Symbol, error){ef.DynamicSymbols, ef.Symbols} {
+		syms, err := symbols()
+		if err != nil {
+			continue
+		}
+		for i := range syms {
+			s := &syms[i]
+			if s.Name == name && elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Section != elf.SHN_UNDEF && s.Value != 0 {
+				sym = s
+				break
+			}
+		}
+		if sym != nil {
+			break
+		}
+	}
+	if sym == nil {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	if sym.Size == 0 || sym.Size > maxGetterSize || int(sym.Section) >= len(ef.Sections) {
+		return nil, fmt.Errorf("%s: unexpected size %d", name, sym.Size)
+	}
+	section := ef.Sections[sym.Section]
+	if sym.Value < section.Addr || sym.Value+sym.Size > section.Addr+section.Size {
+		return nil, fmt.Errorf("%s not in %s", name, section.Name)
+	}
+	code := make([]byte, sym.Size)
+	if _, err := section.ReadAt(code, int64(sym.Value-section.Addr)); err != nil {
+		return nil, err
+	}
+
+	var insts sslGetter
+	for i := 0; i < len(code); {
+		// Builds with -fcf-protection start functions with ENDBR64, which x86asm doesn't know
+		if bytes.HasPrefix(code[i:], endbr64) {
+			i += len(endbr64)
+			continue
+		}
+		inst, err := x86asm.Decode(code[i:], 64)
+		if err != nil || inst.Op == 0 || hasVEXPrefix(inst) {
+			return nil, fmt.Errorf("can't disassemble %s at +0x%x", name, i)
+		}
+		insts = append(insts, inst)
+		i += inst.Len
+	}
+	return insts, nil
+}
+
+// reg64 returns the 64-bit register a register is part of, 0 for those that aren't general purpose
+func reg64(r x86asm.Reg) x86asm.Reg {
+	switch {
+	case r >= x86asm.RAX && r <= x86asm.R15:
+		return r
+	case r >= x86asm.EAX && r <= x86asm.R15L:
+		return r - x86asm.EAX + x86asm.RAX
+	case r >= x86asm.AX && r <= x86asm.R15W:
+		return r - x86asm.AX + x86asm.RAX
+	case r >= x86asm.AL && r <= x86asm.BL:
+		return r - x86asm.AL + x86asm.RAX
+	case r >= x86asm.AH && r <= x86asm.BH:
+		return r - x86asm.AH + x86asm.RAX
+	case r >= x86asm.SPB && r <= x86asm.R15B:
+		return r - x86asm.SPB + x86asm.RSP
+	}
+	return 0
+}
+
+// written returns the 64-bit register an instruction writes, 0 if none or if it's not a general purpose register
+func written(inst x86asm.Inst) x86asm.Reg {
+	switch inst.Op {
+	case x86asm.CMP, x86asm.TEST, x86asm.PUSH, x86asm.BT:
+		return 0
+	case x86asm.CALL:
+		return x86asm.RAX
+	}
+	if r, ok := inst.Args[0].(x86asm.Reg); ok {
+		return reg64(r)
+	}
+	return 0
+}
+
+// load returns the register an instruction loads from base+displacement, without index, and the displacement
+func load(inst x86asm.Inst, bases map[x86asm.Reg]bool) (x86asm.Reg, int32, bool) {
+	if inst.Op != x86asm.MOV && inst.Op != x86asm.MOVZX && inst.Op != x86asm.MOVSXD {
+		return 0, 0, false
+	}
+	dst, ok := inst.Args[0].(x86asm.Reg)
+	mem, isMem := inst.Args[1].(x86asm.Mem)
+	if !ok || !isMem || !bases[mem.Base] || mem.Index != 0 || mem.Segment != 0 || mem.Disp < 0 {
+		return 0, 0, false
+	}
+	return reg64(dst), int32(mem.Disp), true
+}
+
+var rdiOnly = map[x86asm.Reg]bool{x86asm.RDI: true}
+
+// returnedField returns the offset a getter like SSL_version(const SSL *s) { return s->version; } reads, from a
+// single load from its first argument to RAX followed by RET, with nothing but register clearing in between
+func (g sslGetter) returnedField() (int32, bool) {
+	if len(g) < 2 {
+		return 0, false
+	}
+	dst, disp, ok := load(g[0], rdiOnly)
+	if !ok || dst != x86asm.RAX {
+		return 0, false
+	}
+	for _, inst := range g[1:] {
+		switch {
+		case inst.Op == x86asm.RET:
+			return disp, true
+		case inst.Op == x86asm.XOR && inst.Args[0] == inst.Args[1] && written(inst) != x86asm.RAX:
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// storedFields returns the offsets a getter like SSL_get0_alpn_selected(const SSL *s, const unsigned char **data,
+// unsigned int *len) reads from its first argument and stores to the pointers it's given, keyed by the register
+// of the pointer
+func (g sslGetter) storedFields() map[x86asm.Reg]int32 {
+	loaded := map[x86asm.Reg]int32{} // Registers holding a field
+	stored := map[x86asm.Reg]int32{}
+	for _, inst := range g {
+		if inst.Op == x86asm.RET {
+			break
+		}
+		if inst.Op == x86asm.MOV {
+			mem, isMem := inst.Args[0].(x86asm.Mem)
+			src, isReg := inst.Args[1].(x86asm.Reg)
+			if isMem && isReg && mem.Disp == 0 && mem.Index == 0 {
+				if disp, ok := loaded[reg64(src)]; ok {
+					stored[mem.Base] = disp
+				}
+				continue
+			}
+		}
+		r := written(inst)
+		delete(loaded, r)
+		if dst, disp, ok := load(inst, rdiOnly); ok {
+			loaded[dst] = disp
+		}
+	}
+	return stored
+}
+
+// returnedFields returns every offset of its first argument a getter returns the value of on any of its paths,
+// found by following its instructions in order, whatever the branches. SSL_get_servername returns s->ext.hostname
+// on most of them, and otherwise a field of s->session, which isn't loaded from its argument.
+func (g sslGetter) returnedFields() map[int32]bool {
+	// Registers the argument is copied to, e.g. to call another function
+	bases := map[x86asm.Reg]bool{x86asm.RDI: true}
+	for _, inst := range g {
+		if src, ok := inst.Args[1].(x86asm.Reg); inst.Op == x86asm.MOV && ok && src == x86asm.RDI {
+			if dst, ok := inst.Args[0].(x86asm.Reg); ok {
+				bases[dst] = true
+			}
+		}
+	}
+
+	fields := map[int32]bool{}
+	rax, loaded := int32(0), false
+	for _, inst := range g {
+		if inst.Op == x86asm.RET {
+			if loaded {
+				fields[rax] = true
+			}
+			loaded = false
+			continue
+		}
+		if dst, disp, ok := load(inst, bases); ok && dst == x86asm.RAX && inst.Op == x86asm.MOV && inst.MemBytes == 8 {
+			rax, loaded = disp, true
+		} else if written(inst) == x86asm.RAX {
+			loaded = false
+		}
+	}
+	return fields
+}
+
+// findSSLLayout reads the offsets of the fields behind the getters of the library at path, -1 for those whose
+// getter isn't as expected, e.g. since OpenSSL 3.2, whose getters check whether the SSL* is a QUIC connection first
+func findSSLLayout(path string) (bpfSslLayout, error) {
+	layout := bpfSslLayout{-1, -1, -1, -1, -1, -1, -1, -1}
+	ef, err := elf.Open(path)
+	if err != nil {
+		return layout, err
+	}
+	defer ef.Close()
+	if ef.Machine != elf.EM_X86_64 {
+		return layout, fmt.Errorf("unsupported architecture %s", ef.Machine)
+	}
+
+	getters := map[string]sslGetter{}
+	for _, name := range []string{"SSL_version", "SSL_is_server", "SSL_get_session", "SSL_SESSION_get0_cipher",
+		"SSL_CIPHER_get_protocol_id", "SSL_get0_alpn_selected", "SSL_get_servername"} {
+		if g, err := readSSLGetter(ef, name); err == nil {
+			getters[name] = g
+		}
+	}
+
+	for name, field := range map[string]*int32{
+		"SSL_version":                &layout.Version,
+		"SSL_is_server":              &layout.Server,
+		"SSL_get_session":            &layout.Session,
+		"SSL_SESSION_get0_cipher":    &layout.Cipher,
+		"SSL_CIPHER_get_protocol_id": &layout.CipherId,
+	} {
+		if disp, ok := getters[name].returnedField(); ok {
+			*field = disp
+		}
+	}
+	// The IANA ID is the low 16 bits of the 32-bit SSL_CIPHER.id, at the same offset on little endian machines
+	if g := getters["SSL_CIPHER_get_protocol_id"]; layout.CipherId >= 0 && g[0].MemBytes != 2 {
+		layout.CipherId = -1
+	}
+
+	stored := getters["SSL_get0_alpn_selected"].storedFields()
+	if alpn, ok := stored[x86asm.RSI]; ok {
+		if alpnLen, ok := stored[x86asm.RDX]; ok {
+			layout.Alpn, layout.AlpnLen = alpn, alpnLen
+		}
+	}
+
+	// A single candidate only, the session's hostname being reached through SSL.session
+	if fields := getters["SSL_get_servername"].returnedFields(); len(fields) == 1 {
+		for disp := range fields {
+			if disp != layout.Session {
+				layout.Hostname = disp
+			}
+		}
+	}
+	return layout, nil
+}
+
+// sslLayouts numbers the distinct layouts of the libraries, their number being the cookie of the uprobes of the
+// libraries and the index in ssl_layout_map
+var sslLayouts = struct {
+	sync.Mutex
+	ids map[bpfSslLayout]uint64
+}{ids: map[bpfSslLayout]uint64{}}
+
+// sslLayoutCookie returns the cookie of the uprobes of the library at path, 0 when none of the fields were found
+func sslLayoutCookie(objs *bpfObjects, path string) (uint64, error) {
+	layout, err := findSSLLayout(path)
+	if err != nil || layout == (bpfSslLayout{-1, -1, -1, -1, -1, -1, -1, -1}) {
+		return 0, err
+	}
+
+	sslLayouts.Lock()
+	defer sslLayouts.Unlock()
+	if id, ok := sslLayouts.ids[layout]; ok {
+		return id, nil
+	}
+	id := uint64(len(sslLayouts.ids) + 1)
+	if id >= uint64(objs.SslLayoutMap.MaxEntries()) {
+		return 0, fmt.Errorf("more than %d SSL layouts", id-1)
+	}
+	if err := objs.SslLayoutMap.Put(uint32(id), layout); err != nil {
+		return 0, err
+	}
+	sslLayouts.ids[layout] = id
+	return id, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ld.so.cache format, see glibc's sysdeps/generic/dl-cache.h
+const (
+	ldCachePath         = "/etc/ld.so.cache"
+	ldCacheMagicOld     = "ld.so-1.7.0"
+	ldCacheMagicNew     = "glibc-ld.so.cache"
+	ldCacheVersionNew   = "1.1"
+	ldCacheOldHeaderLen = 16 // magic (padded to 12 bytes), nlibs
+	ldCacheOldEntryLen  = 12 // flags, key, value
+	ldCacheNewHeaderLen = 48 // magic, version, nlibs, len_strings, flags, padding, extension_offset, unused
+	ldCacheNewEntryLen  = 24 // flags, key, value, osversion, hwcap
+
+	ldCacheFlagTypeMask = 0x00ff
+	ldCacheFlagELFLibc6 = 0x0003
+	ldCacheFlagArchMask = 0xff00
+)
+
+// Architecture flags of the 64-bit libraries the probes can be attached to
+var ldCacheArchFlags = map[string]int32{
+	"amd64": 0x0300,
+	"arm64": 0x0a00,
+}
+
+// sslLibrary is a shared library the probes are attached to. Libraries are identified
+// by device and inode, since the same file is reachable through many paths.
+type sslLibrary struct {
+	Path string // Path reachable from the tracer's mount namespace
+	Dev  uint64
+	Ino  uint64
+}
+
+type libraryKey struct {
+	Dev uint64
+	Ino uint64
+}
+
+// ldCacheLibraries returns the paths of the libraries in /etc/ld.so.cache whose name starts with prefix
+func ldCacheLibraries(prefix string) ([]string, error) {
+	data, err := os.ReadFile(ldCachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The old format can be followed by the new one, otherwise the file only has the new format
+	if bytes.HasPrefix(data, []byte(ldCacheMagicOld)) {
+		if len(data) < ldCacheOldHeaderLen {
+			return nil, fmt.Errorf("%s: truncated header", ldCachePath)
+		}
+		nlibs := int(binary.LittleEndian.Uint32(data[12:16]))
+		entries := ldCacheOldHeaderLen + nlibs*ldCacheOldEntryLen
+
+		// New format starts at the next 8 bytes boundary
+		newStart := (entries + 7) &^ 7
+		if newStart < len(data) && bytes.HasPrefix(data[newStart:], []byte(ldCacheMagicNew)) {
+			return parseLdCacheNew(data[newStart:], prefix)
+		}
+		if entries > len(data) {
+			return nil, fmt.Errorf("%s: truncated entries", ldCachePath)
+		}
+		return parseLdCacheOld(data, nlibs, data[entries:], prefix), nil
+	}
+	if bytes.HasPrefix(data, []byte(ldCacheMagicNew)) {
+		return parseLdCacheNew(data, prefix)
+	}
+	return nil, fmt.Errorf("%s: unknown format", ldCachePath)
+}
+
+// In the old format, string offsets are relative to the end of the entries
+func parseLdCacheOld(data []byte, nlibs int, strs []byte, prefix string) []string {
+	paths := []string{}
+	for i := 0; i < nlibs; i++ {
+		entry := data[ldCacheOldHeaderLen+i*ldCacheOldEntryLen:]
+		flags := int32(binary.LittleEndian.Uint32(entry[0:4]))
+		key := cString(strs, binary.LittleEndian.Uint32(entry[4:8]))
+		value := cString(strs, binary.LittleEndian.Uint32(entry[8:12]))
+		if flags&ldCacheFlagTypeMask == ldCacheFlagELFLibc6 && strings.HasPrefix(key, prefix) {
+			paths = append(paths, value)
+		}
+	}
+	return paths
+}
+
+// In the new format, string offsets are relative to the start of the new header
+func parseLdCacheNew(data []byte, prefix string) ([]string, error) {
+	if len(data) < ldCacheNewHeaderLen || string(data[len(ldCacheMagicNew):len(ldCacheMagicNew)+len(ldCacheVersionNew)]) != ldCacheVersionNew {
+		return nil, fmt.Errorf("%s: unsupported version", ldCachePath)
+	}
+	nlibs := int(binary.LittleEndian.Uint32(data[20:24]))
+	if ldCacheNewHeaderLen+nlibs*ldCacheNewEntryLen > len(data) {
+		return nil, fmt.Errorf("%s: truncated entries", ldCachePath)
+	}
+
+	arch, knownArch := ldCacheArchFlags[runtime.GOARCH]
+	paths := []string{}
+	for i := 0; i < nlibs; i++ {
+		entry := data[ldCacheNewHeaderLen+i*ldCacheNewEntryLen:]
+		flags := int32(binary.LittleEndian.Uint32(entry[0:4]))
+		key := cString(data, binary.LittleEndian.Uint32(entry[4:8]))
+		value := cString(data, binary.LittleEndian.Uint32(entry[8:12]))
+		if flags&ldCacheFlagTypeMask != ldCacheFlagELFLibc6 || (knownArch && flags&ldCacheFlagArchMask != arch) {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			paths = append(paths, value)
+		}
+	}
+	return paths, nil
+}
+
+// cString returns the NUL terminated string at offset
+func cString(data []byte, offset uint32) string {
+	if int(offset) >= len(data) {
+		return ""
+	}
+	s := data[offset:]
+	if end := bytes.IndexByte(s, 0); end != -1 {
+		s = s[:end]
+	}
+	return string(s)
+}
+
+// isLibrary tells whether a file name is a version of the shared library prefix, e.g. libssl.so.3 for libssl.
+// NSS's libssl3.so isn't a libssl.
+func isLibrary(path, prefix string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, prefix+".so")
+}
+
+// processLibraries returns the paths of the libraries loaded by pid whose name starts with prefix.
+// Paths are resolved through /proc/<pid>/root so libraries of containers are reachable.
+func processLibraries(pid int, prefix string) ([]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	paths := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") || !isLibrary(fields[5], prefix) {
+			continue
+		}
+		if seen[fields[5]] {
+			continue
+		}
+		seen[fields[5]] = true
+		paths = append(paths, fmt.Sprintf("/proc/%d/root%s", pid, fields[5]))
+	}
+	return paths, scanner.Err()
+}
+
+// pids returns the pids of all running processes
+func pids() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pids := []int{}
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// installedLibraries returns every distinct library of /etc/ld.so.cache whose name starts with prefix
+func installedLibraries(prefix string) ([]sslLibrary, error) {
+	paths, err := ldCacheLibraries(prefix + ".so")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[libraryKey]bool{}
+	libraries := []sslLibrary{}
+	for _, path := range paths {
+		library, err := statLibrary(path)
+		if err != nil || seen[library.key()] {
+			continue
+		}
+		seen[library.key()] = true
+		libraries = append(libraries, library)
+	}
+	return libraries, nil
+}
+
+func statLibrary(path string) (sslLibrary, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return sslLibrary{}, err
+	}
+	return sslLibrary{Path: path, Dev: uint64(st.Dev), Ino: st.Ino}, nil
+}
+
+func (l sslLibrary) key() libraryKey {
+	return libraryKey{Dev: l.Dev, Ino: l.Ino}
+}
+
+// definesSymbol tells whether the ELF file at path defines the function symbol itself, rather than importing it
+func definesSymbol(path, symbol string) bool {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer ef.Close()
+
+	for _, symbols := range []func() ([]elf.Symbol, error){ef.Symbols, ef.DynamicSymbols} {
+		syms, err := symbols()
+		if err != nil {
+			continue
+		}
+		for _, s := range syms {
+			if s.Name == symbol && elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Section != elf.SHN_UNDEF && s.Value != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// processExecutable returns the path of the executable of pid, resolved through /proc/<pid>/root like libraries
+func processExecutable(pid int) (string, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/proc/%d/root%s", pid, exe), nil
+}
@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"flag"
 	"log"
 	"os"
 	"fmt"
 	"os/signal"
-	"os/exec"
 	"strings"
-	"bufio"
 	"syscall"
 
 	"github.com/cilium/ebpf/link"
@@ -19,35 +18,122 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target amd64 -type ssl_data_event_t bpf ssl.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target amd64 -type ssl_data_event_t -type ssl_handshake_event_t -type ssl_layout -type process_event_t -type filter_config bpf ssl.c
 
-func findLibraryPath(libname string) (string, error) {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("ldconfig -p | grep %s", libname))
-
-	// Run the command and get the output
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+// attachSSLProbes attaches the SSL_write, SSL_read and, when present, SSL_write_ex, SSL_read_ex,
+// socket binding and handshake probes to the libssl (or the binary embedding BoringSSL) at path
+func attachSSLProbes(objs *bpfObjects, path string) ([]link.Link, error) {
+	// Handshakes are reported without what the SSL* negotiated when its layout isn't found
+	cookie, err := sslLayoutCookie(objs, path)
 	if err != nil {
-		return "", fmt.Errorf("failed to run ldconfig: %w", err)
+		log.Printf("%s: SSL layout: %s", path, err)
 	}
+	return attachUprobes(path, cookie, []uprobeSpec{
+		{"SSL_write", objs.UprobeLibsslWrite, objs.UretprobeLibsslWrite, false},
+		{"SSL_read", objs.UprobeLibsslRead, objs.UretprobeLibsslRead, false},
+		// Symbols that only exist since OpenSSL 1.1.1 are attached when present
+		{"SSL_write_ex", objs.UprobeLibsslWriteEx, objs.UretprobeLibsslWriteEx, true},
+		{"SSL_read_ex", objs.UprobeLibsslReadEx, objs.UretprobeLibsslReadEx, true},
+		// Bind SSL* to their socket
+		{"SSL_set_fd", objs.UprobeLibsslSetFd, nil, true},
+		// Only defined here when BoringSSL's libcrypto is linked in the same executable, OpenSSL's being in libcrypto
+		{"BIO_new_socket", objs.UprobeLibsslBioNewSocket, objs.UretprobeLibsslBioNewSocket, true},
+		{"SSL_set_bio", objs.UprobeLibsslSetBio, nil, true},
+		// Handshakes, SSL_connect and SSL_accept being the client and server shortcuts to SSL_do_handshake
+		{"SSL_do_handshake", objs.UprobeLibsslDoHandshake, objs.UretprobeLibsslDoHandshake, true},
+		{"SSL_connect", objs.UprobeLibsslDoHandshake, objs.UretprobeLibsslDoHandshake, true},
+		{"SSL_accept", objs.UprobeLibsslDoHandshake, objs.UretprobeLibsslDoHandshake, true},
+		// An SSL* set up for another connection reports its handshake again
+		{"SSL_set_connect_state", objs.UprobeLibsslNewHandshake, nil, true},
+		{"SSL_set_accept_state", objs.UprobeLibsslNewHandshake, nil, true},
+		{"SSL_clear", objs.UprobeLibsslNewHandshake, nil, true},
+	})
+}
 
-	// Read the first line of output which should have the library path
-	scanner := bufio.NewScanner(&out)
-	if scanner.Scan() {
-		line := scanner.Text()
-		// Extract the path from the ldconfig output
-		if start := strings.LastIndex(line, ">"); start != -1 {
-			path := strings.TrimSpace(line[start+1:])
-			return path, nil
-		}
+func closeLinks(links []link.Link) {
+	for _, l := range links {
+		l.Close()
 	}
+}
 
-	return "", fmt.Errorf("library not found")
+// readProcessEvents attaches to the TLS libraries processes load and detaches from them once they exit,
+// until the reader is closed
+func readProcessEvents(rd *ringbuf.Reader, attacher *Attacher) {
+	var event bpfProcessEventT
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			log.Printf("reading from process reader: %s", err)
+			continue
+		}
+
+		if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+			log.Printf("error parsing process event: %s", err)
+			continue
+		}
+
+		attacher.HandleEvent(event.Pid, event.Type, unix.ByteSliceToString(event.Filename[:]))
+	}
 }
 
+// readHandshakeEvents logs the handshakes the filter selects, until the reader is closed
+func readHandshakeEvents(rd *ringbuf.Reader, filter *HTTPFilter) {
+	tracker := NewHandshakeTracker()
+
+	var event bpfSslHandshakeEventT
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			log.Printf("reading from handshake reader: %s", err)
+			continue
+		}
+
+		if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+			log.Printf("error parsing handshake event: %s", err)
+			continue
+		}
+
+		if h := tracker.Observe(&event); h != nil && filter.MatchHandshake(h) {
+			log.Printf("TLS handshake %s\n", h)
+		}
+	}
+}
 
 func main() {
+	goBinaries := flag.String("go", "", "comma separated paths of Go binaries whose crypto/tls connections are traced")
+	pcapPath := flag.String("pcap", "", "write the decrypted traffic to this pcapng file")
+	redactPath := flag.String("redact-config", "", "JSON file of the secrets to redact, replacing the default rules")
+	redactMask := flag.String("redact-mask", "", "how secrets are masked: fixed, stars or hash")
+	noRedact := flag.Bool("no-redact", false, "output the decrypted payloads as they are, secrets included")
+	filterExpr := flag.String("filter", "", "space separated terms selecting the traffic that's output, e.g. \"comm=curl host=example.com path^=/api/ status=5xx\"")
+	spansPath := flag.String("spans", "", "write a span per HTTP exchange to this file, in the Zipkin v2 JSON format, one per line")
+	flag.Parse()
+
+	filter, err := ParseHTTPFilter(*filterExpr)
+	if err != nil {
+		log.Fatalf("parsing filter: %s", err)
+	}
+
+	var redactor *Redactor
+	if !*noRedact {
+		config, err := LoadRedactConfig(*redactPath)
+		if err != nil {
+			log.Fatalf("loading redaction config: %s", err)
+		}
+		if *redactMask != "" {
+			config.Mask = *redactMask
+		}
+		if redactor, err = NewRedactor(config); err != nil {
+			log.Fatalf("redaction config: %s", err)
+		}
+	}
+
 	stopper := make(chan os.Signal, 1)
 	signal.Notify(stopper, os.Interrupt, syscall.SIGTERM)
 
@@ -63,36 +149,60 @@ func main() {
 	}
 	defer objs.Close()
 
-	opensslPath, err := findLibraryPath("libssl.so");
-	if err != nil {
-		log.Fatal(err)
+	// Before attaching, so that no event of another process gets through
+	if err := filter.Push(&objs); err != nil {
+		log.Fatalf("setting the BPF filters: %s", err)
 	}
-	log.Printf("OpenSSL path: %s\n", opensslPath);
 
-	// Open an ELF binary and read its symbols.
-	ex, err := link.OpenExecutable(opensslPath)
+	// Processes are followed from now on, so that those starting during the scan aren't missed
+	attacher := NewAttacher(&objs)
+	defer attacher.Close()
+	prd, err := ringbuf.NewReader(objs.ProcessEventMap)
 	if err != nil {
-		log.Fatalf("opening executable: %s", err)
+		log.Fatalf("opening process ringbuf reader: %s", err)
 	}
-
-	// Set up SSL probes
-	uprobe_ssl_write, err := ex.Uprobe("SSL_write", objs.UprobeLibsslWrite, nil)
+	defer prd.Close()
+	processTracepoints, err := attachProcessTracepoints(&objs)
 	if err != nil {
-		log.Fatalf("creating uprobe - SSL_write: %s", err)
+		log.Printf("Processes started later won't be traced: %s", err)
 	}
-	defer uprobe_ssl_write.Close()
+	for _, l := range processTracepoints {
+		defer l.Close()
+	}
+	go readProcessEvents(prd, attacher)
 
-	uprobe_ssl_read, err := ex.Uprobe("SSL_read", objs.UprobeLibsslRead, nil)
-	if err != nil {
-		log.Fatalf("creating uprobe - SSL_read: %s", err)
+	// Every distinct TLS library, whether installed on the host or loaded by a (containerized) process
+	attacher.AttachInstalled()
+	attacher.ScanProcesses()
+	attached := attacher.Len()
+	// Go programs implement TLS themselves
+	if *goBinaries != "" {
+		for _, path := range strings.Split(*goBinaries, ",") {
+			links, err := attachGoTLSProbes(&objs, path)
+			if err != nil {
+				log.Printf("Skipping %s: %s", path, err)
+				continue
+			}
+			for _, l := range links {
+				defer l.Close()
+			}
+			attached++
+			log.Printf("Go binary: %s (%d probes)\n", path, len(links))
+		}
 	}
-	defer uprobe_ssl_read.Close()
 
-	uretprobe_ssl_read, err := ex.Uretprobe("SSL_read", objs.UretprobeLibsslRead, nil)
+	if attached == 0 {
+		log.Println("No TLS library or Go binary yet, waiting for processes to load one")
+	}
+
+	// Socket reads and writes made during handshakes carry the hellos and certificates
+	tracepoints, err := attachHandshakeTracepoints(&objs)
 	if err != nil {
-		log.Fatalf("Creating uretprobe - SSL_read: %s", err)
+		log.Printf("Handshake metadata unavailable: %s", err)
+	}
+	for _, l := range tracepoints {
+		defer l.Close()
 	}
-	defer uretprobe_ssl_read.Close()
 
 	rd, err := ringbuf.NewReader(objs.SslDataEventMap)
 	if err != nil {
@@ -110,8 +220,42 @@ func main() {
 		}
 	}()
 
+	var pcap *PcapWriter
+	if *pcapPath != "" {
+		pcap, err = NewPcapWriter(*pcapPath)
+		if err != nil {
+			log.Fatalf("creating pcap file: %s", err)
+		}
+		defer pcap.Close()
+	}
+
+	var spans *SpanTracker
+	var spanWriter *SpanWriter
+	var boot uint64
+	if *spansPath != "" {
+		if boot, err = bootTime(); err != nil {
+			log.Fatalf("reading the boot time: %s", err)
+		}
+		spanWriter, err = NewSpanWriter(*spansPath)
+		if err != nil {
+			log.Fatalf("creating span file: %s", err)
+		}
+		defer spanWriter.Close()
+		spans = NewSpanTracker(redactor)
+	}
+
+	hrd, err := ringbuf.NewReader(objs.SslHandshakeEventMap)
+	if err != nil {
+		log.Fatalf("opening handshake ringbuf reader: %s", err)
+	}
+	defer hrd.Close()
+	go readHandshakeEvents(hrd, filter)
+
 	log.Println("Waiting for events..")
 
+	tracker := NewHTTPTracker()
+	redaction := NewRedactStream(redactor)
+
 	var event bpfSslDataEventT
 	for {
 		record, err := rd.Read()
@@ -130,14 +274,56 @@ func main() {
 			continue
 		}
 
-		msg_bytes := event.Buf[0:event.Len]
-		msg := unix.ByteSliceToString(msg_bytes)
-
 		msg_type := "Sent"
 		if event.Egress == 0 {
 			msg_type = "Received"
 		}
 
-		log.Printf("%s: pid: %d size: %d\n%s\n\n", msg_type, event.Pid, event.Len, msg)
+		message, exchanges := tracker.Observe(&event)
+		if spans != nil {
+			spans.Observe(&event, message)
+		}
+
+		// Secrets are masked before any output, the payload keeping its length in the pcap file. Every event
+		// is redacted, filtered out or not, as secrets can continue from one event of a connection to the next.
+		payload := redaction.Redact(&event)
+		if filter.MatchEvent(event.Egress != 0, message) {
+			if pcap != nil {
+				if err := pcap.Write(&event); err != nil {
+					log.Printf("writing to pcap file: %s", err)
+				}
+			}
+
+			if event.Ret <= 0 {
+				log.Printf("%s error: pid: %d tid: %d ssl: 0x%x %s ret: %d\n\n", msg_type, event.Pid, event.Tid, event.Ssl, NewSocketInfo(&event), event.Ret)
+			} else {
+				msg := unix.ByteSliceToString(payload)
+
+				http_msg := ""
+				if message != nil {
+					http_msg = redactor.RedactString(fmt.Sprintf(" http: %s", message))
+				}
+
+				log.Printf("%s: pid: %d tid: %d ssl: 0x%x %s size: %d%s\n%s\n\n", msg_type, event.Pid, event.Tid, event.Ssl, NewSocketInfo(&event), event.Ret, http_msg, msg)
+			}
+		}
+
+		for _, e := range exchanges {
+			var span *Span
+			if spans != nil {
+				span = spans.Finish(e, boot)
+			}
+			if !filter.MatchExchange(e) {
+				continue
+			}
+			if span == nil {
+				log.Printf("HTTP %s\n", redactor.RedactString(e.String()))
+				continue
+			}
+			log.Printf("HTTP %s trace: %s span: %s\n", redactor.RedactString(e.String()), span.TraceID, span.ID)
+			if err := spanWriter.Write(span); err != nil {
+				log.Printf("writing span: %s", err)
+			}
+		}
 	}
 }
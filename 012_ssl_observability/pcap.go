@@ -0,0 +1,322 @@
+package main
+
+// pcapng: https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	pcapngSectionHeaderBlock  = 0x0A0D0D0A
+	pcapngInterfaceDescBlock  = 0x00000001
+	pcapngEnhancedPacketBlock = 0x00000006
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+
+	pcapngOptEndOfOpt         = 0
+	pcapngOptComment          = 1
+	pcapngOptInterfaceTsresol = 9
+
+	pcapngLinkTypeRaw = 101 // Raw IPv4 or IPv6 packets
+)
+
+const (
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	tcpHeaderSize  = 20
+
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+
+	// Largest TCP payload written in one packet
+	pcapMaxSegment = 65000
+
+	// Fake endpoints, when the socket isn't known
+	pcapFakeServerPort      = 80
+	pcapFakeClientPortFirst = 32768
+	pcapFakeClientPortCount = 28232
+)
+
+// Ports of protocols over TLS, replaced by the port of the plaintext protocol so Wireshark dissects the decrypted data
+var plaintextPorts = map[uint16]uint16{
+	443:  80,   // HTTPS
+	8443: 8080, // HTTPS alternate
+	465:  25,   // SMTPS
+	993:  143,  // IMAPS
+	995:  110,  // POP3S
+	636:  389,  // LDAPS
+}
+
+func plaintextPort(port uint16) uint16 {
+	if p, ok := plaintextPorts[port]; ok {
+		return p
+	}
+	return port
+}
+
+type pcapConn struct {
+	client, server netip.AddrPort
+	localIsClient  bool
+	seq            [2]uint32 // Next sequence number, indexed by whether the client sends
+	ipID           uint16
+}
+
+// PcapWriter writes the decrypted data as TCP segments of synthetic connections into a pcapng file
+type PcapWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	conns map[httpConnKey]*pcapConn
+	// Added to bpf_ktime_get_ns() timestamps (CLOCK_MONOTONIC) to get the time since the epoch
+	bootTime uint64
+}
+
+func NewPcapWriter(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p := &PcapWriter{
+		f:        f,
+		w:        bufio.NewWriter(f),
+		conns:    make(map[httpConnKey]*pcapConn),
+		bootTime: boot,
+	}
+
+	// Section header, then a single interface with nanosecond timestamps
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // Major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // Minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	p.writeBlock(pcapngSectionHeaderBlock, shb, nil)
+
+	idb := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // No snap length
+	p.writeBlock(pcapngInterfaceDescBlock, idb, pcapngOption(nil, pcapngOptInterfaceTsresol, []byte{9}))
+	if err := p.w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// bootTime returns the time since the epoch of CLOCK_MONOTONIC's origin, to be added to bpf_ktime_get_ns() timestamps
+func bootTime() (uint64, error) {
+	var mono unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &mono); err != nil {
+		return 0, err
+	}
+	return uint64(time.Now().UnixNano() - mono.Nano()), nil
+}
+
+// Write appends the data of an event as TCP segments of its connection, whose handshake is written first
+func (p *PcapWriter) Write(e *bpfSslDataEventT) error {
+	if e.Ret <= 0 {
+		return nil
+	}
+	egress := e.Egress != 0
+	k := httpConnKey{Pid: e.Pid, SSL: e.Ssl}
+	c, ok := p.conns[k]
+	if !ok {
+		c = p.newConn(e, egress)
+		p.conns[k] = c
+		p.handshake(c, e.TimestampNs)
+	}
+
+	fromClient := egress == c.localIsClient
+	comment := fmt.Sprintf("pid: %d tid: %d ssl: 0x%x", e.Pid, e.Tid, e.Ssl)
+	data := e.Buf[:e.Len]
+	size := uint64(e.Ret)
+	for size > 0 {
+		n := min(size, pcapMaxSegment)
+		captured := data[:min(uint64(len(data)), n)]
+		data = data[len(captured):]
+		p.segment(c, fromClient, tcpFlagPsh|tcpFlagAck, captured, uint32(n), e.TimestampNs, comment)
+		size -= n
+	}
+	return p.w.Flush()
+}
+
+func (p *PcapWriter) Close() error {
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
+
+// newConn picks the endpoints of a connection: the socket addresses when known, otherwise fake but consistent
+// ones. The side sending first is assumed to be the client, as in HTTP.
+func (p *PcapWriter) newConn(e *bpfSslDataEventT, egress bool) *pcapConn {
+	c := &pcapConn{}
+	socket := NewSocketInfo(e)
+	if socket.Local.IsValid() && socket.Remote.IsValid() {
+		local := netip.AddrPortFrom(socket.Local.Addr(), plaintextPort(socket.Local.Port()))
+		remote := netip.AddrPortFrom(socket.Remote.Addr(), plaintextPort(socket.Remote.Port()))
+		// Servers listen on the lower port
+		c.localIsClient = socket.Local.Port() > socket.Remote.Port()
+		c.client, c.server = local, remote
+		if !c.localIsClient {
+			c.client, c.server = remote, local
+		}
+		return c
+	}
+
+	// Client 10.0.0.0/8 address derived from the pid, server 172.16.0.0/12 address derived from the SSL*
+	c.localIsClient = egress
+	c.client = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(e.Pid >> 16), byte(e.Pid >> 8), byte(e.Pid)}),
+		uint16(pcapFakeClientPortFirst+len(p.conns)%pcapFakeClientPortCount))
+	h := e.Ssl ^ e.Ssl>>20 ^ e.Ssl>>40
+	c.server = netip.AddrPortFrom(netip.AddrFrom4([4]byte{172, 16 | byte(h>>16)&0x0f, byte(h >> 8), byte(h)}), pcapFakeServerPort)
+	return c
+}
+
+// handshake writes the SYN, SYN-ACK and ACK of a connection, both sides starting with sequence number 0
+func (p *PcapWriter) handshake(c *pcapConn, ts uint64) {
+	p.segment(c, true, tcpFlagSyn, nil, 1, ts, "")
+	p.segment(c, false, tcpFlagSyn|tcpFlagAck, nil, 1, ts, "")
+	p.segment(c, true, tcpFlagAck, nil, 0, ts, "")
+}
+
+// segment writes a TCP segment carrying size bytes, of which only payload was captured
+func (p *PcapWriter) segment(c *pcapConn, fromClient bool, flags uint8, payload []byte, size uint32, ts uint64, comment string) {
+	src, dst := c.client, c.server
+	sender, receiver := 1, 0
+	if !fromClient {
+		src, dst = dst, src
+		sender, receiver = 0, 1
+	}
+	seq := c.seq[sender]
+	c.seq[sender] += size
+	// SYN and FIN count as one byte but carry no data
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		size = 0
+	}
+	ack := uint32(0)
+	if flags&tcpFlagAck != 0 {
+		ack = c.seq[receiver]
+	}
+
+	tcp := make([]byte, tcpHeaderSize, tcpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = tcpHeaderSize / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535) // Window
+	tcp = append(tcp, payload...)
+	// The checksum can only be computed over the whole payload
+	if uint32(len(payload)) == size {
+		binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(src.Addr(), dst.Addr(), tcp))
+	}
+
+	var ip []byte
+	if src.Addr().Is4() {
+		ip = make([]byte, ipv4HeaderSize)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipv4HeaderSize+tcpHeaderSize+size))
+		binary.BigEndian.PutUint16(ip[4:6], c.ipID)
+		c.ipID++
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000) // Don't fragment
+		ip[8] = 64                                  // TTL
+		ip[9] = unix.IPPROTO_TCP
+		src4, dst4 := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:16], src4[:])
+		copy(ip[16:20], dst4[:])
+		binary.BigEndian.PutUint16(ip[10:12], ^checksum(0, ip))
+	} else {
+		ip = make([]byte, ipv6HeaderSize)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(tcpHeaderSize+size))
+		ip[6] = unix.IPPROTO_TCP
+		ip[7] = 64 // Hop limit
+		src16, dst16 := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:24], src16[:])
+		copy(ip[24:40], dst16[:])
+	}
+	packet := append(ip, tcp...)
+
+	ts += p.bootTime
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // Interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(ip)+tcpHeaderSize)+size)
+	epb = append(epb, packet...)
+	epb = pad4(epb)
+	var options []byte
+	if comment != "" {
+		options = pcapngOption(nil, pcapngOptComment, []byte(comment))
+	}
+	p.writeBlock(pcapngEnhancedPacketBlock, epb, options)
+}
+
+// writeBlock writes a block, whose options are terminated by opt_endofopt
+func (p *PcapWriter) writeBlock(blockType uint32, body []byte, options []byte) {
+	if options != nil {
+		options = pcapngOption(options, pcapngOptEndOfOpt, nil)
+	}
+	length := uint32(12 + len(body) + len(options))
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = append(block, options...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	p.w.Write(block)
+}
+
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad4(b)
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// checksum adds data to the one's complement sum
+func checksum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// tcpChecksum computes the checksum of a segment, including the IPv4 or IPv6 pseudo header
+func tcpChecksum(src, dst netip.Addr, segment []byte) uint16 {
+	pseudo := append(src.AsSlice(), dst.AsSlice()...)
+	if src.Is4() {
+		pseudo = append(pseudo, 0, unix.IPPROTO_TCP)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_TCP)
+	}
+	sum := uint32(checksum(0, pseudo))
+	return ^checksum(sum, segment)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// How secrets are replaced in the output
+const (
+	maskFixed = "fixed" // By the replacement text, "[REDACTED]" by default
+	maskStars = "stars" // By as many '*', keeping the length of the payload
+	maskHash  = "hash"  // By the start of their SHA-256, so that equal secrets can be told apart from different ones
+)
+
+// RedactConfig lists what's secret in the decrypted payloads. Regular expressions with a capturing group
+// only mask the group, e.g. the token after "Bearer ".
+type RedactConfig struct {
+	Headers     []string `json:"headers"`      // Header names, case insensitive
+	QueryParams []string `json:"query_params"` // Parameters of URLs and form bodies, case insensitive
+	JSONPaths   []string `json:"json_paths"`   // Dot separated keys from the root of JSON bodies, "*" matching one key and "**" any number
+	Patterns    []string `json:"patterns"`     // Regular expressions matched anywhere
+	Mask        string   `json:"mask"`         // fixed, stars or hash
+	Replacement string   `json:"replacement"`  // Replacement text of the fixed mask
+}
+
+var defaultRedactConfig = RedactConfig{
+	Headers: []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		"X-Api-Key", "X-Auth-Token", "X-Csrf-Token", "X-Amz-Security-Token",
+	},
+	QueryParams: []string{
+		"api_key", "apikey", "key", "token", "access_token", "refresh_token", "id_token",
+		"password", "passwd", "secret", "client_secret", "code", "signature",
+		"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+	},
+	JSONPaths: []string{
+		"**.password", "**.passwd", "**.secret", "**.client_secret", "**.api_key", "**.apiKey",
+		"**.access_token", "**.refresh_token", "**.id_token", "**.token", "**.tokens",
+	},
+	Patterns: []string{
+		`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`, // JWT
+		`(?i)\bbearer\s+([A-Za-z0-9._~+/-]+=*)`,
+		`(?i)\bbasic\s+([A-Za-z0-9+/]+=*)`,
+		`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`, // AWS access key ID
+		`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`,
+	},
+	Mask:        maskFixed,
+	Replacement: "[REDACTED]",
+}
+
+// LoadRedactConfig reads a JSON configuration, whose fields replace the ones of the default configuration
+func LoadRedactConfig(path string) (RedactConfig, error) {
+	config := defaultRedactConfig
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Redactor masks the secrets of decrypted payloads before they're output. A nil *Redactor masks nothing.
+type Redactor struct {
+	headers     *regexp.Regexp
+	queryParams *regexp.Regexp
+	jsonPaths   [][]string
+	jsonLeaves  *regexp.Regexp // Keys of the JSON paths, for bodies that can't be walked from their root
+	patterns    []*regexp.Regexp
+	mask        string
+	replacement string
+}
+
+func NewRedactor(config RedactConfig) (*Redactor, error) {
+	r := &Redactor{
+		mask:        config.Mask,
+		replacement: config.Replacement,
+	}
+	switch r.mask {
+	case maskFixed, maskStars, maskHash:
+	default:
+		return nil, fmt.Errorf("unknown mask %q, expected %s, %s or %s", r.mask, maskFixed, maskStars, maskHash)
+	}
+
+	if len(config.Headers) > 0 {
+		// Header lines, the value being masked
+		r.headers = regexp.MustCompile(`(?im)^(?:` + quoteAll(config.Headers) + `)[ \t]*:[ \t]*([^\r\n]*)`)
+	}
+	if len(config.QueryParams) > 0 {
+		// name=value pairs in URLs and form bodies
+		r.queryParams = regexp.MustCompile(`(?i)(?:^|[?&;\s])(?:` + quoteAll(config.QueryParams) + `)=([^&;#\s]*)`)
+	}
+
+	var leaves []string
+	for _, path := range config.JSONPaths {
+		keys := strings.Split(path, ".")
+		r.jsonPaths = append(r.jsonPaths, keys)
+		if leaf := keys[len(keys)-1]; leaf != "*" && leaf != "**" {
+			leaves = append(leaves, leaf)
+		}
+	}
+	if len(leaves) > 0 {
+		// "key": "value" or "key": scalar, the string possibly truncated
+		r.jsonLeaves = regexp.MustCompile(`"(?:` + quoteAll(leaves) + `)"\s*:\s*(?:"((?:[^"\\]|\\.)*)|([^\s",}\]]+))`)
+	}
+
+	for _, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %s", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// Redact returns data with its secrets masked as configured
+func (r *Redactor) Redact(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+	return r.replace(data, r.spans(data))
+}
+
+func (r *Redactor) RedactString(s string) string {
+	if r == nil {
+		return s
+	}
+	return string(r.Redact([]byte(s)))
+}
+
+// replace returns data with the secrets at spans masked as configured
+func (r *Redactor) replace(data []byte, spans [][2]int) []byte {
+	if len(spans) == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	prev := 0
+	for _, s := range spans {
+		out = append(out, data[prev:s[0]]...)
+		secret := data[s[0]:s[1]]
+		switch r.mask {
+		case maskStars:
+			out = append(out, bytes.Repeat([]byte{'*'}, len(secret))...)
+		case maskHash:
+			sum := sha256.Sum256(secret)
+			out = append(out, "[sha256:"+hex.EncodeToString(sum[:6])+"]"...)
+		default:
+			out = append(out, r.replacement...)
+		}
+		prev = s[1]
+	}
+	return append(out, data[prev:]...)
+}
+
+// starSpans overwrites the secrets at spans with '*', keeping the length of data whatever the configured mask,
+// for outputs whose sizes must stay right such as pcap files
+func starSpans(data []byte, spans [][2]int) {
+	for _, s := range spans {
+		for i := s[0]; i < s[1]; i++ {
+			data[i] = '*'
+		}
+	}
+}
+
+// Most bytes of an unfinished line kept for the next event of a connection
+const redactCarryMax = 4096
+
+type redactStreamKey struct {
+	Pid    uint32
+	SSL    uint64
+	Egress bool
+}
+
+type redactCarry struct {
+	line         []byte
+	lastActivity uint64
+}
+
+// RedactStream redacts the events of each connection and direction as a stream: an SSL call can end in the
+// middle of a header or JSON value, so the line the previous event ended in is prepended before looking for
+// secrets, and the part of them in the new event is masked too.
+type RedactStream struct {
+	r         *Redactor
+	carries   map[redactStreamKey]*redactCarry
+	lastSweep uint64
+}
+
+// NewRedactStream returns nil for a nil Redactor, which redacts nothing
+func NewRedactStream(r *Redactor) *RedactStream {
+	if r == nil {
+		return nil
+	}
+	return &RedactStream{
+		r:       r,
+		carries: make(map[redactStreamKey]*redactCarry),
+	}
+}
+
+// Redact returns the payload of the event with its secrets masked as configured, and overwrites them with '*'
+// in the event itself, keeping its length for the pcap file. Each event of a connection must be given in order.
+func (s *RedactStream) Redact(event *bpfSslDataEventT) []byte {
+	data := event.Buf[:event.Len]
+	if s == nil {
+		return data
+	}
+	s.sweep(event.TimestampNs)
+	k := redactStreamKey{Pid: event.Pid, SSL: event.Ssl, Egress: event.Egress != 0}
+	if event.Ret <= 0 {
+		delete(s.carries, k)
+		return data
+	}
+
+	var carried []byte
+	if c := s.carries[k]; c != nil {
+		carried = c.line
+	}
+	// Bytes lost past the captured ones break the stream, the next event not continuing this one
+	spans := s.streamSpans(k, carried, data, event.TimestampNs, uint64(event.Ret) == uint64(event.Len))
+
+	payload := s.r.replace(data, spans)
+	starSpans(data, spans)
+	return payload
+}
+
+// streamSpans returns the spans of the secrets of data, a continuation of carried, and keeps the last line
+// of both when keep is set
+func (s *RedactStream) streamSpans(k redactStreamKey, carried, data []byte, now uint64, keep bool) [][2]int {
+	stream := make([]byte, 0, len(carried)+len(data))
+	stream = append(append(stream, carried...), data...)
+
+	var spans [][2]int
+	for _, sp := range s.r.spans(stream) {
+		if sp[1] <= len(carried) {
+			continue
+		}
+		spans = append(spans, [2]int{max(sp[0]-len(carried), 0), sp[1] - len(carried)})
+	}
+
+	line := stream[bytes.LastIndexByte(stream, '\n')+1:]
+	if len(line) > redactCarryMax {
+		line = line[len(line)-redactCarryMax:]
+	}
+	if !keep || len(line) == 0 {
+		delete(s.carries, k)
+	} else {
+		s.carries[k] = &redactCarry{line: line, lastActivity: now}
+	}
+	return spans
+}
+
+// sweep forgets the lines of idle connections, after as long as HTTPTracker does
+func (s *RedactStream) sweep(now uint64) {
+	if now-s.lastSweep < uint64(httpSweepInterval) {
+		return
+	}
+	s.lastSweep = now
+	for k, c := range s.carries {
+		if now-c.lastActivity >= uint64(httpIdleTimeout) {
+			delete(s.carries, k)
+		}
+	}
+}
+
+// spans returns the sorted, non overlapping byte ranges of the secrets of data
+func (r *Redactor) spans(data []byte) [][2]int {
+	var spans [][2]int
+	addMatches := func(re *regexp.Regexp, from int) {
+		if re == nil {
+			return
+		}
+		for _, m := range re.FindAllSubmatchIndex(data[from:], -1) {
+			// The first group that matched, or the whole match
+			start, end := m[0], m[1]
+			for g := 2; g < len(m); g += 2 {
+				if m[g] >= 0 {
+					start, end = m[g], m[g+1]
+					break
+				}
+			}
+			if end > start {
+				spans = append(spans, [2]int{from + start, from + end})
+			}
+		}
+	}
+
+	addMatches(r.headers, 0)
+	addMatches(r.queryParams, 0)
+	for _, re := range r.patterns {
+		addMatches(re, 0)
+	}
+
+	// JSON bodies are walked from their root when it's in data, the keys of the paths are
+	// looked for in what couldn't be walked
+	if len(r.jsonPaths) > 0 {
+		body := 0
+		if isHTTPStart(data) {
+			if end := bytes.Index(data, []byte("\r\n\r\n")); end != -1 {
+				body = end + 4
+			}
+		}
+		root := bytes.IndexAny(data[body:], "{[")
+		if root == -1 {
+			addMatches(r.jsonLeaves, body)
+		} else {
+			root += body
+			jsonSpans, walked := r.jsonSpans(data[root:])
+			for _, s := range jsonSpans {
+				spans = append(spans, [2]int{root + s[0], root + s[1]})
+			}
+			if r.jsonLeaves != nil {
+				for _, m := range r.jsonLeaves.FindAllSubmatchIndex(data[body:root], -1) {
+					spans = append(spans, leafSpan(m, body))
+				}
+				addMatches(r.jsonLeaves, root+walked)
+			}
+		}
+	}
+
+	return mergeSpans(spans)
+}
+
+func leafSpan(m []int, offset int) [2]int {
+	if m[2] >= 0 {
+		return [2]int{offset + m[2], offset + m[3]}
+	}
+	return [2]int{offset + m[4], offset + m[5]}
+}
+
+func mergeSpans(spans [][2]int) [][2]int {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s[0] <= merged[n-1][1] {
+			merged[n-1][1] = max(merged[n-1][1], s[1])
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// jsonFrame is an object or array being walked
+type jsonFrame struct {
+	object    bool
+	key       string
+	expectKey bool
+}
+
+// jsonSpans walks the JSON document at the start of data, returning the values whose path matches a rule
+// and how many bytes could be walked, a truncated document being walked as far as it goes.
+// Arrays don't add to the path, their elements having the path of the array.
+func (r *Redactor) jsonSpans(data []byte) ([][2]int, int) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var spans [][2]int
+	var stack []jsonFrame
+	masking := 0 // Depth of the object or array being masked as a whole, 0 if none
+	maskStart := 0
+
+	for {
+		before := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			if masking > 0 {
+				// The rest of the masked value was truncated
+				spans = append(spans, [2]int{maskStart, len(data)})
+				return spans, len(data)
+			}
+			if n := len(stack); n > 0 && stack[n-1].object && !stack[n-1].expectKey && r.matchesJSONPath(stack) {
+				// The value of a key to mask was truncated
+				start := before
+				for start < len(data) && strings.IndexByte(" \t\r\n:\"", data[start]) != -1 {
+					start++
+				}
+				spans = append(spans, [2]int{start, len(data)})
+				return spans, len(data)
+			}
+			return spans, before
+		}
+		end := int(dec.InputOffset())
+		start := before
+		for start < end && strings.IndexByte(" \t\r\n:,", data[start]) != -1 {
+			start++
+		}
+
+		var parent *jsonFrame
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+		if parent != nil && parent.object && parent.expectKey {
+			if key, ok := tok.(string); ok {
+				parent.key = key
+				parent.expectKey = false
+				continue
+			}
+		}
+
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if masking > len(stack) {
+				spans = append(spans, [2]int{maskStart, end})
+				masking = 0
+			}
+		} else {
+			if masking == 0 && r.matchesJSONPath(stack) {
+				if isDelim {
+					masking = len(stack) + 1
+					maskStart = start
+				} else if _, ok := tok.(string); ok {
+					spans = append(spans, [2]int{start + 1, end - 1})
+				} else {
+					spans = append(spans, [2]int{start, end})
+				}
+			}
+			if isDelim {
+				stack = append(stack, jsonFrame{object: delim == '{', expectKey: delim == '{'})
+				continue
+			}
+		}
+
+		// A value was completed, the enclosing object expects the next key
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].expectKey = true
+		}
+		if len(stack) == 0 {
+			return spans, end
+		}
+	}
+}
+
+// matchesJSONPath tells whether the value about to be read in the innermost frame of stack matches a rule
+func (r *Redactor) matchesJSONPath(stack []jsonFrame) bool {
+	var path []string
+	for _, f := range stack {
+		if f.object {
+			path = append(path, f.key)
+		}
+	}
+	if len(path) == 0 {
+		return false
+	}
+	for _, rule := range r.jsonPaths {
+		if matchPath(rule, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(rule, path []string) bool {
+	if len(rule) == 0 {
+		return len(path) == 0
+	}
+	if rule[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchPath(rule[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (rule[0] != "*" && !strings.EqualFold(rule[0], path[0])) {
+		return false
+	}
+	return matchPath(rule[1:], path[1:])
+}
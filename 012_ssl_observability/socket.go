@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketInfo is the socket an SSL* is bound to, as read by the eBPF program when the data went through
+type SocketInfo struct {
+	Fd     int32 // -1 if SSL_set_fd or SSL_set_bio weren't seen
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+}
+
+func NewSocketInfo(e *bpfSslDataEventT) SocketInfo {
+	return socketInfo(e.Fd, e.Family, e.Lport, e.Rport, e.Laddr, e.Raddr)
+}
+
+// socketInfo builds a SocketInfo from the socket fields the eBPF programs fill in their events
+func socketInfo(fd int32, family, lport, rport uint16, laddr, raddr [16]uint8) SocketInfo {
+	s := SocketInfo{Fd: fd}
+	switch family {
+	case unix.AF_INET:
+		s.Local = netip.AddrPortFrom(netip.AddrFrom4([4]byte(laddr[:4])), lport)
+		s.Remote = netip.AddrPortFrom(netip.AddrFrom4([4]byte(raddr[:4])), rport)
+	case unix.AF_INET6:
+		// IPv4 clients of IPv6 sockets show up as ::ffff:a.b.c.d
+		s.Local = netip.AddrPortFrom(netip.AddrFrom16(laddr).Unmap(), lport)
+		s.Remote = netip.AddrPortFrom(netip.AddrFrom16(raddr).Unmap(), rport)
+	}
+	return s
+}
+
+// String prints e.g. "fd: 5 10.0.0.2:51234 -> 93.184.216.34:443"
+func (s SocketInfo) String() string {
+	if s.Fd < 0 {
+		return "fd: ?"
+	}
+	if !s.Local.IsValid() {
+		return fmt.Sprintf("fd: %d", s.Fd)
+	}
+	return fmt.Sprintf("fd: %d %s -> %s", s.Fd, s.Local, s.Remote)
+}
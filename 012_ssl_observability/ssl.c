@@ -10,42 +10,241 @@ struct {
     __uint(max_entries, 16777216);
 } ssl_data_event_map SEC(".maps");
 
-// Used to pass data from the SSL_read_entry to exit
+// Used to pass data from the SSL_read/SSL_read_ex entry to exit. Keyed by thread, since a thread
+// can be preempted or migrate to another CPU, and other threads can run SSL_read in between.
 struct {
-    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, struct ssl_read_data);
+} ssl_read_data_map SEC(".maps");
+
+// Used to pass data from the SSL_write_ex entry to exit
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, struct ssl_write_ex_data);
+} ssl_write_ex_data_map SEC(".maps");
+
+// File descriptor of each SSL*, set by SSL_set_fd or SSL_set_bio with a socket BIO
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct ssl_key);
+    __type(value, s32);
+} ssl_fd_map SEC(".maps");
+
+// File descriptor of each socket BIO created by BIO_new_socket, until it's given to SSL_set_bio
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct ssl_key);
+    __type(value, s32);
+} bio_fd_map SEC(".maps");
+
+// Used to pass the fd from the BIO_new_socket entry to exit
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, s32);
+} bio_new_socket_map SEC(".maps");
+
+// Used to send the bytes of handshakes and their completion to user space
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 4194304);
+} ssl_handshake_event_map SEC(".maps");
+
+// Threads in SSL_do_handshake, whose socket reads and writes are the handshake messages
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, struct ssl_handshake_data);
+} ssl_handshake_map SEC(".maps");
+
+// SSL* whose handshake was reported, so that it isn't reported again by their next SSL_read or SSL_write
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, struct ssl_key);
+    __type(value, u8);
+} ssl_reported_map SEC(".maps");
+
+// Layouts of the SSL libraries found by user space, indexed by the cookie of their uprobes, 0 meaning unknown
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_SSL_LAYOUTS);
+    __type(key, u32);
+    __type(value, struct ssl_layout);
+} ssl_layout_map SEC(".maps");
+
+// Used to pass the buffer from the read/write syscall entry to exit, for threads in a handshake
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, struct handshake_io_data);
+} handshake_io_map SEC(".maps");
+
+// Used to send the execs, executable mappings and exits of processes to user space, which attaches
+// the probes to the TLS libraries they load
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 262144);
+} process_event_map SEC(".maps");
+
+// Used to pass the name of the mapped file from the mmap entry to exit
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u64); // pid_tgid
+    __type(value, struct process_event_t);
+} mmap_map SEC(".maps");
+
+// Used to read the prefilters of user space, a single entry
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
     __uint(max_entries, 1);
     __type(key, u32);
+    __type(value, struct filter_config);
+} filter_config_map SEC(".maps");
+
+// Processes traced when filter_config.pids is set
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, u32); // pid
+    __type(value, u8);
+} filter_pid_map SEC(".maps");
+
+// Commands traced when filter_config.comms is set
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, struct comm_key);
+    __type(value, u8);
+} filter_comm_map SEC(".maps");
+
+// Returns whether the current process passes the pid and command prefilters
+static __always_inline int process_traced() {
+    u32 zero = 0;
+    struct filter_config *config = bpf_map_lookup_elem(&filter_config_map, &zero);
+    if (!config) {
+        return 1;
+    }
+    if (config->pids) {
+        u32 pid = bpf_get_current_pid_tgid() >> 32;
+        if (!bpf_map_lookup_elem(&filter_pid_map, &pid)) {
+            return 0;
+        }
+    }
+    if (config->comms) {
+        struct comm_key key = {};
+        bpf_get_current_comm(&key.comm, sizeof(key.comm));
+        if (!bpf_map_lookup_elem(&filter_comm_map, &key)) {
+            return 0;
+        }
+    }
+    return 1;
+}
+
+// Returns the file of a file descriptor of the current task, NULL if there's none
+static __always_inline struct file *fd_file(s32 fd) {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct fdtable *fdt = BPF_CORE_READ(task, files, fdt);
+    u32 max_fds = BPF_CORE_READ(fdt, max_fds);
+    if (fd < 0 || fd >= max_fds) {
+        return NULL;
+    }
+    struct file **fds = BPF_CORE_READ(fdt, fd);
+    struct file *file = NULL;
+    bpf_probe_read_kernel(&file, sizeof(file), &fds[fd]);
+    return file;
+}
+
+// Returns the sock of a file descriptor of the current task, NULL if it isn't a socket
+static __always_inline struct sock *fd_sock(s32 fd) {
+    struct file *file = fd_file(fd);
+    if (!file || (BPF_CORE_READ(file, f_inode, i_mode) & S_IFMT) != S_IFSOCK) {
+        return NULL;
+    }
+    struct socket *sock = BPF_CORE_READ(file, private_data);
+    return BPF_CORE_READ(sock, sk);
+}
+
+// Fills the fd, family, addresses and ports of the socket the SSL* is bound to into e,
+// which can be any event with these fields
+#define read_ssl_socket(ssl, e) ({                                                          \
+    (e)->fd = -1;                                                                           \
+    (e)->family = 0;                                                                        \
+    struct ssl_key __k = {};                                                                \
+    __k.ptr = (ssl);                                                                        \
+    __k.pid = bpf_get_current_pid_tgid() >> 32;                                             \
+    s32 *__fd = bpf_map_lookup_elem(&ssl_fd_map, &__k);                                     \
+    struct sock *__sk = NULL;                                                               \
+    if (__fd) {                                                                             \
+        (e)->fd = *__fd;                                                                    \
+        __sk = fd_sock(*__fd);                                                              \
+    }                                                                                       \
+    u16 __family = __sk ? BPF_CORE_READ(__sk, __sk_common.skc_family) : 0;                  \
+    if (__family == AF_INET) {                                                              \
+        bpf_core_read(&(e)->laddr, sizeof(u32), &__sk->__sk_common.skc_rcv_saddr);          \
+        bpf_core_read(&(e)->raddr, sizeof(u32), &__sk->__sk_common.skc_daddr);              \
+    } else if (__family == AF_INET6) {                                                      \
+        BPF_CORE_READ_INTO(&(e)->laddr, __sk, __sk_common.skc_v6_rcv_saddr);                \
+        BPF_CORE_READ_INTO(&(e)->raddr, __sk, __sk_common.skc_v6_daddr);                    \
+    }                                                                                       \
+    if (__family == AF_INET || __family == AF_INET6) {                                      \
+        (e)->family = __family;                                                             \
+        (e)->lport = BPF_CORE_READ(__sk, __sk_common.skc_num);                              \
+        (e)->rport = bpf_ntohs(BPF_CORE_READ(__sk, __sk_common.skc_dport));                 \
+    }                                                                                       \
+})
+
+// Used to pass data from the Go crypto/tls (*Conn).Read entry to its RET instructions. Keyed by goroutine,
+// since the goroutine can be parked while reading and resumed on another thread. A Read that panics
+// never reaches a RET to delete its entry, so the oldest are evicted.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 10240);
+    __type(key, struct ssl_key); // g, pid
     __type(value, struct ssl_read_data);
-} ssl_read_data_map SEC(".maps");
+} go_tls_read_map SEC(".maps");
 
-SEC("uprobe/SSL_write")
-int uprobe_libssl_write(struct pt_regs *ctx) {
-    void* buf = (void *) PT_REGS_PARM2(ctx);
-    u64 size =  PT_REGS_PARM3(ctx);
+// Copies the plaintext buffer into the ring buffer
+static __always_inline int submit_ssl_data(u64 ssl, char *buf, u64 size, char egress) {
+    // Sanity check there's data in buffer
+    if (size == 0) {
+        return 0;
+    }
+    if (!process_traced()) {
+        return 0;
+    }
 
-    u32 map_id = 0;
     // reserve/commit ring buffer API
     struct ssl_data_event_t* map_value = bpf_ringbuf_reserve(&ssl_data_event_map, sizeof(struct ssl_data_event_t), 0);
     if (!map_value) {
-	    return 0; 
-    }
-    
-    // Sanity check there's data in buffer 
-    // otherwise discard the reserved memory in ring buffer
-    if (size == 0) { 
-        bpf_ringbuf_discard(map_value, 0);
-        return 0;
+	    return 0;
     }
 
-    // Store the PID and payload size
-    map_value->pid = bpf_get_current_pid_tgid() >> 32;
-    map_value->len = size;
-    map_value->egress = 1;
-	
+    // Store the process and thread that triggered this hook, its connection and the direction of the message
+    u64 id = bpf_get_current_pid_tgid();
+    map_value->timestamp_ns = bpf_ktime_get_ns();
+    map_value->ssl = ssl;
+    map_value->pid = id >> 32;
+    map_value->tid = id;
+    map_value->ret = size;
+    map_value->egress = egress;
+    read_ssl_socket(ssl, map_value);
+
     u32 buf_size = MAX_BUF_SIZE;
     if (size < buf_size) {
 	    buf_size = size;
     }
+    map_value->len = buf_size;
 
     // Read data from the buffer
     if (bpf_probe_read_user(map_value->buf, buf_size, buf) != 0) {
@@ -53,82 +252,715 @@ int uprobe_libssl_write(struct pt_regs *ctx) {
         return 0;
     }
 
-    // Based on the data in buffer, determine the type of HTTP Method
-    u32 method = parse_http_method((char*)buf);
-    if (method == -1) {
-    	bpf_printk("Failed to parse HTTP method");
+    // Submit the event to user space
+    bpf_ringbuf_submit(map_value, 0);
+
+    return 0;
+}
+
+// Reports a failed SSL call, ret being its return value
+static __always_inline int submit_ssl_error(u64 ssl, s32 ret, char egress) {
+    if (!process_traced()) {
+        return 0;
     }
-    bpf_printk("HTTP Method ID: %d", method);
 
-    // Submit the event to user space
+    struct ssl_data_event_t* map_value = bpf_ringbuf_reserve(&ssl_data_event_map, sizeof(struct ssl_data_event_t), 0);
+    if (!map_value) {
+	    return 0;
+    }
+
+    u64 id = bpf_get_current_pid_tgid();
+    map_value->timestamp_ns = bpf_ktime_get_ns();
+    map_value->ssl = ssl;
+    map_value->pid = id >> 32;
+    map_value->tid = id;
+    map_value->len = 0;
+    map_value->ret = ret;
+    map_value->egress = egress;
+    read_ssl_socket(ssl, map_value);
+
     bpf_ringbuf_submit(map_value, 0);
 
     return 0;
 }
 
-SEC("uprobe/SSL_read")
-int uprobe_libssl_read(struct pt_regs *ctx) {
-    u32 zero = 0;
-    struct ssl_read_data *data = bpf_map_lookup_elem(&ssl_read_data_map, &zero);
+// NSPR's PR_Write/PR_Read are used for every kind of file, so only layered descriptors are traced.
+// PRFileDesc starts with its PRIOMethods, which start with the descriptor type.
+static __always_inline int is_nspr_layered(u64 fd) {
+    u64 methods = 0;
+    if (bpf_probe_read_user(&methods, sizeof(methods), (void *)fd) != 0 || !methods) {
+        return 0;
+    }
+    s32 file_type = 0;
+    if (bpf_probe_read_user(&file_type, sizeof(file_type), (void *)methods) != 0) {
+        return 0;
+    }
+    return file_type == PR_DESC_LAYERED;
+}
+
+// Returns the layout of the library the uprobe is attached to, NULL if unknown
+static __always_inline struct ssl_layout *get_ssl_layout(struct pt_regs *ctx) {
+    u32 cookie = bpf_get_attach_cookie(ctx);
+    if (!cookie) {
+        return NULL;
+    }
+    return bpf_map_lookup_elem(&ssl_layout_map, &cookie);
+}
+
+// Fills the fields of the event that SSL_version, SSL_get_current_cipher, SSL_is_server, SSL_get0_alpn_selected and
+// SSL_get_servername would return for the SSL*
+static __always_inline void read_ssl_params(struct ssl_layout *layout, u64 ssl, struct ssl_handshake_event_t *e) {
+    e->version = 0;
+    e->cipher = 0;
+    e->server = -1;
+    e->alpn_len = 0;
+    e->server_name[0] = 0;
+    if (!layout) {
+        return;
+    }
+
+    s32 value = 0;
+    if (layout->version >= 0 && bpf_probe_read_user(&value, sizeof(value), (void *)(ssl + layout->version)) == 0) {
+        e->version = value;
+    }
+    if (layout->server >= 0 && bpf_probe_read_user(&value, sizeof(value), (void *)(ssl + layout->server)) == 0) {
+        e->server = value != 0;
+    }
+    u64 session = 0, cipher = 0;
+    if (layout->session >= 0 && layout->cipher >= 0 && layout->cipher_id >= 0) {
+        bpf_probe_read_user(&session, sizeof(session), (void *)(ssl + layout->session));
+        if (session) {
+            bpf_probe_read_user(&cipher, sizeof(cipher), (void *)(session + layout->cipher));
+        }
+        if (cipher) {
+            bpf_probe_read_user(&e->cipher, sizeof(e->cipher), (void *)(cipher + layout->cipher_id));
+        }
+    }
+    u64 alpn = 0;
+    u32 alpn_len = 0;
+    if (layout->alpn >= 0 && layout->alpn_len >= 0) {
+        bpf_probe_read_user(&alpn, sizeof(alpn), (void *)(ssl + layout->alpn));
+        bpf_probe_read_user(&alpn_len, sizeof(alpn_len), (void *)(ssl + layout->alpn_len));
+    }
+    if (alpn && alpn_len > 0 && alpn_len <= MAX_ALPN_SIZE &&
+        bpf_probe_read_user(e->alpn, alpn_len, (void *)alpn) == 0) {
+        e->alpn_len = alpn_len;
+    }
+    u64 hostname = 0;
+    if (layout->hostname >= 0) {
+        bpf_probe_read_user(&hostname, sizeof(hostname), (void *)(ssl + layout->hostname));
+    }
+    if (hostname) {
+        bpf_probe_read_user_str(e->server_name, sizeof(e->server_name), (void *)hostname);
+    }
+}
+
+// Reports the end of the handshake the thread is in, ret being 1 once it's done and <= 0 on failure or when
+// a non-blocking socket isn't ready
+static __always_inline int submit_handshake_done(struct pt_regs *ctx, s32 ret) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_handshake_data *data = bpf_map_lookup_elem(&ssl_handshake_map, &id);
     if (!data) {
         return 0;
     }
-	
-    // Store buffer and size into map passed to the read/exit function 
-    data->buf = PT_REGS_PARM2(ctx);
-    data->len = PT_REGS_PARM3(ctx);
+    u64 ssl = data->ssl;
+    u64 start_ns = data->start_ns;
+    bpf_map_delete_elem(&ssl_handshake_map, &id);
+
+    struct ssl_key k = {};
+    k.ptr = ssl;
+    k.pid = id >> 32;
+    if (ret == 1) {
+        u8 one = 1;
+        bpf_map_update_elem(&ssl_reported_map, &k, &one, BPF_ANY);
+    }
+
+    struct ssl_handshake_event_t *e = bpf_ringbuf_reserve(&ssl_handshake_event_map, sizeof(struct ssl_handshake_event_t), 0);
+    if (!e) {
+        return 0;
+    }
+    e->timestamp_ns = bpf_ktime_get_ns();
+    e->start_ns = start_ns;
+    e->ssl = ssl;
+    e->pid = id >> 32;
+    e->tid = id;
+    e->len = 0;
+    e->ret = ret;
+    e->type = HANDSHAKE_EVENT_DONE;
+    e->egress = 0;
+    read_ssl_socket(ssl, e);
+    read_ssl_params(get_ssl_layout(ctx), ssl, e);
+
+    bpf_ringbuf_submit(e, 0);
 
     return 0;
 }
 
+// Follows the handshake of an SSL* that SSL_read or SSL_write runs, when the application didn't call SSL_do_handshake
+// but SSL_set_connect_state or SSL_set_accept_state. Their first call completing is reported as the end of the
+// handshake, also for the connections established before the tracer started.
+static __always_inline void implicit_handshake_enter(struct pt_regs *ctx, u64 ssl) {
+    if (!get_ssl_layout(ctx) || !process_traced()) {
+        return;
+    }
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_key k = {};
+    k.ptr = ssl;
+    k.pid = id >> 32;
+    if (bpf_map_lookup_elem(&ssl_reported_map, &k)) {
+        return;
+    }
+
+    struct ssl_handshake_data data = {};
+    data.ssl = ssl;
+    data.start_ns = bpf_ktime_get_ns();
+    bpf_map_update_elem(&ssl_handshake_map, &id, &data, BPF_ANY);
+}
+
+// int SSL_write(SSL *ssl, const void *buf, int num)
+// Also attached to GnuTLS: ssize_t gnutls_record_send(gnutls_session_t session, const void *data, size_t data_size)
+SEC("uprobe/SSL_write")
+int uprobe_libssl_write(struct pt_regs *ctx) {
+    u64 ssl = PT_REGS_PARM1(ctx);
+    void* buf = (void *) PT_REGS_PARM2(ctx);
+    u64 size =  PT_REGS_PARM3(ctx);
+
+    implicit_handshake_enter(ctx, ssl);
+    return submit_ssl_data(ssl, buf, size, 1);
+}
+
+SEC("uretprobe/SSL_write")
+int uretprobe_libssl_write(struct pt_regs *ctx) {
+    s32 ret = PT_REGS_RC(ctx);
+    return submit_handshake_done(ctx, ret > 0 ? 1 : ret);
+}
+
+// int SSL_write_ex(SSL *s, const void *buf, size_t num, size_t *written)
+SEC("uprobe/SSL_write_ex")
+int uprobe_libssl_write_ex(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+
+    // Store buffer and the pointer to the written size into map passed to the write_ex/exit function
+    struct ssl_write_ex_data data = {};
+    data.ssl = PT_REGS_PARM1(ctx);
+    data.buf = PT_REGS_PARM2(ctx);
+    data.written = PT_REGS_PARM4(ctx);
+    bpf_map_update_elem(&ssl_write_ex_data_map, &id, &data, BPF_ANY);
+
+    implicit_handshake_enter(ctx, data.ssl);
+    return 0;
+}
+
+SEC("uretprobe/SSL_write_ex")
+int uretprobe_libssl_write_ex(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_write_ex_data *data = bpf_map_lookup_elem(&ssl_write_ex_data_map, &id);
+    if (!data) {
+        return 0;
+    }
+
+    u64 ssl = data->ssl;
+    char *buf = (char *)data->buf;
+    u64 written_ptr = data->written;
+    bpf_map_delete_elem(&ssl_write_ex_data_map, &id);
+
+    // SSL_write_ex returns 1 on success, the number of bytes written is stored in *written
+    s32 ret = PT_REGS_RC(ctx);
+    submit_handshake_done(ctx, ret == 1 ? 1 : -1);
+    if (ret != 1) {
+        return submit_ssl_error(ssl, ret, 1);
+    }
+    size_t written = 0;
+    if (!written_ptr || bpf_probe_read_user(&written, sizeof(written), (void *)written_ptr) != 0) {
+        return 0;
+    }
+
+    return submit_ssl_data(ssl, buf, written, 1);
+}
+
+// int SSL_read(SSL *ssl, void *buf, int num)
+// Also attached to GnuTLS: ssize_t gnutls_record_recv(gnutls_session_t session, void *data, size_t data_size)
+SEC("uprobe/SSL_read")
+int uprobe_libssl_read(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+
+    // Store buffer and size into map passed to the read/exit function
+    struct ssl_read_data data = {};
+    data.ssl = PT_REGS_PARM1(ctx);
+    data.buf = PT_REGS_PARM2(ctx);
+    data.len = PT_REGS_PARM3(ctx);
+    bpf_map_update_elem(&ssl_read_data_map, &id, &data, BPF_ANY);
+
+    implicit_handshake_enter(ctx, data.ssl);
+    return 0;
+}
+
 SEC("uretprobe/SSL_read")
 int uretprobe_libssl_read(struct pt_regs *ctx) {
-    // Get the buffer and size from the read/entry
-    u32 zero = 0;
-    struct ssl_read_data *data = bpf_map_lookup_elem(&ssl_read_data_map, &zero);
+    // Get the buffer and size from the read/entry of this thread
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_read_data *data = bpf_map_lookup_elem(&ssl_read_data_map, &id);
     if (!data) {
         return 0;
-    }	
+    }
+    u64 ssl = data->ssl;
+    char *buf = (char *)data->buf;
+    bpf_map_delete_elem(&ssl_read_data_map, &id);
 
-    u32 map_id = 0;
-    struct ssl_data_event_t* map_value = bpf_ringbuf_reserve(&ssl_data_event_map, sizeof(struct ssl_data_event_t), 0);
-    if (!map_value) {
-	    return 0; 
+    // SSL_read returns the number of bytes read, or <= 0 on failure
+    s32 ret = PT_REGS_RC(ctx);
+    submit_handshake_done(ctx, ret > 0 ? 1 : ret);
+    if (ret <= 0) {
+        return submit_ssl_error(ssl, ret, 0);
     }
 
-    // Store the PID of the process that triggered this hook and 
-    // indicate this is an incoming/ingress message
-    map_value->pid = bpf_get_current_pid_tgid() >> 32;
-    map_value->egress = 0;
-	
-    // Sanity check there's data in buffer 
-    u64 size = PT_REGS_RC(ctx);
-    if (size == 0) { 
-        bpf_ringbuf_discard(map_value, 0);
+    return submit_ssl_data(ssl, buf, ret, 0);
+}
+
+// int SSL_read_ex(SSL *ssl, void *buf, size_t num, size_t *readbytes)
+SEC("uprobe/SSL_read_ex")
+int uprobe_libssl_read_ex(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+
+    // Store buffer, size and the pointer to the read size into map passed to the read_ex/exit function
+    struct ssl_read_data data = {};
+    data.ssl = PT_REGS_PARM1(ctx);
+    data.buf = PT_REGS_PARM2(ctx);
+    data.len = PT_REGS_PARM3(ctx);
+    data.readbytes = PT_REGS_PARM4(ctx);
+    bpf_map_update_elem(&ssl_read_data_map, &id, &data, BPF_ANY);
+
+    implicit_handshake_enter(ctx, data.ssl);
+    return 0;
+}
+
+SEC("uretprobe/SSL_read_ex")
+int uretprobe_libssl_read_ex(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_read_data *data = bpf_map_lookup_elem(&ssl_read_data_map, &id);
+    if (!data) {
         return 0;
     }
-	
-    u32 buf_size = MAX_BUF_SIZE;
-    if (size < buf_size) {
-	    buf_size = size;
+    u64 ssl = data->ssl;
+    char *buf = (char *)data->buf;
+    u64 readbytes_ptr = data->readbytes;
+    bpf_map_delete_elem(&ssl_read_data_map, &id);
+
+    // SSL_read_ex returns 1 on success, the number of bytes read is stored in *readbytes
+    s32 ret = PT_REGS_RC(ctx);
+    submit_handshake_done(ctx, ret == 1 ? 1 : -1);
+    if (ret != 1) {
+        return submit_ssl_error(ssl, ret, 0);
     }
-    map_value->len = buf_size;
+    size_t readbytes = 0;
+    if (!readbytes_ptr || bpf_probe_read_user(&readbytes, sizeof(readbytes), (void *)readbytes_ptr) != 0) {
+        return 0;
+    }
+
+    return submit_ssl_data(ssl, buf, readbytes, 0);
+}
+
+// int SSL_set_fd(SSL *ssl, int fd)
+SEC("uprobe/SSL_set_fd")
+int uprobe_libssl_set_fd(struct pt_regs *ctx) {
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_PARM1(ctx);
+    k.pid = bpf_get_current_pid_tgid() >> 32;
+    s32 fd = PT_REGS_PARM2(ctx);
+    bpf_map_update_elem(&ssl_fd_map, &k, &fd, BPF_ANY);
+    // A new socket is a new connection, whose handshake is reported
+    bpf_map_delete_elem(&ssl_reported_map, &k);
+
+    return 0;
+}
+
+// BIO *BIO_new_socket(int sock, int close_flag)
+SEC("uprobe/BIO_new_socket")
+int uprobe_libssl_bio_new_socket(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    s32 fd = PT_REGS_PARM1(ctx);
+    bpf_map_update_elem(&bio_new_socket_map, &id, &fd, BPF_ANY);
+
+    return 0;
+}
 
-    // Based on the data in buffer, determine the HTTP status
-    u32 http_status = parse_http_status((char*)data->buf);
-    if (http_status == -1) {
-    	bpf_printk("Failed to parse HTTP status");
+SEC("uretprobe/BIO_new_socket")
+int uretprobe_libssl_bio_new_socket(struct pt_regs *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    s32 *fd = bpf_map_lookup_elem(&bio_new_socket_map, &id);
+    if (!fd) {
+        return 0;
     }
-    bpf_printk("HTTP STATUS CODE: %d", http_status);
+    s32 sock = *fd;
+    bpf_map_delete_elem(&bio_new_socket_map, &id);
 
-    // "Transfer" data buffer from one map to another
-    if (bpf_probe_read_user(map_value->buf, buf_size, (char*)data->buf) != 0) {
-        bpf_ringbuf_discard(map_value, 0);
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_RC(ctx);
+    k.pid = id >> 32;
+    if (!k.ptr) {
         return 0;
     }
+    bpf_map_update_elem(&bio_fd_map, &k, &sock, BPF_ANY);
 
-    // Submit the event to the user space
-    bpf_ringbuf_submit(map_value, 0);
+    return 0;
+}
+
+// void SSL_set_bio(SSL *s, BIO *rbio, BIO *wbio)
+SEC("uprobe/SSL_set_bio")
+int uprobe_libssl_set_bio(struct pt_regs *ctx) {
+    u32 pid = bpf_get_current_pid_tgid() >> 32;
+
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_PARM1(ctx);
+    k.pid = pid;
+    bpf_map_delete_elem(&ssl_reported_map, &k);
+
+    struct ssl_key bio = {};
+    bio.ptr = PT_REGS_PARM2(ctx);
+    bio.pid = pid;
+    s32 *fd = bpf_map_lookup_elem(&bio_fd_map, &bio);
+    if (!fd) {
+        return 0;
+    }
+    bpf_map_update_elem(&ssl_fd_map, &k, fd, BPF_ANY);
+
+    return 0;
+}
+
+// func (c *Conn) Write(b []byte) (int, error)
+SEC("uprobe/go_tls_write")
+int uprobe_go_tls_write(struct pt_regs *ctx) {
+    // The *Conn is used as the SSL* of the connection
+    u64 conn = GO_PARAM1(ctx);
+    char *buf = (char *)GO_PARAM2(ctx);
+    u64 size = GO_PARAM3(ctx);
+
+    return submit_ssl_data(conn, buf, size, 1);
+}
+
+// func (c *Conn) Read(b []byte) (int, error)
+SEC("uprobe/go_tls_read")
+int uprobe_go_tls_read(struct pt_regs *ctx) {
+    struct ssl_key k = {};
+    k.ptr = GO_G(ctx);
+    k.pid = bpf_get_current_pid_tgid() >> 32;
+
+    struct ssl_read_data data = {};
+    data.ssl = GO_PARAM1(ctx);
+    data.buf = GO_PARAM2(ctx);
+    data.len = GO_PARAM3(ctx);
+    bpf_map_update_elem(&go_tls_read_map, &k, &data, BPF_ANY);
+
+    return 0;
+}
+
+// Attached to the RET instructions of (*Conn).Read, since uretprobes break Go's stack management
+SEC("uprobe/go_tls_read_ret")
+int uprobe_go_tls_read_ret(struct pt_regs *ctx) {
+    struct ssl_key k = {};
+    k.ptr = GO_G(ctx);
+    k.pid = bpf_get_current_pid_tgid() >> 32;
+    struct ssl_read_data *data = bpf_map_lookup_elem(&go_tls_read_map, &k);
+    if (!data) {
+        return 0;
+    }
+    u64 conn = data->ssl;
+    char *buf = (char *)data->buf;
+    bpf_map_delete_elem(&go_tls_read_map, &k);
+
+    // Results: n in the first register, the error interface (type, data) in the next two
+    s64 n = GO_PARAM1(ctx);
+    if (n > 0) {
+        return submit_ssl_data(conn, buf, n, 0);
+    }
+    if (GO_PARAM2(ctx) != 0) {
+        return submit_ssl_error(conn, 0, 0);
+    }
+
+    return 0;
+}
+
+// void gnutls_transport_set_int2(gnutls_session_t session, int recv_fd, int send_fd)
+SEC("uprobe/gnutls_transport_set_int2")
+int uprobe_gnutls_transport_set_int2(struct pt_regs *ctx) {
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_PARM1(ctx);
+    k.pid = bpf_get_current_pid_tgid() >> 32;
+    s32 fd = PT_REGS_PARM2(ctx);
+    bpf_map_update_elem(&ssl_fd_map, &k, &fd, BPF_ANY);
+
+    return 0;
+}
+
+// PRInt32 PR_Write(PRFileDesc *fd, const void *buf, PRInt32 amount)
+SEC("uprobe/PR_Write")
+int uprobe_nspr_write(struct pt_regs *ctx) {
+    u64 fd = PT_REGS_PARM1(ctx);
+    if (!is_nspr_layered(fd)) {
+        return 0;
+    }
+    void* buf = (void *) PT_REGS_PARM2(ctx);
+    s32 amount = PT_REGS_PARM3(ctx);
+    if (amount <= 0) {
+        return 0;
+    }
+
+    return submit_ssl_data(fd, buf, amount, 1);
+}
+
+// PRInt32 PR_Read(PRFileDesc *fd, void *buf, PRInt32 amount), returns through uretprobe_libssl_read
+SEC("uprobe/PR_Read")
+int uprobe_nspr_read(struct pt_regs *ctx) {
+    u64 fd = PT_REGS_PARM1(ctx);
+    if (!is_nspr_layered(fd)) {
+        return 0;
+    }
+    u64 id = bpf_get_current_pid_tgid();
+
+    struct ssl_read_data data = {};
+    data.ssl = fd;
+    data.buf = PT_REGS_PARM2(ctx);
+    data.len = PT_REGS_PARM3(ctx);
+    bpf_map_update_elem(&ssl_read_data_map, &id, &data, BPF_ANY);
+
+    return 0;
+}
+
+// int SSL_do_handshake(SSL *s), also attached to SSL_connect(SSL *ssl) and SSL_accept(SSL *ssl) which call it
+SEC("uprobe/SSL_do_handshake")
+int uprobe_libssl_do_handshake(struct pt_regs *ctx) {
+    if (!process_traced()) {
+        return 0;
+    }
+    u64 id = bpf_get_current_pid_tgid();
+
+    // Calls on established connections have nothing to report
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_PARM1(ctx);
+    k.pid = id >> 32;
+    if (bpf_map_lookup_elem(&ssl_reported_map, &k)) {
+        return 0;
+    }
+
+    struct ssl_handshake_data data = {};
+    data.ssl = k.ptr;
+    data.start_ns = bpf_ktime_get_ns();
+    bpf_map_update_elem(&ssl_handshake_map, &id, &data, BPF_ANY);
+
+    return 0;
+}
+
+// Finds nothing to report when SSL_connect and SSL_accept return, the nested SSL_do_handshake having reported it
+SEC("uretprobe/SSL_do_handshake")
+int uretprobe_libssl_do_handshake(struct pt_regs *ctx) {
+    return submit_handshake_done(ctx, PT_REGS_RC(ctx));
+}
+
+// void SSL_set_connect_state(SSL *s), also attached to SSL_set_accept_state(SSL *s) and SSL_clear(SSL *s), which
+// prepare the SSL* for a new handshake
+SEC("uprobe/SSL_set_connect_state")
+int uprobe_libssl_new_handshake(struct pt_regs *ctx) {
+    struct ssl_key k = {};
+    k.ptr = PT_REGS_PARM1(ctx);
+    k.pid = bpf_get_current_pid_tgid() >> 32;
+    bpf_map_delete_elem(&ssl_reported_map, &k);
+
+    return 0;
+}
+
+// Saves the buffer of a socket read or write made by a thread in a handshake
+static __always_inline int handshake_io_enter(struct trace_event_raw_sys_enter *ctx, char egress) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct ssl_handshake_data *hs = bpf_map_lookup_elem(&ssl_handshake_map, &id);
+    if (!hs) {
+        return 0;
+    }
+
+    s32 fd = ctx->args[0];
+    struct ssl_key k = {};
+    k.ptr = hs->ssl;
+    k.pid = id >> 32;
+    s32 *ssl_fd = bpf_map_lookup_elem(&ssl_fd_map, &k);
+    if (ssl_fd && *ssl_fd != fd) {
+        return 0;
+    }
+    if (!ssl_fd) {
+        // Sockets the library reads and writes during the handshake are the SSL* socket, which binds it
+        // when it wasn't seen through SSL_set_fd or SSL_set_bio
+        if (!fd_sock(fd)) {
+            return 0;
+        }
+        bpf_map_update_elem(&ssl_fd_map, &k, &fd, BPF_ANY);
+    }
+
+    struct handshake_io_data data = {};
+    data.buf = ctx->args[1];
+    data.fd = fd;
+    data.egress = egress;
+    bpf_map_update_elem(&handshake_io_map, &id, &data, BPF_ANY);
+
+    return 0;
+}
+
+// Copies the bytes that were read or written into the ring buffer
+static __always_inline int handshake_io_exit(struct trace_event_raw_sys_exit *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct handshake_io_data *data = bpf_map_lookup_elem(&handshake_io_map, &id);
+    if (!data) {
+        return 0;
+    }
+    char *buf = (char *)data->buf;
+    s32 fd = data->fd;
+    char egress = data->egress;
+    bpf_map_delete_elem(&handshake_io_map, &id);
+
+    struct ssl_handshake_data *hs = bpf_map_lookup_elem(&ssl_handshake_map, &id);
+    s64 ret = ctx->ret;
+    if (!hs || ret <= 0) {
+        return 0;
+    }
+
+    struct ssl_handshake_event_t *e = bpf_ringbuf_reserve(&ssl_handshake_event_map, sizeof(struct ssl_handshake_event_t), 0);
+    if (!e) {
+        return 0;
+    }
+    e->timestamp_ns = bpf_ktime_get_ns();
+    e->start_ns = hs->start_ns;
+    e->ssl = hs->ssl;
+    e->pid = id >> 32;
+    e->tid = id;
+    e->ret = ret;
+    e->fd = fd;
+    e->family = 0;
+    e->type = HANDSHAKE_EVENT_DATA;
+    e->egress = egress;
+
+    u32 buf_size = MAX_HANDSHAKE_SIZE;
+    if (ret < buf_size) {
+        buf_size = ret;
+    }
+    e->len = buf_size;
+    if (bpf_probe_read_user(e->buf, buf_size, buf) != 0) {
+        bpf_ringbuf_discard(e, 0);
+        return 0;
+    }
+    bpf_ringbuf_submit(e, 0);
+
+    return 0;
+}
+
+// OpenSSL socket BIOs use write/read, send/recv go through sendto/recvfrom
+SEC("tracepoint/syscalls/sys_enter_write")
+int tracepoint_sys_enter_write(struct trace_event_raw_sys_enter *ctx) {
+    return handshake_io_enter(ctx, 1);
+}
+
+SEC("tracepoint/syscalls/sys_exit_write")
+int tracepoint_sys_exit_write(struct trace_event_raw_sys_exit *ctx) {
+    return handshake_io_exit(ctx);
+}
+
+SEC("tracepoint/syscalls/sys_enter_sendto")
+int tracepoint_sys_enter_sendto(struct trace_event_raw_sys_enter *ctx) {
+    return handshake_io_enter(ctx, 1);
+}
+
+SEC("tracepoint/syscalls/sys_exit_sendto")
+int tracepoint_sys_exit_sendto(struct trace_event_raw_sys_exit *ctx) {
+    return handshake_io_exit(ctx);
+}
+
+SEC("tracepoint/syscalls/sys_enter_read")
+int tracepoint_sys_enter_read(struct trace_event_raw_sys_enter *ctx) {
+    return handshake_io_enter(ctx, 0);
+}
+
+SEC("tracepoint/syscalls/sys_exit_read")
+int tracepoint_sys_exit_read(struct trace_event_raw_sys_exit *ctx) {
+    return handshake_io_exit(ctx);
+}
+
+SEC("tracepoint/syscalls/sys_enter_recvfrom")
+int tracepoint_sys_enter_recvfrom(struct trace_event_raw_sys_enter *ctx) {
+    return handshake_io_enter(ctx, 0);
+}
+
+SEC("tracepoint/syscalls/sys_exit_recvfrom")
+int tracepoint_sys_exit_recvfrom(struct trace_event_raw_sys_exit *ctx) {
+    return handshake_io_exit(ctx);
+}
+
+static __always_inline int submit_process_event(u32 type) {
+    struct process_event_t *e = bpf_ringbuf_reserve(&process_event_map, sizeof(struct process_event_t), 0);
+    if (!e) {
+        return 0;
+    }
+    e->pid = bpf_get_current_pid_tgid() >> 32;
+    e->type = type;
+    e->filename[0] = 0;
+    bpf_ringbuf_submit(e, 0);
+
+    return 0;
+}
+
+SEC("tracepoint/sched/sched_process_exec")
+int tracepoint_sched_process_exec(void *ctx) {
+    return submit_process_event(PROCESS_EVENT_EXEC);
+}
+
+SEC("tracepoint/sched/sched_process_exit")
+int tracepoint_sched_process_exit(void *ctx) {
+    // Fired by every thread, the process is gone once its main thread exits
+    u64 id = bpf_get_current_pid_tgid();
+    if ((u32)id != id >> 32) {
+        return 0;
+    }
+    return submit_process_event(PROCESS_EVENT_EXIT);
+}
+
+// void *mmap(void *addr, size_t length, int prot, int flags, int fd, off_t offset)
+SEC("tracepoint/syscalls/sys_enter_mmap")
+int tracepoint_sys_enter_mmap(struct trace_event_raw_sys_enter *ctx) {
+    // The dynamic loader maps the code of shared libraries as executable
+    if (!(ctx->args[2] & PROT_EXEC)) {
+        return 0;
+    }
+    struct file *file = fd_file(ctx->args[4]);
+    if (!file) {
+        return 0;
+    }
+
+    u64 id = bpf_get_current_pid_tgid();
+    struct process_event_t e = {};
+    e.pid = id >> 32;
+    e.type = PROCESS_EVENT_MMAP;
+    const unsigned char *name = BPF_CORE_READ(file, f_path.dentry, d_name.name);
+    bpf_probe_read_kernel_str(e.filename, sizeof(e.filename), name);
+    bpf_map_update_elem(&mmap_map, &id, &e, BPF_ANY);
+
+    return 0;
+}
+
+// Reported once mapped, so user space finds the library in /proc/<pid>/maps
+SEC("tracepoint/syscalls/sys_exit_mmap")
+int tracepoint_sys_exit_mmap(struct trace_event_raw_sys_exit *ctx) {
+    u64 id = bpf_get_current_pid_tgid();
+    struct process_event_t *data = bpf_map_lookup_elem(&mmap_map, &id);
+    if (!data) {
+        return 0;
+    }
+    // Errors are returned as -errno
+    if (ctx->ret < 0 && ctx->ret > -4096) {
+        bpf_map_delete_elem(&mmap_map, &id);
+        return 0;
+    }
+
+    struct process_event_t *e = bpf_ringbuf_reserve(&process_event_map, sizeof(struct process_event_t), 0);
+    if (e) {
+        __builtin_memcpy(e, data, sizeof(struct process_event_t));
+        bpf_ringbuf_submit(e, 0);
+    }
+    bpf_map_delete_elem(&mmap_map, &id);
 
     return 0;
 }
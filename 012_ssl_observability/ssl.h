@@ -1,89 +1,153 @@
 #include "vmlinux.h"
 #include <bpf/bpf_tracing.h>
 #include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
 
-#define MIN_METHOD_LEN 8
-#define MIN_RESP_LEN 12
 #define MAX_BUF_SIZE 1024
+// Bytes copied of each socket read or write during a handshake, enough for the hellos and usually the first certificate
+#define MAX_HANDSHAKE_SIZE 4096
 
-#define METHOD_UNKNOWN      0
-#define METHOD_GET          1
-#define METHOD_POST         2
-#define METHOD_PUT          3
-#define METHOD_PATCH        4
-#define METHOD_DELETE       5
-#define METHOD_HEAD         6
-#define METHOD_CONNECT      7
-#define METHOD_OPTIONS      8
-#define METHOD_TRACE        9
+// Go register ABI on amd64 (https://go.dev/s/regabi), arguments and results are passed in the same registers
+#define GO_PARAM1(x) ((x)->ax)
+#define GO_PARAM2(x) ((x)->bx)
+#define GO_PARAM3(x) ((x)->cx)
+// Current goroutine
+#define GO_G(x) ((x)->r14)
+
+// NSPR PRDescType of layered file descriptors, e.g. the SSL layer NSS pushes on sockets
+#define PR_DESC_LAYERED 4
+
+#define AF_INET     2
+#define AF_INET6    10
+#define S_IFMT      00170000
+#define S_IFSOCK    0140000
+#define PROT_EXEC   0x4
 
 const struct ssl_data_event_t *unused __attribute__((unused));
 struct ssl_data_event_t {
+    u64 timestamp_ns; // bpf_ktime_get_ns() when the call returned
+    u64 ssl; // SSL* of the connection, used to pair requests and responses
     u32 pid; 
+    u32 tid;
     u32 len;
+    s32 ret; // Number of bytes read or written, or the return value (<= 0) of a failed SSL call
+    s32 fd; // Socket of the SSL*, -1 if unknown
+    u16 family; // AF_INET or AF_INET6, 0 if the socket couldn't be read
+    u16 lport; // Ports in host byte order
+    u16 rport;
+    u8 laddr[16]; // 4 bytes used for AF_INET
+    u8 raddr[16];
     char egress; // 1 if egress, 0 if ingress
     u8 buf[MAX_BUF_SIZE];
 };
 
+#define HANDSHAKE_EVENT_DATA 0 // Bytes read or written on the socket of the SSL* during the handshake
+#define HANDSHAKE_EVENT_DONE 1 // The handshake function, or the first SSL_read or SSL_write of the SSL*, returned
+
+#define MAX_SERVER_NAME_SIZE 256 // SNI host names are at most 255 bytes
+#define MAX_ALPN_SIZE 32
+
+// Layouts of the SSL libraries, indexed by the cookie of their uprobes
+#define MAX_SSL_LAYOUTS 64
+
+// Offsets of the fields of SSL and of the structures it points to that the getters of a library read, -1 when
+// unknown. User space finds them in the code of the getters.
+const struct ssl_layout *unused_layout __attribute__((unused));
+struct ssl_layout {
+    s32 version;   // int SSL.version, SSL_version
+    s32 server;    // int SSL.server, SSL_is_server
+    s32 session;   // SSL_SESSION *SSL.session, SSL_get_session
+    s32 cipher;    // const SSL_CIPHER *SSL_SESSION.cipher, SSL_SESSION_get0_cipher
+    s32 cipher_id; // u16 IANA ID in SSL_CIPHER, SSL_CIPHER_get_protocol_id
+    s32 alpn;      // unsigned char * of the selected protocol in SSL, SSL_get0_alpn_selected
+    s32 alpn_len;  // unsigned int length of the selected protocol in SSL
+    s32 hostname;  // char *SSL.ext.hostname, SSL_get_servername
+};
+
+const struct ssl_handshake_event_t *unused_handshake __attribute__((unused));
+struct ssl_handshake_event_t {
+    u64 timestamp_ns;
+    u64 start_ns; // bpf_ktime_get_ns() when the handshake function was entered
+    u64 ssl;
+    u32 pid;
+    u32 tid;
+    u32 len;
+    s32 ret; // Number of bytes read or written, or the return value of the handshake function
+    s32 fd; // Socket of the SSL*, -1 if unknown
+    u16 family; // Socket fields are only filled for HANDSHAKE_EVENT_DONE
+    u16 lport;
+    u16 rport;
+    u8 laddr[16];
+    u8 raddr[16];
+    u8 type; // HANDSHAKE_EVENT_*
+    char egress;
+    // What the getters of the SSL* return, for HANDSHAKE_EVENT_DONE when the layout of the library is known
+    u16 version; // 0 if unknown
+    u16 cipher; // 0 if unknown
+    s8 server; // -1 if unknown
+    u8 alpn_len;
+    u8 alpn[MAX_ALPN_SIZE];
+    u8 server_name[MAX_SERVER_NAME_SIZE];
+    u8 buf[MAX_HANDSHAKE_SIZE];
+};
+
+#define PROCESS_EVENT_EXEC 0 // The process executed a new program
+#define PROCESS_EVENT_MMAP 1 // The process mapped a file as executable, e.g. a shared library
+#define PROCESS_EVENT_EXIT 2
+
+#define MAX_FILENAME_SIZE 64
+
+const struct process_event_t *unused_process __attribute__((unused));
+struct process_event_t {
+    u32 pid;
+    u32 type; // PROCESS_EVENT_*
+    u8 filename[MAX_FILENAME_SIZE]; // Name of the mapped file, without its directory
+};
+
+#define TASK_COMM_LEN 16
+
+// Prefilters set by user space, so that the events of other processes don't reach the ring buffers
+const struct filter_config *unused_filter __attribute__((unused));
+struct filter_config {
+    u8 pids; // 1 if only the processes of filter_pid_map are traced
+    u8 comms; // 1 if only the commands of filter_comm_map are traced
+};
+
+struct comm_key {
+    char comm[TASK_COMM_LEN];
+};
+
 struct ssl_read_data {
+    u64 ssl;
     u32 len;
     u64 buf;
+    u64 readbytes; // size_t *readbytes of SSL_read_ex, 0 for SSL_read
+};
+
+// SSL* or BIO* of a process
+struct ssl_key {
+    u64 ptr;
+    u32 pid;
+    u32 pad;
+};
+
+struct ssl_write_ex_data {
+    u64 ssl;
+    u64 buf;
+    u64 written; // size_t *written
 };
 
-static __always_inline int parse_http_status(char *buf) {
-    char b[MIN_RESP_LEN];
-    long r = bpf_probe_read(&b, sizeof(b), (void *)(buf)) ;
-    if (r < 0) {
-        return 0;
-    }
-
-    // e.g. HTTP/1.1 200 OK
-    if (b[0] != 'H' || b[1] != 'T' || b[2] != 'T' || b[3] != 'P' || b[4] != '/') {
-        return -1;
-    }
-    if (b[5] < '0' || b[5] > '9') {
-        return -1;
-    }
-    if (b[6] != '.') {
-        return -1;
-    }
-    if (b[7] < '0' || b[7] > '9') {
-        return -1;
-    }
-    if (b[8] != ' ') {
-        return -1;
-    }
-    if (b[9] < '0' || b[9] > '9' || b[10] < '0' || b[10] > '9' || b[11] < '0' || b[11] > '9') {
-        return -1;
-    }
-    return (b[9]-'0')*100 + (b[10]-'0')*10 + (b[11]-'0');
-}
-
-static __always_inline int parse_http_method(char *buf) {
-    char buf_prefix[MIN_METHOD_LEN];
-    long r = bpf_probe_read(&buf_prefix, sizeof(buf_prefix), (void *)(buf)) ;
-    if (r < 0) {
-        return 0;
-    }
-
-    if (buf_prefix[0] == 'G' && buf_prefix[1] == 'E' && buf_prefix[2] == 'T') {
-         return METHOD_GET;
-    } else if(buf_prefix[0] == 'P' && buf_prefix[1] == 'O' && buf_prefix[2] == 'S' && buf_prefix[3] == 'T') {
-        return METHOD_POST;
-    } else if(buf_prefix[0] == 'P' && buf_prefix[1] == 'U' && buf_prefix[2] == 'T') {
-        return METHOD_PUT;
-    } else if(buf_prefix[0] == 'P' && buf_prefix[1] == 'A' && buf_prefix[2] == 'T' && buf_prefix[3] == 'C' && buf_prefix[4] == 'H') {
-        return METHOD_PATCH;
-    } else if(buf_prefix[0] == 'D' && buf_prefix[1] == 'E' && buf_prefix[2] == 'L' && buf_prefix[3] == 'E' && buf_prefix[4] == 'T' && buf_prefix[5] == 'E') {
-        return METHOD_DELETE;
-    } else if(buf_prefix[0] == 'H' && buf_prefix[1] == 'E' && buf_prefix[2] == 'A' && buf_prefix[3] == 'D') {
-        return METHOD_HEAD;
-    } else if (buf_prefix[0] == 'C' && buf_prefix[1] == 'O' && buf_prefix[2] == 'N' && buf_prefix[3] == 'N' && buf_prefix[4] == 'E' && buf_prefix[5] == 'C' && buf_prefix[6] == 'T') {
-        return METHOD_CONNECT;
-    } else if(buf_prefix[0] == 'O' && buf_prefix[1] == 'P' && buf_prefix[2] == 'T' && buf_prefix[3] == 'I' && buf_prefix[4] == 'O' && buf_prefix[5] == 'N' && buf_prefix[6] == 'S') {
-        return METHOD_OPTIONS;
-    } else if(buf_prefix[0] == 'T' && buf_prefix[1] == 'R' && buf_prefix[2] == 'A' && buf_prefix[3] == 'C' && buf_prefix[4] == 'E') {
-        return METHOD_TRACE;
-    }
-    return -1;
-}
+// Handshake a thread is in, from the entry of SSL_do_handshake, or of the first SSL_read or SSL_write of the SSL*,
+// to its return
+struct ssl_handshake_data {
+    u64 ssl;
+    u64 start_ns;
+};
+
+// Socket read or write of a thread in a handshake, from the syscall entry to exit
+struct handshake_io_data {
+    u64 buf;
+    s32 fd;
+    char egress;
+};
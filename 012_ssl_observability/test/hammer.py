@@ -0,0 +1,93 @@
+#!/usr/bin/env python3
+# Regression test for concurrent SSL_read tracking, run by hand: the tracer needs root
+# to load its BPF programs, so neither CI nor go test run it.
+#
+# Many threads send requests over their own keep-alive connection to the test server,
+# using Python's ssl module (OpenSSL). Every request carries a unique X-Request-Id that
+# the server echoes in its response. Given the tracer output, the test checks that every
+# response was captured exactly once, i.e. no thread reported the buffer of another one.
+#
+#   sudo ./ssl-ebpf 2> tracer.log
+#   python3 hammer.py --log ../tracer.log
+
+import argparse
+import http.client
+import re
+import ssl
+import sys
+import threading
+import time
+import uuid
+
+
+def worker(run_id, thread, requests, errors):
+    context = ssl._create_unverified_context()
+    conn = http.client.HTTPSConnection("localhost", 4445, context=context)
+    try:
+        for i in range(requests):
+            request_id = f"{run_id}-{thread}-{i}"
+            conn.request("GET", "/", headers={"X-Request-Id": request_id})
+            response = conn.getresponse()
+            response.read()
+            if response.getheader("X-Request-Id") != request_id:
+                errors.append(f"{request_id}: server replied {response.getheader('X-Request-Id')}")
+    except Exception as e:
+        errors.append(f"thread {thread}: {e}")
+    finally:
+        conn.close()
+
+
+def check(log_path, run_id, expected):
+    with open(log_path, errors="replace") as f:
+        log = f.read()
+
+    # Split the log into events, keeping only the responses
+    events = re.split(r"^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d ", log, flags=re.MULTILINE)
+    seen = {}
+    for event in events:
+        if not event.startswith("Received"):
+            continue
+        for request_id in re.findall(r"X-Request-Id: (" + re.escape(run_id) + r"-\d+-\d+)", event):
+            seen[request_id] = seen.get(request_id, 0) + 1
+
+    missing = [i for i in expected if i not in seen]
+    duplicated = [i for i, count in seen.items() if count > 1]
+    print(f"captured {len(seen)}/{len(expected)} responses, {len(missing)} missing, {len(duplicated)} duplicated")
+    for i in missing[:10]:
+        print(f"missing: {i}")
+    for i in duplicated[:10]:
+        print(f"duplicated: {i} ({seen[i]} times)")
+    return not missing and not duplicated
+
+
+def main():
+    parser = argparse.ArgumentParser()
+    parser.add_argument("--threads", type=int, default=32)
+    parser.add_argument("--requests", type=int, default=200, help="requests per thread")
+    parser.add_argument("--log", help="tracer output to check")
+    args = parser.parse_args()
+
+    run_id = uuid.uuid4().hex[:8]
+    errors = []
+    threads = [threading.Thread(target=worker, args=(run_id, t, args.requests, errors)) for t in range(args.threads)]
+    start = time.time()
+    for t in threads:
+        t.start()
+    for t in threads:
+        t.join()
+    print(f"run {run_id}: {args.threads * args.requests} requests in {time.time() - start:.2f}s, {len(errors)} errors")
+    for e in errors[:10]:
+        print(e)
+    if errors:
+        sys.exit(1)
+
+    if args.log:
+        # Leave the tracer some time to drain the ring buffer
+        time.sleep(2)
+        expected = [f"{run_id}-{t}-{i}" for t in range(args.threads) for i in range(args.requests)]
+        if not check(args.log, run_id, expected):
+            sys.exit(1)
+
+
+if __name__ == "__main__":
+    main()
@@ -12,6 +12,11 @@ var (
 )
 
 func httpRequestHandler(w http.ResponseWriter, req *http.Request) {
+	// Echo the request ID, so captured responses can be matched with their requests (see hammer.py)
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		w.Header().Set("X-Request-Id", id)
+	}
+
 	switch req.Method {
 	case http.MethodGet:
 		w.Write([]byte("GET request received\n"))
@@ -0,0 +1,110 @@
+#!/usr/bin/env python3
+# Regression test for the redaction of secrets.
+#
+# Replays the auth flow of 003_auth_flow_load_testing against the test server: the register
+# and login payloads, the tokens returned by the login, then the authenticated request with
+# its Bearer token, plus a cookie, an API key in the query string and a form body. Every secret
+# is unique to the run. Given the tracer output, the test checks that the requests were
+# captured and that none of the secrets appears in it.
+#
+#   sudo ./ssl-ebpf 2> tracer.log
+#   python3 redact.py --log ../tracer.log
+
+import argparse
+import base64
+import http.client
+import json
+import os
+import ssl
+import sys
+import time
+import uuid
+
+PAYLOADS = os.path.join(os.path.dirname(os.path.abspath(__file__)), "../../003_auth_flow_load_testing")
+
+
+def payload(name, values):
+    with open(os.path.join(PAYLOADS, name)) as f:
+        body = f.read()
+    for key, value in values.items():
+        body = body.replace("{{" + key + "}}", value)
+    return body
+
+
+def jwt(subject):
+    def part(obj):
+        return base64.urlsafe_b64encode(json.dumps(obj).encode()).rstrip(b"=").decode()
+    return part({"alg": "HS256", "typ": "JWT"}) + "." + part({"sub": subject}) + "." + uuid.uuid4().hex
+
+
+def run(run_id):
+    values = {
+        "username": f"user-{run_id}",
+        "email": f"user-{run_id}@example.com",
+        "password": f"password-{uuid.uuid4().hex}",
+    }
+    access_token = jwt(values["username"])
+    secrets = {
+        "password": values["password"],
+        "access token": access_token,
+        "refresh token": jwt(values["username"]),
+        "cookie": f"session-{uuid.uuid4().hex}",
+        "api key": f"key-{uuid.uuid4().hex}",
+        "form password": f"form-{uuid.uuid4().hex}",
+        "aws key": "AKIA" + uuid.uuid4().hex[:16].upper(),
+    }
+    tokens = json.dumps({"tokens": {"access": secrets["access token"], "refresh": secrets["refresh token"]}})
+
+    requests = [
+        ("POST", "/register/", payload("register_payload.json", values), {"Content-Type": "application/json"}),
+        ("POST", "/login/", payload("login_payload.json", values), {"Content-Type": "application/json"}),
+        # The tokens as the login response would carry them
+        ("POST", "/tokens/", tokens, {"Content-Type": "application/json"}),
+        ("GET", "/user/", None, {"Authorization": f"Bearer {access_token}", "Cookie": f"sessionid={secrets['cookie']}"}),
+        ("GET", f"/search/?q=tls&api_key={secrets['api key']}", None, {}),
+        ("POST", "/form/", f"username={values['username']}&password={secrets['form password']}",
+         {"Content-Type": "application/x-www-form-urlencoded"}),
+        ("POST", "/config/", f"aws_access_key_id = {secrets['aws key']}", {"Content-Type": "text/plain"}),
+    ]
+
+    context = ssl._create_unverified_context()
+    conn = http.client.HTTPSConnection("localhost", 4445, context=context)
+    try:
+        for method, url, body, headers in requests:
+            headers = dict(headers, **{"X-Request-Id": f"{run_id}-{url}"})
+            conn.request(method, url, body=body, headers=headers)
+            conn.getresponse().read()
+    finally:
+        conn.close()
+    return secrets, len(requests)
+
+
+def check(log_path, run_id, secrets, requests):
+    with open(log_path, errors="replace") as f:
+        log = f.read()
+
+    captured = log.count(f"X-Request-Id: {run_id}-")
+    leaked = [name for name, secret in secrets.items() if secret in log]
+    print(f"captured {captured} of {2 * requests} requests and responses, {len(leaked)} secrets leaked")
+    for name in leaked:
+        print(f"leaked: {name}")
+    return captured > 0 and not leaked
+
+
+def main():
+    parser = argparse.ArgumentParser()
+    parser.add_argument("--log", required=True, help="tracer output to check")
+    args = parser.parse_args()
+
+    run_id = uuid.uuid4().hex[:8]
+    secrets, requests = run(run_id)
+    print(f"run {run_id}: {requests} requests")
+
+    # Leave the tracer some time to drain the ring buffer
+    time.sleep(2)
+    if not check(args.log, run_id, secrets, requests):
+        sys.exit(1)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where the trace of a span comes from
+const (
+	traceSourceW3C    = "w3c"    // traceparent header of the request
+	traceSourceB3     = "b3"     // b3 or X-B3-* headers of the request
+	traceSourceThread = "thread" // Incoming request the thread was handling when it sent the request
+	traceSourceReply  = "reply"  // traceresponse header of the response
+	traceSourceNew    = "new"    // None of the above, the span starts a trace
+)
+
+// TraceContext is the position of a span in a distributed trace, as propagated in HTTP headers
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	State   string // W3C tracestate
+}
+
+// ParseTraceContext extracts the context propagated by W3C traceparent and tracestate headers or by B3 headers,
+// in their single or multiple header form, returning the source it was found in
+func ParseTraceContext(h http.Header) (TraceContext, string, bool) {
+	if c, ok := parseTraceparent(h.Get("Traceparent")); ok {
+		c.State = h.Get("Tracestate")
+		return c, traceSourceW3C, true
+	}
+	if b3 := h.Get("B3"); b3 != "" {
+		// {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}, or only the sampling state
+		parts := strings.Split(b3, "-")
+		if len(parts) >= 2 {
+			if c, ok := parseB3(parts[0], parts[1]); ok {
+				return c, traceSourceB3, true
+			}
+		}
+	}
+	if c, ok := parseB3(h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId")); ok {
+		return c, traceSourceB3, true
+	}
+	return TraceContext{}, "", false
+}
+
+// parseTraceparent parses {version}-{trace-id}-{parent-id}-{trace-flags} (https://www.w3.org/TR/trace-context/),
+// future versions being allowed to append fields
+func parseTraceparent(s string) (TraceContext, bool) {
+	var c TraceContext
+	if len(s) < 55 || (len(s) > 55 && (s[:2] == "00" || s[55] != '-')) || s[:2] == "ff" {
+		return c, false
+	}
+	parts := strings.Split(s[:55], "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[3]) != 2 {
+		return c, false
+	}
+	if !decodeID(c.TraceID[:], parts[1]) || !decodeID(c.SpanID[:], parts[2]) {
+		return c, false
+	}
+	return c, true
+}
+
+// parseB3 parses the trace ID, of 64 or 128 bits, and span ID of B3 headers
+func parseB3(traceID, spanID string) (TraceContext, bool) {
+	var c TraceContext
+	ok := false
+	switch len(traceID) {
+	case 16:
+		ok = decodeID(c.TraceID[8:], traceID)
+	case 32:
+		ok = decodeID(c.TraceID[:], traceID)
+	}
+	if !ok || !decodeID(c.SpanID[:], spanID) || c.TraceID == [16]byte{} {
+		return c, false
+	}
+	return c, true
+}
+
+// decodeID decodes a hex ID into dst, which must be filled and not all zeros
+func decodeID(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeSpan is the span of an HTTP exchange, assigned once the headers of its request are known
+type exchangeSpan struct {
+	TraceContext         // Trace and ID of the span
+	parentID     [8]byte // Zero for the root of a trace
+	source       string  // traceSource*
+}
+
+type threadKey struct {
+	Pid uint32
+	Tid uint32
+}
+
+// SpanTracker turns HTTP exchanges into spans of the traces their headers propagate. A request without
+// trace headers sent by a thread handling an incoming request joins the trace of the incoming request,
+// as its span's child: that's how thread-per-request servers make their calls.
+type SpanTracker struct {
+	redactor  *Redactor
+	requests  map[*HTTPMessage]*exchangeSpan
+	handling  map[threadKey]*exchangeSpan // Incoming request each thread is handling
+	services  map[uint32]string           // Command of each process
+	lastSweep uint64
+}
+
+func NewSpanTracker(redactor *Redactor) *SpanTracker {
+	return &SpanTracker{
+		redactor: redactor,
+		requests: make(map[*HTTPMessage]*exchangeSpan),
+		handling: make(map[threadKey]*exchangeSpan),
+		services: make(map[uint32]string),
+	}
+}
+
+// Observe assigns its span to the request an event belongs to, once its headers are known
+func (t *SpanTracker) Observe(event *bpfSslDataEventT, msg *HTTPMessage) {
+	t.sweep(event.TimestampNs)
+	if msg == nil || !msg.Request || msg.Method == "" {
+		return
+	}
+	if _, ok := t.requests[msg]; !ok {
+		t.requests[msg] = t.start(event.Pid, msg)
+	}
+}
+
+func (t *SpanTracker) start(pid uint32, req *HTTPMessage) *exchangeSpan {
+	s := &exchangeSpan{}
+	thread := threadKey{Pid: pid, Tid: req.Tid}
+	incoming := t.handling[thread]
+	c, source, ok := ParseTraceContext(req.Headers)
+	switch {
+	case ok && req.Egress:
+		// The headers carry the ID the client gave its span of the request, the server's span being its child
+		s.TraceContext = c
+		if incoming != nil && incoming.TraceID == c.TraceID {
+			s.parentID = incoming.SpanID
+		}
+		s.source = source
+		return s
+	case ok:
+		s.TraceContext = c
+		s.parentID = c.SpanID
+		s.source = source
+	case req.Egress && incoming != nil:
+		s.TraceID = incoming.TraceID
+		s.State = incoming.State
+		s.parentID = incoming.SpanID
+		s.source = traceSourceThread
+	default:
+		rand.Read(s.TraceID[:])
+		s.source = traceSourceNew
+	}
+	rand.Read(s.SpanID[:])
+
+	if !req.Egress {
+		t.handling[thread] = s
+	}
+	return s
+}
+
+// Finish returns the span of a completed exchange
+func (t *SpanTracker) Finish(e *HTTPExchange, bootTime uint64) *Span {
+	s, ok := t.requests[e.Request]
+	if !ok {
+		s = t.start(e.Pid, e.Request)
+	}
+	t.forget(e.Pid, e.Request, s)
+
+	// The server may tell the trace of a request that had none
+	if s.source == traceSourceNew && e.Request.Egress {
+		if c, ok := parseTraceparent(e.Response.Headers.Get("Traceresponse")); ok {
+			s.TraceID = c.TraceID
+			s.source = traceSourceReply
+		}
+	}
+
+	kind := "SERVER"
+	if e.Request.Egress {
+		kind = "CLIENT"
+	}
+	path, _, _ := strings.Cut(e.Request.URL, "?")
+	span := &Span{
+		TraceID:       hex.EncodeToString(s.TraceID[:]),
+		ID:            hex.EncodeToString(s.SpanID[:]),
+		Kind:          kind,
+		Name:          e.Request.Method + " " + t.redactor.RedactString(path),
+		Timestamp:     int64(e.Request.Start+bootTime) / 1000,
+		Duration:      max(e.Latency.Microseconds(), 1),
+		LocalEndpoint: SpanEndpoint{ServiceName: t.service(e.Pid)},
+		Tags: map[string]string{
+			"http.method":      e.Request.Method,
+			"http.host":        e.Request.Host,
+			"http.path":        t.redactor.RedactString(path),
+			"http.url":         t.redactor.RedactString(e.Request.Host + e.Request.URL),
+			"http.status_code": strconv.Itoa(e.Response.Status),
+			"pid":              strconv.Itoa(int(e.Pid)),
+			"tid":              strconv.Itoa(int(e.Request.Tid)),
+			"trace.source":     s.source,
+		},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.State != "" {
+		span.Tags["w3c.tracestate"] = s.State
+	}
+	if !e.Response.Complete {
+		span.Tags["error"] = "incomplete response"
+	} else if e.Response.Status >= 500 {
+		span.Tags["error"] = strconv.Itoa(e.Response.Status)
+	}
+	if remote := e.Socket.Remote; remote.IsValid() {
+		span.RemoteEndpoint = &SpanEndpoint{Port: remote.Port()}
+		if remote.Addr().Is4() {
+			span.RemoteEndpoint.IPv4 = remote.Addr().String()
+		} else {
+			span.RemoteEndpoint.IPv6 = remote.Addr().String()
+		}
+	}
+	return span
+}
+
+func (t *SpanTracker) forget(pid uint32, req *HTTPMessage, s *exchangeSpan) {
+	delete(t.requests, req)
+	thread := threadKey{Pid: pid, Tid: req.Tid}
+	if t.handling[thread] == s {
+		delete(t.handling, thread)
+	}
+}
+
+// sweep forgets the requests that won't complete, e.g. those of connections closed before their response
+func (t *SpanTracker) sweep(now uint64) {
+	if now-t.lastSweep < uint64(httpIdleTimeout) {
+		return
+	}
+	t.lastSweep = now
+
+	for req, s := range t.requests {
+		if now-req.End > 2*uint64(httpIdleTimeout) {
+			for thread, handled := range t.handling {
+				if handled == s {
+					delete(t.handling, thread)
+				}
+			}
+			delete(t.requests, req)
+		}
+	}
+	// Pids get reused
+	clear(t.services)
+}
+
+// service names a process by its command
+func (t *SpanTracker) service(pid uint32) string {
+	if name, ok := t.services[pid]; ok {
+		return name
+	}
+	name := "pid-" + strconv.Itoa(int(pid))
+	if comm, err := os.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/comm"); err == nil {
+		name = strings.TrimSpace(string(comm))
+	}
+	t.services[pid] = name
+	return name
+}
+
+// Span is a span in the Zipkin v2 JSON format (https://zipkin.io/zipkin-api/#/default/post_spans),
+// which Zipkin, Jaeger and the OpenTelemetry collector accept
+type Span struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId,omitempty"`
+	Kind           string            `json:"kind"`
+	Name           string            `json:"name"`
+	Timestamp      int64             `json:"timestamp"` // Microseconds since the epoch
+	Duration       int64             `json:"duration"`  // Microseconds
+	LocalEndpoint  SpanEndpoint      `json:"localEndpoint"`
+	RemoteEndpoint *SpanEndpoint     `json:"remoteEndpoint,omitempty"`
+	Tags           map[string]string `json:"tags"`
+}
+
+type SpanEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        uint16 `json:"port,omitempty"`
+}
+
+// SpanWriter writes spans to a file, one JSON object per line
+type SpanWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewSpanWriter(path string) (*SpanWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SpanWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (w *SpanWriter) Write(span *Span) error {
+	return w.enc.Encode(span)
+}
+
+func (w *SpanWriter) Close() error {
+	return w.f.Close()
+}
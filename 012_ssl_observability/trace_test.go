@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		ok      bool
+		traceID string
+		spanID  string
+	}{
+		{
+			"version 00",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7",
+		},
+		{
+			"future version with more fields",
+			"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-what-the-future-holds",
+			true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7",
+		},
+		{"version 00 with more fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", false, "", ""},
+		{"version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, "", ""},
+		{"all zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, "", ""},
+		{"all zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, "", ""},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, "", ""},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-0100", false, "", ""},
+		{"truncated", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, "", ""},
+		{"empty", "", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ok := parseTraceparent(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.in, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got := hex.EncodeToString(c.TraceID[:]); got != tt.traceID {
+				t.Errorf("trace ID %s, want %s", got, tt.traceID)
+			}
+			if got := hex.EncodeToString(c.SpanID[:]); got != tt.spanID {
+				t.Errorf("span ID %s, want %s", got, tt.spanID)
+			}
+		})
+	}
+}
+
+func TestParseB3(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ok      bool
+		traceID string
+		spanID  string
+	}{
+		{
+			"single header",
+			map[string]string{"B3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			true, "80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1",
+		},
+		{
+			"single header with a 64 bit trace id",
+			map[string]string{"B3": "64fe8b2a57d3eff7-e457b5a2e4d86bd1"},
+			true, "000000000000000064fe8b2a57d3eff7", "e457b5a2e4d86bd1",
+		},
+		{"single header sampling state only", map[string]string{"B3": "0"}, false, "", ""},
+		{
+			"multiple headers",
+			map[string]string{"X-B3-TraceId": "80f198ee56343ba864fe8b2a57d3eff7", "X-B3-SpanId": "e457b5a2e4d86bd1", "X-B3-Sampled": "1"},
+			true, "80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1",
+		},
+		{
+			"multiple headers with a 64 bit trace id",
+			map[string]string{"X-B3-TraceId": "64fe8b2a57d3eff7", "X-B3-SpanId": "e457b5a2e4d86bd1"},
+			true, "000000000000000064fe8b2a57d3eff7", "e457b5a2e4d86bd1",
+		},
+		{
+			"all zero trace id",
+			map[string]string{"X-B3-TraceId": "0000000000000000", "X-B3-SpanId": "e457b5a2e4d86bd1"},
+			false, "", "",
+		},
+		{
+			"all zero span id",
+			map[string]string{"X-B3-TraceId": "64fe8b2a57d3eff7", "X-B3-SpanId": "0000000000000000"},
+			false, "", "",
+		},
+		{
+			"48 bit trace id",
+			map[string]string{"X-B3-TraceId": "8b2a57d3eff7", "X-B3-SpanId": "e457b5a2e4d86bd1"},
+			false, "", "",
+		},
+		{"no span id", map[string]string{"X-B3-TraceId": "64fe8b2a57d3eff7"}, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, value := range tt.headers {
+				h.Set(name, value)
+			}
+			c, source, ok := ParseTraceContext(h)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceContext(%v) ok = %v, want %v", tt.headers, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if source != traceSourceB3 {
+				t.Errorf("source %s, want %s", source, traceSourceB3)
+			}
+			if got := hex.EncodeToString(c.TraceID[:]); got != tt.traceID {
+				t.Errorf("trace ID %s, want %s", got, tt.traceID)
+			}
+			if got := hex.EncodeToString(c.SpanID[:]); got != tt.spanID {
+				t.Errorf("span ID %s, want %s", got, tt.spanID)
+			}
+		})
+	}
+}
+
+func TestSpanTrackerHeaders(t *testing.T) {
+	tracker := NewSpanTracker(nil)
+	traceparent := func(spanID string) http.Header {
+		h := http.Header{}
+		h.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-"+spanID+"-01")
+		return h
+	}
+	// A server thread handling a request, then calling another service with the same trace
+	incoming := tracker.start(42, &HTTPMessage{Request: true, Tid: 7, Headers: traceparent("00f067aa0ba902b7")})
+	outgoing := tracker.start(42, &HTTPMessage{Request: true, Egress: true, Tid: 7, Headers: traceparent("e457b5a2e4d86bd1")})
+
+	if got := hex.EncodeToString(incoming.parentID[:]); got != "00f067aa0ba902b7" {
+		t.Errorf("incoming request: parent %s, want the span ID of its headers", got)
+	}
+	if incoming.SpanID == incoming.parentID {
+		t.Error("incoming request: span ID of its headers reused")
+	}
+	if got := hex.EncodeToString(outgoing.SpanID[:]); got != "e457b5a2e4d86bd1" {
+		t.Errorf("outgoing request: span %s, want the span ID of its headers", got)
+	}
+	if outgoing.parentID != incoming.SpanID {
+		t.Errorf("outgoing request: parent %x, want the incoming request's span %x", outgoing.parentID, incoming.SpanID)
+	}
+}
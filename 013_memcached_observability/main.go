@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go memcached memcached.c
+
+var mcObjs memcachedObjects
+
+// How often aggregated statistics are logged
+const reportInterval = 10 * time.Second
+
+func main() {
+	// Allow the current process to lock memory for eBPF resources.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load pre-compiled programs and maps into the kernel.
+	mcObjs = memcachedObjects{}
+	if err := loadMemcachedObjects(&mcObjs, nil); err != nil {
+		log.Fatal(err)
+	}
+
+	w, err := link.Tracepoint("syscalls", "sys_enter_write", mcObjs.HandleWrite, nil)
+	if err != nil {
+		log.Fatal("link sys_enter_write tracepoint")
+	}
+	defer w.Close()
+
+	r, err := link.Tracepoint("syscalls", "sys_enter_read", mcObjs.HandleRead, nil)
+	if err != nil {
+		log.Fatal("link sys_enter_read tracepoint")
+	}
+	defer r.Close()
+
+	rexit, err := link.Tracepoint("syscalls", "sys_exit_read", mcObjs.HandleReadExit, nil)
+	if err != nil {
+		log.Fatal("link sys_exit_read tracepoint")
+	}
+	defer rexit.Close()
+
+	L7EventsReader, err := perf.NewReader(mcObjs.L7Events, int(4096)*os.Getpagesize())
+	if err != nil {
+		log.Fatal("error creating perf event array reader")
+	}
+
+	tracker := NewMemcachedTracker()
+	go func() {
+		for range time.Tick(reportInterval) {
+			tracker.Report()
+		}
+	}()
+
+	for {
+		var record perf.Record
+		err := L7EventsReader.ReadInto(&record)
+		if err != nil {
+			log.Print("error reading from perf array")
+		}
+
+		if record.LostSamples != 0 {
+			log.Printf("lost samples l7-event %d", record.LostSamples)
+		}
+
+		if record.RawSample == nil || len(record.RawSample) == 0 {
+			log.Print("read sample l7-event nil or empty")
+			return
+		}
+
+		l7Event := (*bpfL7Event)(unsafe.Pointer(&record.RawSample[0]))
+		protocol := L7ProtocolConversion(l7Event.Protocol).String()
+
+		if protocol == L7_PROTOCOL_MEMCACHED {
+			request := l7Event.Payload[:l7Event.PayloadSize]
+			response := l7Event.ResponsePayload[:l7Event.ResponsePayloadSize]
+
+			var command *MemcachedCommand
+			var result MemcachedResult
+			if MemcachedMethodConversion(l7Event.Method).String() == MEMCACHED_BINARY {
+				command, err = ParseMemcachedBinaryCommand(request)
+				if err == nil {
+					result = ParseMemcachedBinaryResponse(command, response)
+				}
+			} else {
+				command, err = ParseMemcachedTextCommand(request)
+				if err == nil {
+					result = ParseMemcachedTextResponse(command, response)
+				}
+			}
+			if err != nil {
+				log.Println("Error:", err)
+				continue
+			}
+
+			latency := time.Duration(l7Event.Duration)
+			if command.IsRetrieval() && result.Complete {
+				log.Printf("%s -> %s hits: %d misses: %d (%s)\n", command, result.Status, result.Hits, result.Misses, latency)
+			} else {
+				log.Printf("%s -> %s (%s)\n", command, result.Status, latency)
+			}
+			tracker.Observe(command, l7Event.Status, result, latency)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+// Memcached text protocol: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+// Memcached binary protocol: https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	memcachedBinaryHeaderSize    = 24
+	memcachedBinaryRequestMagic  = 0x80
+	memcachedBinaryResponseMagic = 0x81
+)
+
+// Binary protocol opcodes
+var memcachedOpcodes = map[uint8]string{
+	0x00: "get",
+	0x01: "set",
+	0x02: "add",
+	0x03: "replace",
+	0x04: "delete",
+	0x05: "incr",
+	0x06: "decr",
+	0x07: "quit",
+	0x08: "flush",
+	0x09: "getq",
+	0x0a: "noop",
+	0x0b: "version",
+	0x0c: "getk",
+	0x0d: "getkq",
+	0x0e: "append",
+	0x0f: "prepend",
+	0x10: "stat",
+	0x11: "setq",
+	0x12: "addq",
+	0x13: "replaceq",
+	0x14: "deleteq",
+	0x15: "incrq",
+	0x16: "decrq",
+	0x17: "quitq",
+	0x18: "flushq",
+	0x19: "appendq",
+	0x1a: "prependq",
+	0x1c: "touch",
+	0x1d: "gat",
+	0x1e: "gatq",
+	0x23: "gatk",
+	0x24: "gatkq",
+}
+
+// Binary protocol response status
+var memcachedStatuses = map[uint16]string{
+	0x0000: "NO_ERROR",
+	0x0001: "KEY_NOT_FOUND",
+	0x0002: "KEY_EXISTS",
+	0x0003: "VALUE_TOO_LARGE",
+	0x0004: "INVALID_ARGUMENTS",
+	0x0005: "ITEM_NOT_STORED",
+	0x0006: "NON_NUMERIC_VALUE",
+	0x0007: "WRONG_VBUCKET",
+	0x0008: "AUTH_ERROR",
+	0x0009: "AUTH_CONTINUE",
+	0x0081: "UNKNOWN_COMMAND",
+	0x0082: "OUT_OF_MEMORY",
+	0x0083: "NOT_SUPPORTED",
+	0x0084: "INTERNAL_ERROR",
+	0x0085: "BUSY",
+	0x0086: "TEMPORARY_FAILURE",
+}
+
+// Commands that retrieve values, their replies are classified as hits or misses
+var memcachedRetrievalCommands = map[string]bool{
+	"get": true, "gets": true, "gat": true, "gats": true,
+	"getq": true, "getk": true, "getkq": true, "gatq": true, "gatk": true, "gatkq": true,
+}
+
+// MemcachedCommand is a decoded text command line or binary request
+type MemcachedCommand struct {
+	Name   string
+	Keys   []string
+	Flags  uint32
+	Bytes  int // Size of the value sent with storage commands
+	Binary bool
+}
+
+func (c *MemcachedCommand) IsRetrieval() bool {
+	return memcachedRetrievalCommands[c.Name]
+}
+
+func (c *MemcachedCommand) String() string {
+	s := fmt.Sprintf("%s %s", c.Name, strings.Join(c.Keys, " "))
+	if c.Bytes > 0 {
+		s += fmt.Sprintf(" flags: %d bytes: %d", c.Flags, c.Bytes)
+	}
+	return s
+}
+
+// ParseMemcachedTextCommand decodes the first command line of a text request
+func ParseMemcachedTextCommand(payload []byte) (*MemcachedCommand, error) {
+	end := bytes.Index(payload, []byte("\r\n"))
+	if end == -1 {
+		return nil, fmt.Errorf("command line not terminated")
+	}
+	fields := strings.Fields(string(payload[:end]))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("command without key: %q", payload[:end])
+	}
+
+	c := &MemcachedCommand{Name: fields[0]}
+	switch c.Name {
+	case "get", "gets":
+		// get <key>*
+		c.Keys = fields[1:]
+	case "gat", "gats":
+		// gat <exptime> <key>*
+		c.Keys = fields[2:]
+	case "set", "add", "replace", "append", "prepend", "cas":
+		// set <key> <flags> <exptime> <bytes> [noreply]
+		// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+		if len(fields) < 5 || (c.Name == "cas" && len(fields) < 6) {
+			return nil, fmt.Errorf("malformed %s command", c.Name)
+		}
+		c.Keys = fields[1:2]
+		flags, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s flags: %w", c.Name, err)
+		}
+		c.Flags = uint32(flags)
+		if c.Bytes, err = strconv.Atoi(fields[4]); err != nil {
+			return nil, fmt.Errorf("malformed %s bytes: %w", c.Name, err)
+		}
+	case "incr", "decr", "touch", "delete":
+		// incr <key> <value> [noreply], touch <key> <exptime> [noreply], delete <key> [noreply]
+		c.Keys = fields[1:2]
+	default:
+		return nil, fmt.Errorf("unknown command: %s", c.Name)
+	}
+	return c, nil
+}
+
+// ParseMemcachedBinaryCommand decodes the binary request packets of a write.
+// Clients pipeline quiet gets (getq, getkq) followed by a noop, so the keys of every packet are collected.
+func ParseMemcachedBinaryCommand(payload []byte) (*MemcachedCommand, error) {
+	c := &MemcachedCommand{Binary: true}
+	for len(payload) >= memcachedBinaryHeaderSize && payload[0] == memcachedBinaryRequestMagic {
+		opcode := payload[1]
+		keyLen := int(binary.BigEndian.Uint16(payload[2:4]))
+		extrasLen := int(payload[4])
+		bodyLen := int(binary.BigEndian.Uint32(payload[8:12]))
+
+		name, ok := memcachedOpcodes[opcode]
+		if !ok {
+			name = fmt.Sprintf("opcode 0x%02x", opcode)
+		}
+		if c.Name == "" {
+			c.Name = name
+		}
+
+		body := payload[memcachedBinaryHeaderSize:]
+		if extrasLen+keyLen > len(body) {
+			// The packet didn't fit in the copied payload
+			break
+		}
+		if keyLen > 0 {
+			c.Keys = append(c.Keys, string(body[extrasLen:extrasLen+keyLen]))
+		}
+		// set, add and replace extras: flags (4), expiration (4)
+		if extrasLen == 8 && (opcode == 0x01 || opcode == 0x02 || opcode == 0x03 || opcode == 0x11 || opcode == 0x12 || opcode == 0x13) {
+			c.Flags = binary.BigEndian.Uint32(body[0:4])
+			c.Bytes += bodyLen - extrasLen - keyLen
+		}
+
+		if memcachedBinaryHeaderSize+bodyLen > len(payload) {
+			break
+		}
+		payload = payload[memcachedBinaryHeaderSize+bodyLen:]
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("no binary request packet")
+	}
+	return c, nil
+}
+
+// MemcachedResult classifies the reply of a command
+type MemcachedResult struct {
+	Status   string // First status line, e.g. STORED, NOT_FOUND, END, or binary status of the first packet
+	Hits     int
+	Misses   int
+	Complete bool // Whether the whole reply was decoded, otherwise misses are unknown
+}
+
+// ParseMemcachedTextResponse decodes a text reply, counting VALUE blocks for retrieval commands
+func ParseMemcachedTextResponse(c *MemcachedCommand, payload []byte) MemcachedResult {
+	r := MemcachedResult{}
+	for len(payload) > 0 {
+		end := bytes.Index(payload, []byte("\r\n"))
+		if end == -1 {
+			return r
+		}
+		line := string(payload[:end])
+		payload = payload[end+2:]
+
+		if !strings.HasPrefix(line, "VALUE ") {
+			if r.Status == "" {
+				r.Status = line
+			}
+			// END terminates retrieval replies, other commands reply with a single line
+			if line == "END" || !c.IsRetrieval() {
+				r.Complete = true
+				break
+			}
+			continue
+		}
+
+		// VALUE <key> <flags> <bytes> [<cas unique>]\r\n<data block>\r\n
+		if r.Status == "" {
+			r.Status = "VALUE"
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return r
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return r
+		}
+		r.Hits++
+		if size+2 > len(payload) {
+			// The data block didn't fit in the copied payload
+			return r
+		}
+		payload = payload[size+2:]
+	}
+
+	if r.Complete && c.IsRetrieval() {
+		r.Misses = len(c.Keys) - r.Hits
+	}
+	return r
+}
+
+// ParseMemcachedBinaryResponse decodes the binary response packets of a read
+func ParseMemcachedBinaryResponse(c *MemcachedCommand, payload []byte) MemcachedResult {
+	r := MemcachedResult{}
+	for len(payload) >= memcachedBinaryHeaderSize && payload[0] == memcachedBinaryResponseMagic {
+		opcode := payload[1]
+		status := binary.BigEndian.Uint16(payload[6:8])
+		bodyLen := int(binary.BigEndian.Uint32(payload[8:12]))
+
+		if r.Status == "" {
+			name, ok := memcachedStatuses[status]
+			if !ok {
+				name = fmt.Sprintf("status 0x%04x", status)
+			}
+			r.Status = name
+		}
+
+		if memcachedRetrievalCommands[memcachedOpcodes[opcode]] {
+			switch status {
+			case 0x0000:
+				r.Hits++
+			case 0x0001:
+				r.Misses++
+			}
+		}
+
+		// Quiet gets only reply on hits, the noop that follows them ends the reply
+		if opcode == 0x0a || (opcode != 0x09 && opcode != 0x0d && opcode != 0x1e && opcode != 0x24) {
+			r.Complete = true
+		}
+
+		if memcachedBinaryHeaderSize+bodyLen > len(payload) {
+			break
+		}
+		payload = payload[memcachedBinaryHeaderSize+bodyLen:]
+	}
+
+	if r.Complete && c.IsRetrieval() {
+		r.Misses = len(c.Keys) - r.Hits
+	}
+	return r
+}
@@ -0,0 +1,234 @@
+// Memcached protocol specification
+// Text: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+// Binary: https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+// A client sends either a text command line, e.g. "get <key>\r\n", or a binary packet
+// starting with the request magic byte 0x80 followed by a 24 bytes header.
+// The server replies in the same protocol, binary responses starting with the magic byte 0x81.
+
+#include <linux/bpf.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_endian.h>
+
+#define MAX_PAYLOAD_SIZE 1024
+
+#define PROTOCOL_UNKNOWN    0
+#define PROTOCOL_MEMCACHED	1
+
+#define STATUS_SUCCESS 1
+#define STATUS_ERROR 2
+#define STATUS_UNKNOWN 3
+
+#define METHOD_UNKNOWN 0
+#define METHOD_MEMCACHED_TEXT     1
+#define METHOD_MEMCACHED_BINARY   2
+
+#define MEMCACHED_BINARY_HEADER_SIZE 24
+#define MEMCACHED_BINARY_REQUEST_MAGIC 0x80
+#define MEMCACHED_BINARY_RESPONSE_MAGIC 0x81
+
+// Binary response status
+#define MEMCACHED_STATUS_NO_ERROR 0x0000
+#define MEMCACHED_STATUS_KEY_NOT_FOUND 0x0001
+#define MEMCACHED_STATUS_KEY_EXISTS 0x0002
+#define MEMCACHED_STATUS_ITEM_NOT_STORED 0x0005
+
+struct trace_entry {
+	short unsigned int type;
+	unsigned char flags;
+	unsigned char preempt_count;
+	int pid;
+};
+
+struct socket_key {
+    __u64 fd;
+    __u32 pid;
+    __u8 is_tls;
+};
+
+struct read_args {
+    __u64 fd;
+    char* buf;
+    __u64 size;
+    __u64 read_start_ns;  
+};
+
+struct trace_event_raw_sys_enter_write {
+	struct trace_entry ent;
+    __s32 __syscall_nr;
+    __u64 fd;
+    char * buf;
+    __u64 count;
+};
+
+struct trace_event_raw_sys_enter_read{
+    struct trace_entry ent;
+    int __syscall_nr;
+    unsigned long int fd;
+    char * buf;
+    __u64 count;
+};
+
+struct trace_event_raw_sys_exit_read {
+    __u64 unused;
+    __s32 id;
+    __s64 ret;
+};
+
+struct l7_request {
+    __u64 write_time_ns;  
+    __u8 protocol;
+    __u8 method;
+    unsigned char payload[MAX_PAYLOAD_SIZE];
+    __u32 payload_size;
+    __u8 payload_read_complete;
+    __u8 request_type;
+    __u32 seq;
+    __u32 tid;
+};
+
+struct l7_event {
+    __u64 fd;
+    __u64 write_time_ns;
+    __u32 pid;
+    __u32 status;
+    __u64 duration;
+    __u8 protocol;
+    __u8 method;
+    __u16 padding;
+    unsigned char payload[MAX_PAYLOAD_SIZE];
+    __u32 payload_size;
+    __u8 payload_read_complete;
+    __u8 failed;
+    __u8 is_tls;
+    __u32 seq;
+    __u32 tid;
+    unsigned char response_payload[MAX_PAYLOAD_SIZE];
+    __u32 response_payload_size;
+    __u8 response_payload_read_complete;
+};
+
+static __always_inline
+int is_memcached_text_command(char *buf, __u64 buf_size) {
+    // get <key>\r\n is the shortest command
+    if (buf_size < 7) {
+        return 0;
+    }
+    char b[7];
+    if (bpf_probe_read(&b, sizeof(b), (void *)((char *)buf)) < 0) {
+        return 0;
+    }
+
+    // Retrieval commands: get, gets, gat, gats
+    if (b[0] == 'g' && (b[1] == 'e' || b[1] == 'a') && b[2] == 't' && (b[3] == ' ' || (b[3] == 's' && b[4] == ' '))) {
+        return 1;
+    }
+
+    // Storage commands: set, add, cas, append
+    if ((b[0] == 's' && b[1] == 'e' && b[2] == 't' && b[3] == ' ') ||
+        (b[0] == 'a' && b[1] == 'd' && b[2] == 'd' && b[3] == ' ') ||
+        (b[0] == 'c' && b[1] == 'a' && b[2] == 's' && b[3] == ' ') ||
+        (b[0] == 'a' && b[1] == 'p' && b[2] == 'p' && b[3] == 'e' && b[4] == 'n' && b[5] == 'd' && b[6] == ' ')) {
+        return 1;
+    }
+
+    // incr, decr, touch, delete
+    if ((b[0] == 'i' && b[1] == 'n' && b[2] == 'c' && b[3] == 'r' && b[4] == ' ') ||
+        (b[0] == 'd' && b[1] == 'e' && b[2] == 'c' && b[3] == 'r' && b[4] == ' ') ||
+        (b[0] == 't' && b[1] == 'o' && b[2] == 'u' && b[3] == 'c' && b[4] == 'h' && b[5] == ' ') ||
+        (b[0] == 'd' && b[1] == 'e' && b[2] == 'l' && b[3] == 'e' && b[4] == 't' && b[5] == 'e' && b[6] == ' ')) {
+        return 1;
+    }
+
+    // replace and prepend are 8 bytes long including the space
+    if (buf_size < 8) {
+        return 0;
+    }
+    char c;
+    if (bpf_probe_read(&c, sizeof(c), (void *)((char *)buf+7)) < 0) {
+        return 0;
+    }
+    if (c == ' ' && ((b[0] == 'r' && b[1] == 'e' && b[2] == 'p' && b[3] == 'l' && b[4] == 'a' && b[5] == 'c' && b[6] == 'e') ||
+        (b[0] == 'p' && b[1] == 'r' && b[2] == 'e' && b[3] == 'p' && b[4] == 'e' && b[5] == 'n' && b[6] == 'd'))) {
+        return 1;
+    }
+
+    return 0;
+}
+
+static __always_inline
+int is_memcached_binary_request(char *buf, __u64 buf_size) {
+    if (buf_size < MEMCACHED_BINARY_HEADER_SIZE) {
+        return 0;
+    }
+    __u8 b[12];
+    if (bpf_probe_read(&b, sizeof(b), (void *)((char *)buf)) < 0) {
+        return 0;
+    }
+
+    // Magic, opcode, key length (2), extras length, data type (always 0), vbucket (2), total body length (4)
+    if (b[0] != MEMCACHED_BINARY_REQUEST_MAGIC || b[5] != 0) {
+        return 0;
+    }
+
+    __u32 key_len = (b[2] << 8) | b[3];
+    __u32 extras_len = b[4];
+    __u32 body_len = ((__u32)b[8] << 24) | ((__u32)b[9] << 16) | ((__u32)b[10] << 8) | b[11];
+    if (key_len + extras_len > body_len) {
+        return 0;
+    }
+
+    return 1;
+}
+
+static __always_inline
+__u32 parse_memcached_response(char *buf, __u64 buf_size, __u8 method) {
+    if (method == METHOD_MEMCACHED_BINARY) {
+        if (buf_size < MEMCACHED_BINARY_HEADER_SIZE) {
+            return STATUS_UNKNOWN;
+        }
+        __u8 b[8];
+        if (bpf_probe_read(&b, sizeof(b), (void *)((char *)buf)) < 0) {
+            return STATUS_UNKNOWN;
+        }
+        if (b[0] != MEMCACHED_BINARY_RESPONSE_MAGIC) {
+            return STATUS_UNKNOWN;
+        }
+
+        // Misses, CAS conflicts and rejected add/replace are outcomes of the command, not errors
+        __u16 status = (b[6] << 8) | b[7];
+        if (status == MEMCACHED_STATUS_NO_ERROR || status == MEMCACHED_STATUS_KEY_NOT_FOUND ||
+            status == MEMCACHED_STATUS_KEY_EXISTS || status == MEMCACHED_STATUS_ITEM_NOT_STORED) {
+            return STATUS_SUCCESS;
+        }
+        return STATUS_ERROR;
+    }
+
+    if (buf_size < 2) {
+        return STATUS_UNKNOWN;
+    }
+
+    // must end with \r\n
+    char end[2];
+    if (bpf_probe_read(&end, sizeof(end), (void *)((char *)buf+buf_size-2)) < 0) {
+        return STATUS_UNKNOWN;
+    }
+    if (end[0] != '\r' || end[1] != '\n') {
+        return STATUS_UNKNOWN;
+    }
+
+    char b[4];
+    if (bpf_probe_read(&b, sizeof(b), (void *)((char *)buf)) < 0) {
+        return STATUS_UNKNOWN;
+    }
+
+    // ERROR, CLIENT_ERROR <message>, SERVER_ERROR <message>
+    if ((b[0] == 'E' && b[1] == 'R' && b[2] == 'R') ||
+        (b[0] == 'C' && b[1] == 'L' && b[2] == 'I') ||
+        (b[0] == 'S' && b[1] == 'E' && b[2] == 'R' && b[3] == 'V')) {
+        return STATUS_ERROR;
+    }
+
+    return STATUS_SUCCESS;
+}
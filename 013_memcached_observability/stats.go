@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A memcached call slower than 2^24 µs (~16.8 seconds) has in practice timed out, so the last
+// of the buckets gathers them all
+const latencyBuckets = 26
+
+// LatencyHistogram is the latency distribution of a command. Bucket 0 counts the calls under 1 µs,
+// bucket i the ones from 2^(i-1) to 2^i µs.
+type LatencyHistogram struct {
+	Buckets [latencyBuckets]uint64
+	Count   uint64
+	Total   time.Duration
+	Max     time.Duration
+}
+
+func (h *LatencyHistogram) Observe(latency time.Duration) {
+	bucket := 0
+	if us := latency.Microseconds(); us > 0 {
+		bucket = bits.Len64(uint64(us))
+	}
+	if bucket >= latencyBuckets {
+		bucket = latencyBuckets - 1
+	}
+	h.Buckets[bucket]++
+	h.Count++
+	h.Total += latency
+	if latency > h.Max {
+		h.Max = latency
+	}
+}
+
+// String prints the non-empty buckets, e.g. "[256µs, 512µs): 10 [512µs, 1.024ms): 2"
+func (h *LatencyHistogram) String() string {
+	var b strings.Builder
+	for i, count := range h.Buckets {
+		if count == 0 {
+			continue
+		}
+		low, high := time.Duration(0), time.Microsecond
+		if i > 0 {
+			low, high = time.Duration(1<<(i-1))*time.Microsecond, time.Duration(1<<i)*time.Microsecond
+		}
+		if i == latencyBuckets-1 {
+			fmt.Fprintf(&b, "[%s, ...): %d ", low, count)
+		} else {
+			fmt.Fprintf(&b, "[%s, %s): %d ", low, high, count)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+type memcachedCommandStats struct {
+	Calls   uint64
+	Errors  uint64
+	Hits    uint64
+	Misses  uint64
+	Latency LatencyHistogram
+}
+
+// MemcachedTracker aggregates calls, hits, misses and latency per command
+type MemcachedTracker struct {
+	mu       sync.Mutex
+	commands map[string]*memcachedCommandStats
+}
+
+func NewMemcachedTracker() *MemcachedTracker {
+	return &MemcachedTracker{
+		commands: make(map[string]*memcachedCommandStats),
+	}
+}
+
+func (t *MemcachedTracker) Observe(c *MemcachedCommand, status uint32, r MemcachedResult, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.commands[c.Name]
+	if !ok {
+		stats = &memcachedCommandStats{}
+		t.commands[c.Name] = stats
+	}
+	stats.Calls++
+	stats.Latency.Observe(latency)
+	stats.Hits += uint64(r.Hits)
+	stats.Misses += uint64(r.Misses)
+	if status == BPF_STATUS_ERROR {
+		stats.Errors++
+	}
+}
+
+// Report logs calls, errors, hit ratio and the latency histogram of every command
+func (t *MemcachedTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.commands))
+	for name := range t.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := t.commands[name]
+		hitRatio := ""
+		if s.Hits+s.Misses > 0 {
+			hitRatio = fmt.Sprintf(" hits: %d misses: %d (%.2f%% hit)", s.Hits, s.Misses, 100*float64(s.Hits)/float64(s.Hits+s.Misses))
+		}
+		log.Printf("Memcached %s calls: %d errors: %d%s latency avg: %s max: %s %s",
+			name, s.Calls, s.Errors, hitRatio, s.Latency.Total/time.Duration(s.Calls), s.Latency.Max, &s.Latency)
+	}
+}
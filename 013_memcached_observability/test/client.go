@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func main() {
+	// Create a new Memcached client
+	mc := memcache.New("localhost:11211")
+
+	key := "name"
+	value := "anteon"
+
+	// Use the set command to store a key-value pair
+	err := mc.Set(&memcache.Item{Key: key, Value: []byte(value)})
+	if err != nil {
+		log.Fatalf("Could not set key: %v", err)
+	}
+	fmt.Printf("Set key: '%s', value: '%s'\n", key, value)
+
+	// Use the get command to retrieve the value of the key
+	item, err := mc.Get(key)
+	if err != nil {
+		log.Fatalf("Could not get key: %v", err)
+	}
+	fmt.Printf("Got value for '%s': %s\n", key, item.Value)
+
+	// Get several keys at once, 'missing' is a miss
+	items, err := mc.GetMulti([]string{key, "missing"})
+	if err != nil {
+		log.Fatalf("Could not get keys: %v", err)
+	}
+	fmt.Printf("Got %d of 2 keys\n", len(items))
+
+	// Increment a counter
+	err = mc.Set(&memcache.Item{Key: "counter", Value: []byte("1")})
+	if err != nil {
+		log.Fatalf("Could not set counter: %v", err)
+	}
+	counter, err := mc.Increment("counter", 41)
+	if err != nil {
+		log.Fatalf("Could not increment counter: %v", err)
+	}
+	fmt.Printf("Counter: %d\n", counter)
+
+	// Clean up the keys
+	for _, k := range []string{key, "counter"} {
+		if err := mc.Delete(k); err != nil {
+			log.Fatalf("Could not delete key '%s': %v", k, err)
+		}
+	}
+	fmt.Println("Deleted keys 'name', 'counter'")
+
+	// Try to get the value of the deleted key 'name'
+	_, err = mc.Get(key)
+	if err == memcache.ErrCacheMiss {
+		fmt.Printf("Key '%s' does not exist - this is good, because we deleted it :) \n", key)
+	} else if err != nil {
+		log.Fatalf("Error getting key 'name': %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Order is important
+const (
+	BPF_L7_PROTOCOL_UNKNOWN = iota
+	BPF_L7_PROTOCOL_MEMCACHED
+)
+
+const (
+	L7_PROTOCOL_MEMCACHED = "MEMCACHED"
+	L7_PROTOCOL_UNKNOWN   = "UNKNOWN"
+)
+
+// Order is important
+const (
+	BPF_MEMCACHED_METHOD_UNKNOWN = iota
+	METHOD_MEMCACHED_TEXT
+	METHOD_MEMCACHED_BINARY
+)
+
+// for memcached, user space
+const (
+	MEMCACHED_TEXT   = "TEXT"
+	MEMCACHED_BINARY = "BINARY"
+)
+
+// Response status reported by the eBPF program, order is important
+const (
+	BPF_STATUS_SUCCESS = iota + 1
+	BPF_STATUS_ERROR
+	BPF_STATUS_UNKNOWN
+)
+
+type bpfL7Event struct {
+	Fd                          uint64
+	WriteTimeNs                 uint64
+	Pid                         uint32
+	Status                      uint32
+	Duration                    uint64
+	Protocol                    uint8
+	Method                      uint8
+	Padding                     uint16
+	Payload                     [1024]uint8
+	PayloadSize                 uint32
+	PayloadReadComplete         uint8
+	Failed                      uint8
+	IsTls                       uint8
+	_                           [1]byte
+	Seq                         uint32
+	Tid                         uint32
+	ResponsePayload             [1024]uint8
+	ResponsePayloadSize         uint32
+	ResponsePayloadReadComplete uint8
+	_                           [7]byte
+}
+
+// Custom types for the enumeration
+type L7ProtocolConversion uint32
+type MemcachedMethodConversion uint32
+
+// String representation of the enumeration values
+func (e L7ProtocolConversion) String() string {
+	switch e {
+	case BPF_L7_PROTOCOL_MEMCACHED:
+		return L7_PROTOCOL_MEMCACHED
+	case BPF_L7_PROTOCOL_UNKNOWN:
+		return L7_PROTOCOL_UNKNOWN
+	default:
+		return "Unknown"
+	}
+}
+
+// String representation of the enumeration values
+func (e MemcachedMethodConversion) String() string {
+	switch e {
+	case METHOD_MEMCACHED_TEXT:
+		return MEMCACHED_TEXT
+	case METHOD_MEMCACHED_BINARY:
+		return MEMCACHED_BINARY
+	default:
+		return "Unknown"
+	}
+}